@@ -10,8 +10,14 @@ echo "GOROOT: $GOROOT"
 # 清理缓存
 go clean -cache -modcache
 
+# 构建信息（通过 /version 查看）
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+COMMIT=$(git rev-parse HEAD 2>/dev/null || echo unknown)
+BUILD_DATE=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+LDFLAGS="-X main.version=$VERSION -X main.commit=$COMMIT -X main.buildDate=$BUILD_DATE"
+
 # 编译
-go build -o poe-backend main.go
+go build -ldflags "$LDFLAGS" -o poe-backend main.go
 
 if [ $? -eq 0 ]; then
     echo "✅ 编译成功！"
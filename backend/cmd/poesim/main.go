@@ -0,0 +1,61 @@
+// poesim 是 Poe gql_POST 接口的本地模拟器，用于在没有真实 Poe 会话时开发和联调同步逻辑。
+//
+// 模拟逻辑见 internal/poesim，用法：
+//
+//	go run ./cmd/poesim -addr :58300 -records 500 -faults rate_limit=0.2
+//	./poe-backend -poe-base-url http://localhost:58300
+//
+// 运行时控制接口：
+//
+//	GET/PUT /_sim/faults   查看或替换故障概率，如 {"expired_cookie": 1}
+//	POST    /_sim/records  追加 count 条新记录（模拟新的消耗）
+//	GET     /_sim/stats    各查询的请求次数和注入的故障次数
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"poe-points-monitor/internal/poesim"
+)
+
+func main() {
+	addr := flag.String("addr", ":58300", "Address to listen on")
+	records := flag.Int("records", 300, "Number of records to generate when no fixture is given")
+	days := flag.Int("days", 45, "Spread generated records over this many days")
+	fixture := flag.String("fixture", "", "Load records from a JSON or JSONL file (as produced by /api/export)")
+	seed := flag.Int64("seed", 1, "Random seed for generated data and fault injection")
+	faultSpec := flag.String("faults", "", "Faults to inject, e.g. rate_limit=0.2,malformed_json=0.05 (available: "+strings.Join(poesim.FaultNames, ",")+")")
+	cookie := flag.String("cookie", "", "Reject requests whose cookie header differs (empty accepts any)")
+	allotment := flag.Int("allotment", 1000000, "Monthly point allotment reported by settingsPageQuery")
+	retryAfter := flag.Int("retry-after", 2, "Retry-After seconds sent with injected 429 responses")
+	latency := flag.Duration("latency", 0, "Artificial delay added to every gql_POST response")
+	flag.Parse()
+
+	faults, err := poesim.ParseFaults(*faultSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sim, err := poesim.New(poesim.Options{
+		Records:    *records,
+		Days:       *days,
+		Fixture:    *fixture,
+		Seed:       *seed,
+		Faults:     faults,
+		Cookie:     *cookie,
+		Allotment:  *allotment,
+		RetryAfter: *retryAfter,
+		Latency:    *latency,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Poe simulator serving %d records on %s (faults: %v)", sim.Len(), *addr, faults)
+	if err := http.ListenAndServe(*addr, sim.Handler()); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 时序库导出目标：每次同步后把新增记录推送到 InfluxDB（line protocol）或 OTLP/HTTP 端点
+type Exporter struct {
+	ID              int    `json:"id"`
+	Name            string `json:"name"`
+	Kind            string `json:"kind"`                  // influx, otlp
+	Endpoint        string `json:"endpoint"`              // Influx 写入地址（含 db/bucket 参数）或 OTLP 的 /v1/metrics 地址
+	AuthHeader      string `json:"auth_header,omitempty"` // Authorization 头的值，如 "Token xxx"，为空则不发送；只写不返回
+	AuthHeaderSet   bool   `json:"auth_header_set"`
+	BatchSize       int    `json:"batch_size"` // 每个请求最多包含的记录数
+	Enabled         bool   `json:"enabled"`
+	LastRowID       int64  `json:"last_rowid"`     // 高水位：已成功推送的 points_history 最大 rowid
+	LastPushedAt    int64  `json:"last_pushed_at"` // 最近一次成功推送时间（Unix 秒）
+	LastError       string `json:"last_error"`
+	Backfill        *bool  `json:"backfill,omitempty"`          // 仅创建时使用：是否推送已有的历史记录，默认推送
+	ClearAuthHeader bool   `json:"clear_auth_header,omitempty"` // 仅更新时使用：删除已保存的认证头
+}
+
+// 待导出的记录
+type exportRecord struct {
+	RowID int64
+	PointsHistoryNode
+}
+
+const (
+	defaultExporterBatchSize = 1000
+	maxExporterBatchSize     = 5000
+)
+
+var (
+	exporterClient = &http.Client{Timeout: 30 * time.Second}
+	// 串行化推送，避免同步后的自动推送与手动推送重复发送同一批记录
+	exporterMu sync.Mutex
+)
+
+// 标签值中的换行不能出现在 line protocol 中，按转义空格处理；
+// 反斜杠也要转义，否则值末尾的反斜杠会吞掉其后的分隔符
+var lineProtocolTagEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `, "\n", `\ `, "\r", `\ `)
+
+// 编码为 InfluxDB line protocol，时间戳为纳秒（Influx 默认精度）
+func encodeLineProtocol(records []exportRecord) []byte {
+	var buf bytes.Buffer
+	for _, r := range records {
+		buf.WriteString("poe_points")
+		// 标签按键名排序，空值标签不允许出现
+		for _, tag := range [][2]string{
+			{"account", accountLabel(r.Account)},
+			{"bot_id", r.BotID},
+			{"bot_name", r.BotName},
+		} {
+			if tag[1] == "" {
+				continue
+			}
+			buf.WriteString("," + tag[0] + "=" + lineProtocolTagEscaper.Replace(tag[1]))
+		}
+		fmt.Fprintf(&buf, " point_cost=%di %d\n", r.PointCost, r.CreationTime*1000)
+	}
+	return buf.Bytes()
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt"`
+}
+
+// 编码为 OTLP/HTTP JSON 指标：每条记录是 delta 单调 Sum 的一个数据点
+func encodeOTLPMetrics(records []exportRecord) ([]byte, error) {
+	points := make([]otlpNumberDataPoint, 0, len(records))
+	for _, r := range records {
+		ts := strconv.FormatInt(r.CreationTime*1000, 10)
+		points = append(points, otlpNumberDataPoint{
+			Attributes: []otlpKeyValue{
+				{Key: "bot_name", Value: otlpAnyValue{StringValue: r.BotName}},
+				{Key: "bot_id", Value: otlpAnyValue{StringValue: r.BotID}},
+				{Key: "account", Value: otlpAnyValue{StringValue: accountLabel(r.Account)}},
+			},
+			StartTimeUnixNano: ts,
+			TimeUnixNano:      ts,
+			AsInt:             strconv.Itoa(r.PointCost),
+		})
+	}
+
+	payload := gin.H{
+		"resourceMetrics": []gin.H{{
+			"resource": gin.H{
+				"attributes": []otlpKeyValue{{Key: "service.name", Value: otlpAnyValue{StringValue: "poe-points-monitor"}}},
+			},
+			"scopeMetrics": []gin.H{{
+				"scope": gin.H{"name": "poe-points-monitor"},
+				"metrics": []gin.H{{
+					"name":        "poe_points",
+					"description": "Points consumed per message",
+					"unit":        "{point}",
+					"sum": gin.H{
+						"aggregationTemporality": 1, // DELTA
+						"isMonotonic":            true,
+						"dataPoints":             points,
+					},
+				}},
+			}},
+		}},
+	}
+	return json.Marshal(payload)
+}
+
+// 发送一批记录
+func sendExportBatch(e *Exporter, records []exportRecord) error {
+	var body []byte
+	contentType := "text/plain; charset=utf-8"
+	switch e.Kind {
+	case "otlp":
+		var err error
+		if body, err = encodeOTLPMetrics(records); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	default:
+		body = encodeLineProtocol(records)
+	}
+
+	req, err := http.NewRequestWithContext(appCtx, "POST", e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if e.AuthHeader != "" {
+		req.Header.Set("Authorization", e.AuthHeader)
+	}
+
+	resp, err := exporterClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("endpoint returned %d: %s", resp.StatusCode, strings.TrimSpace(string(snippet)))
+	}
+	return nil
+}
+
+// 读取高水位之后的一批记录。rowid 随插入单调递增，导入与合并的旧记录也会被推送
+func loadExportBatch(afterRowID int64, limit int) ([]exportRecord, error) {
+	rows, err := db.Query(`
+		SELECT rowid, id, point_cost, creation_time, bot_name, bot_id, account
+		FROM points_history
+		WHERE rowid > ?
+		ORDER BY rowid
+		LIMIT ?
+	`, afterRowID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []exportRecord
+	for rows.Next() {
+		var r exportRecord
+		if err := rows.Scan(&r.RowID, &r.ID, &r.PointCost, &r.CreationTime, &r.BotName, &r.BotID, &r.Account); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// 推送高水位之后的全部记录，每批成功后立即推进高水位，返回本次推送的记录数
+func pushExporter(e *Exporter) (int, error) {
+	sent := 0
+	for {
+		records, err := loadExportBatch(e.LastRowID, e.BatchSize)
+		if err != nil {
+			return sent, err
+		}
+		if len(records) == 0 {
+			return sent, nil
+		}
+
+		if err := sendExportBatch(e, records); err != nil {
+			e.LastError = err.Error()
+			if _, dbErr := db.Exec("UPDATE exporters SET last_error = ? WHERE id = ?", e.LastError, e.ID); dbErr != nil {
+				log.Printf("Failed to record exporter error: %v", dbErr)
+			}
+			return sent, err
+		}
+
+		e.LastRowID = records[len(records)-1].RowID
+		e.LastPushedAt = time.Now().Unix()
+		e.LastError = ""
+		if _, err := db.Exec(`
+			UPDATE exporters SET last_rowid = ?, last_pushed_at = ?, last_error = '' WHERE id = ?
+		`, e.LastRowID, e.LastPushedAt, e.ID); err != nil {
+			return sent, err
+		}
+		sent += len(records)
+
+		if len(records) < e.BatchSize {
+			return sent, nil
+		}
+	}
+}
+
+// 依次推送所有启用的导出目标（同步完成后调用）
+func runExporters() {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+
+	exporters, err := loadExporters(true)
+	if err != nil {
+		log.Printf("Failed to load exporters: %v", err)
+		return
+	}
+	for i := range exporters {
+		e := &exporters[i]
+		sent, err := pushExporter(e)
+		if err != nil {
+			log.Printf("Exporter %s push failed after %d records: %v", e.Name, sent, err)
+			continue
+		}
+		if sent > 0 {
+			log.Printf("Exporter %s pushed %d records", e.Name, sent)
+		}
+	}
+}
+
+// 加载导出目标
+func loadExporters(onlyEnabled bool) ([]Exporter, error) {
+	query := `
+		SELECT id, name, kind, endpoint, COALESCE(auth_header, ''), COALESCE(batch_size, 0), enabled,
+		       COALESCE(last_rowid, 0), COALESCE(last_pushed_at, 0), COALESCE(last_error, '')
+		FROM exporters
+	`
+	if onlyEnabled {
+		query += " WHERE enabled = 1"
+	}
+	query += " ORDER BY id"
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exporters []Exporter
+	for rows.Next() {
+		var e Exporter
+		var enabled int
+		if err := rows.Scan(&e.ID, &e.Name, &e.Kind, &e.Endpoint, &e.AuthHeader, &e.BatchSize, &enabled,
+			&e.LastRowID, &e.LastPushedAt, &e.LastError); err != nil {
+			return nil, err
+		}
+		e.Enabled = enabled == 1
+		e.AuthHeaderSet = e.AuthHeader != ""
+		if e.BatchSize <= 0 {
+			e.BatchSize = defaultExporterBatchSize
+		}
+		exporters = append(exporters, e)
+	}
+	return exporters, rows.Err()
+}
+
+// 按 ID 加载单个导出目标
+func loadExporter(id string) (*Exporter, error) {
+	exporters, err := loadExporters(false)
+	if err != nil {
+		return nil, err
+	}
+	for i := range exporters {
+		if strconv.Itoa(exporters[i].ID) == id {
+			return &exporters[i], nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// 校验导出目标配置
+func validateExporter(e *Exporter) error {
+	if e.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if e.Kind == "" {
+		e.Kind = "influx"
+	}
+	if e.Kind != "influx" && e.Kind != "otlp" {
+		return fmt.Errorf("kind must be influx or otlp")
+	}
+	if !strings.HasPrefix(e.Endpoint, "http://") && !strings.HasPrefix(e.Endpoint, "https://") {
+		return fmt.Errorf("endpoint must be an http(s) URL")
+	}
+	if e.BatchSize <= 0 {
+		e.BatchSize = defaultExporterBatchSize
+	}
+	if e.BatchSize > maxExporterBatchSize {
+		return fmt.Errorf("batch_size must be at most %d", maxExporterBatchSize)
+	}
+	if e.LastRowID < 0 {
+		return fmt.Errorf("last_rowid must not be negative")
+	}
+	return nil
+}
+
+// 获取导出目标列表
+func getExporters(c *gin.Context) {
+	exporters, err := loadExporters(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if exporters == nil {
+		exporters = []Exporter{}
+	}
+	for i := range exporters {
+		exporters[i].AuthHeader = ""
+	}
+	c.JSON(http.StatusOK, exporters)
+}
+
+// 创建导出目标；backfill=false 时从当前最新记录之后开始推送
+func createExporter(c *gin.Context) {
+	input := Exporter{Enabled: true}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.LastRowID, input.LastPushedAt, input.LastError = 0, 0, ""
+	if err := validateExporter(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Backfill != nil && !*input.Backfill {
+		if err := db.QueryRow("SELECT COALESCE(MAX(rowid), 0) FROM points_history").Scan(&input.LastRowID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	input.Backfill, input.ClearAuthHeader = nil, false
+
+	enabled := 0
+	if input.Enabled {
+		enabled = 1
+	}
+	result, err := db.Exec(`
+		INSERT INTO exporters (name, kind, endpoint, auth_header, batch_size, enabled, last_rowid, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, input.Name, input.Kind, input.Endpoint, input.AuthHeader, input.BatchSize, enabled, input.LastRowID, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	input.ID = int(id)
+	input.AuthHeaderSet = input.AuthHeader != ""
+	input.AuthHeader = ""
+	c.JSON(http.StatusOK, input)
+}
+
+// 更新导出目标；可通过 last_rowid 手动回退或跳过高水位
+func updateExporter(c *gin.Context) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+
+	existing, err := loadExporter(c.Param("id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Exporter not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 未提供的字段保持原值，认证头为空时保留原值，clear_auth_header 删除认证头
+	input := *existing
+	input.AuthHeader = ""
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	switch {
+	case input.ClearAuthHeader && input.AuthHeader != "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "auth_header and clear_auth_header are mutually exclusive"})
+		return
+	case input.ClearAuthHeader:
+	case input.AuthHeader == "":
+		input.AuthHeader = existing.AuthHeader
+	}
+	input.ClearAuthHeader = false
+	input.ID = existing.ID
+	input.Backfill = nil
+	if err := validateExporter(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	enabled := 0
+	if input.Enabled {
+		enabled = 1
+	}
+	_, err = db.Exec(`
+		UPDATE exporters
+		SET name = ?, kind = ?, endpoint = ?, auth_header = ?, batch_size = ?, enabled = ?, last_rowid = ?, updated_at = ?
+		WHERE id = ?
+	`, input.Name, input.Kind, input.Endpoint, input.AuthHeader, input.BatchSize, enabled, input.LastRowID, time.Now(), input.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	input.AuthHeaderSet = input.AuthHeader != ""
+	input.AuthHeader = ""
+	c.JSON(http.StatusOK, input)
+}
+
+// 删除导出目标
+func deleteExporter(c *gin.Context) {
+	result, err := db.Exec("DELETE FROM exporters WHERE id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Exporter not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "导出目标已删除"})
+}
+
+// 立即推送（同步执行，便于查看结果；禁用的目标也可手动推送）
+func pushExporterNow(c *gin.Context) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+
+	e, err := loadExporter(c.Param("id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Exporter not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	sent, err := pushExporter(e)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "sent": sent, "last_rowid": e.LastRowID})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sent": sent, "last_rowid": e.LastRowID})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEncodeLineProtocol(t *testing.T) {
+	records := []exportRecord{
+		{RowID: 1, PointsHistoryNode: PointsHistoryNode{ID: "1", PointCost: 42, CreationTime: 1700000000123456, BotName: "GPT-4o", BotID: "b1"}},
+		{RowID: 2, PointsHistoryNode: PointsHistoryNode{ID: "2", PointCost: 7, CreationTime: 1700000001000000, BotName: "My bot,v=2\nline", Account: "bob"}},
+		{RowID: 3, PointsHistoryNode: PointsHistoryNode{ID: "3", PointCost: 1, CreationTime: 1700000002000000, BotName: `C:\dir\`, BotID: `a\,b`}},
+	}
+	want := "poe_points,account=local,bot_id=b1,bot_name=GPT-4o point_cost=42i 1700000000123456000\n" +
+		"poe_points,account=bob,bot_name=My\\ bot\\,v\\=2\\ line point_cost=7i 1700000001000000000\n" +
+		`poe_points,account=local,bot_id=a\\\,b,bot_name=C:\\dir\\ point_cost=1i 1700000002000000000` + "\n"
+	if got := string(encodeLineProtocol(records)); got != want {
+		t.Errorf("encodeLineProtocol =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestEncodeOTLPMetrics(t *testing.T) {
+	records := []exportRecord{
+		{RowID: 1, PointsHistoryNode: PointsHistoryNode{ID: "1", PointCost: 42, CreationTime: 1700000000123456, BotName: "GPT-4o", BotID: "b1"}},
+	}
+	body, err := encodeOTLPMetrics(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var payload struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []struct {
+					Name string `json:"name"`
+					Sum  struct {
+						AggregationTemporality int                   `json:"aggregationTemporality"`
+						IsMonotonic            bool                  `json:"isMonotonic"`
+						DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+					} `json:"sum"`
+				} `json:"metrics"`
+			} `json:"scopeMetrics"`
+		} `json:"resourceMetrics"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	metric := payload.ResourceMetrics[0].ScopeMetrics[0].Metrics[0]
+	if metric.Name != "poe_points" || metric.Sum.AggregationTemporality != 1 || !metric.Sum.IsMonotonic {
+		t.Errorf("unexpected metric %s", body)
+	}
+	if len(metric.Sum.DataPoints) != 1 {
+		t.Fatalf("got %d data points", len(metric.Sum.DataPoints))
+	}
+	dp := metric.Sum.DataPoints[0]
+	if dp.AsInt != "42" || dp.TimeUnixNano != "1700000000123456000" || dp.StartTimeUnixNano != dp.TimeUnixNano {
+		t.Errorf("unexpected data point %+v", dp)
+	}
+	attrs := map[string]string{}
+	for _, kv := range dp.Attributes {
+		attrs[kv.Key] = kv.Value.StringValue
+	}
+	if attrs["bot_name"] != "GPT-4o" || attrs["bot_id"] != "b1" || attrs["account"] != "local" {
+		t.Errorf("unexpected attributes %v", attrs)
+	}
+}
+
+func TestExporterHighWaterMark(t *testing.T) {
+	setupTestDB(t)
+
+	var mu sync.Mutex
+	var lines []string
+	var auth []string
+	failing := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		auth = append(auth, r.Header.Get("Authorization"))
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		lines = append(lines, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	for i := 1; i <= 5; i++ {
+		insertTestRecords(t, PointsHistoryNode{ID: strconv.Itoa(i), PointCost: i, CreationTime: int64(1700000000000000 + i), BotName: "bot"})
+	}
+
+	r := gin.New()
+	r.GET("/api/exporters", getExporters)
+	r.POST("/api/exporters", createExporter)
+	r.PUT("/api/exporters/:id", updateExporter)
+	w := doJSON(r, "POST", "/api/exporters", `{"name":"influx","endpoint":"`+srv.URL+`","auth_header":"Token abc","batch_size":2}`)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Token abc") || !strings.Contains(w.Body.String(), `"auth_header_set":true`) {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	if w := doJSON(r, "GET", "/api/exporters", ""); strings.Contains(w.Body.String(), "Token abc") {
+		t.Fatalf("list leaks auth header: %s", w.Body)
+	}
+	// 只改批量大小，认证头保持不变
+	if w := doJSON(r, "PUT", "/api/exporters/1", `{"batch_size":2}`); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Token abc") {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+
+	push := func() (int, *Exporter, error) {
+		e, err := loadExporter("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent, err := pushExporter(e)
+		return sent, e, err
+	}
+
+	sent, e, err := push()
+	if err != nil || sent != 5 || e.LastRowID != 5 || len(lines) != 5 {
+		t.Fatalf("first push: sent=%d last_rowid=%d lines=%d err=%v", sent, e.LastRowID, len(lines), err)
+	}
+	if len(auth) != 3 || auth[0] != "Token abc" {
+		t.Errorf("expected 3 batches with auth header, got %v", auth)
+	}
+
+	if sent, _, err := push(); err != nil || sent != 0 {
+		t.Fatalf("second push sent %d, err %v", sent, err)
+	}
+
+	// 导入的较早记录按 rowid 仍会推送
+	insertTestRecords(t, PointsHistoryNode{ID: "old", PointCost: 9, CreationTime: 1600000000000000, BotName: "bot"})
+	if sent, e, err := push(); err != nil || sent != 1 || e.LastRowID != 6 {
+		t.Fatalf("push after import: sent=%d last_rowid=%d err=%v", sent, e.LastRowID, err)
+	}
+
+	// 推送失败时高水位不前进
+	insertTestRecords(t,
+		PointsHistoryNode{ID: "7", PointCost: 1, CreationTime: 1700000000000007, BotName: "bot"},
+		PointsHistoryNode{ID: "8", PointCost: 1, CreationTime: 1700000000000008, BotName: "bot"})
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	if _, e, err := push(); err == nil || e.LastRowID != 6 {
+		t.Fatalf("failed push: last_rowid=%d err=%v", e.LastRowID, err)
+	}
+	var lastRowID int64
+	var lastError string
+	db.QueryRow("SELECT last_rowid, last_error FROM exporters WHERE id = 1").Scan(&lastRowID, &lastError)
+	if lastRowID != 6 || lastError == "" {
+		t.Errorf("after failure: last_rowid=%d last_error=%q", lastRowID, lastError)
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if sent, e, err := push(); err != nil || sent != 2 || e.LastRowID != 8 {
+		t.Fatalf("retry push: sent=%d last_rowid=%d err=%v", sent, e.LastRowID, err)
+	}
+	if len(lines) != 8 {
+		t.Errorf("server received %d lines, want 8", len(lines))
+	}
+}
+
+func TestExporterClearAuthHeader(t *testing.T) {
+	setupTestDB(t)
+	r := gin.New()
+	r.POST("/api/exporters", createExporter)
+	r.PUT("/api/exporters/:id", updateExporter)
+	if w := doJSON(r, "POST", "/api/exporters", `{"name":"influx","endpoint":"http://127.0.0.1:1/write","auth_header":"Token abc"}`); w.Code != http.StatusOK {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+
+	for _, tt := range []struct {
+		body string
+		code int
+		want string
+	}{
+		{`{"auth_header":"Token new","clear_auth_header":true}`, http.StatusBadRequest, "Token abc"},
+		{`{"name":"renamed"}`, http.StatusOK, "Token abc"},
+		{`{"auth_header":"Token new"}`, http.StatusOK, "Token new"},
+		{`{"clear_auth_header":true}`, http.StatusOK, ""},
+	} {
+		w := doJSON(r, "PUT", "/api/exporters/1", tt.body)
+		if w.Code != tt.code {
+			t.Fatalf("%s: status %d: %s", tt.body, w.Code, w.Body)
+		}
+		if w.Code == http.StatusOK && strings.Contains(w.Body.String(), "clear_auth_header") {
+			t.Errorf("%s: response echoes clear_auth_header: %s", tt.body, w.Body)
+		}
+		e, err := loadExporter("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.AuthHeader != tt.want || e.AuthHeaderSet != (tt.want != "") {
+			t.Errorf("%s: auth header = %q (set %v), want %q", tt.body, e.AuthHeader, e.AuthHeaderSet, tt.want)
+		}
+	}
+}
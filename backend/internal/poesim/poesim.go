@@ -0,0 +1,568 @@
+// Package poesim 是 Poe gql_POST 接口的模拟器，供 cmd/poesim 和后端测试使用。
+//
+// 支持 PointsHistoryPageColumnViewerPaginationQuery（游标分页）和 settingsPageQuery，
+// 数据来自随机生成或 fixture 文件（/api/export 导出的 json/jsonl），并可注入故障。
+//
+// 控制接口：
+//
+//	GET/PUT /_sim/faults   查看或替换故障概率，如 {"expired_cookie": 1}
+//	POST    /_sim/records  追加 count 条新记录（模拟新的消耗）
+//	GET     /_sim/stats    各查询的请求次数和注入的故障次数
+package poesim
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	queryPointsHistory = "PointsHistoryPageColumnViewerPaginationQuery"
+	querySettings      = "settingsPageQuery"
+)
+
+// 支持的故障类型
+var FaultNames = []string{
+	"expired_cookie", // 401，模拟 cookie 过期
+	"rate_limit",     // 429 并带 Retry-After
+	"server_error",   // 502
+	"malformed_json", // 200 但响应体被截断
+	"schema_drift",   // 200 但字段被改名
+}
+
+// 积分记录，字段与 /api/export 的 json/jsonl 一致
+type record struct {
+	ID           string `json:"id"`
+	PointCost    int    `json:"point_cost"`
+	CreationTime int64  `json:"creation_time"` // 微秒
+	BotName      string `json:"bot_name"`
+	BotID        string `json:"bot_id"`
+}
+
+type simBot struct {
+	name, id         string
+	weight           int
+	minCost, maxCost int
+}
+
+var simBots = []simBot{
+	{"Claude-3.5-Sonnet", "Qm90OjEwMTI=", 40, 200, 600},
+	{"GPT-4o", "Qm90OjEwMjQ=", 30, 150, 450},
+	{"Gemini-1.5-Pro", "Qm90OjEwMzY=", 15, 100, 300},
+	{"Llama-3-70B", "Qm90OjEwNDg=", 10, 20, 80},
+	{"DALL-E-3", "Qm90OjEwNjA=", 5, 1000, 1500},
+}
+
+// Simulator 保存模拟的记录、故障配置和请求统计，各接口并发安全
+type Simulator struct {
+	mu         sync.Mutex
+	records    []record // 按 creation_time、id 降序
+	nextSeq    int
+	faults     map[string]float64 // 故障名 -> 触发概率
+	rng        *rand.Rand
+	cookie     string // 期望的 cookie，为空不校验
+	allotment  int
+	retryAfter int
+	latency    time.Duration
+	requests   map[string]int
+	injected   map[string]int
+}
+
+// Options 模拟器配置，Days、Seed、Allotment 为零时使用与命令行相同的默认值
+type Options struct {
+	Records    int                // 没有 fixture 时生成的记录数
+	Days       int                // 生成记录分布的天数
+	Fixture    string             // 从 /api/export 导出的 json/jsonl 加载记录
+	Seed       int64              // 生成数据和注入故障的随机种子
+	Faults     map[string]float64 // 故障名 -> 触发概率
+	Cookie     string             // 期望的 cookie，为空不校验
+	Allotment  int                // settingsPageQuery 返回的每月配额
+	RetryAfter int                // 注入 429 时的 Retry-After 秒数
+	Latency    time.Duration      // 每个 gql_POST 响应的额外延迟
+}
+
+// New 按配置创建模拟器并生成或加载记录
+func New(opts Options) (*Simulator, error) {
+	if err := validateFaults(opts.Faults); err != nil {
+		return nil, err
+	}
+	if opts.Days <= 0 {
+		opts.Days = 45
+	}
+	if opts.Seed == 0 {
+		opts.Seed = 1
+	}
+	if opts.Allotment <= 0 {
+		opts.Allotment = 1000000
+	}
+	if opts.Faults == nil {
+		opts.Faults = make(map[string]float64)
+	}
+
+	s := &Simulator{
+		faults:     opts.Faults,
+		rng:        rand.New(rand.NewSource(opts.Seed)),
+		cookie:     opts.Cookie,
+		allotment:  opts.Allotment,
+		retryAfter: opts.RetryAfter,
+		latency:    opts.Latency,
+		requests:   make(map[string]int),
+		injected:   make(map[string]int),
+	}
+	if opts.Fixture != "" {
+		if err := s.loadFixture(opts.Fixture); err != nil {
+			return nil, fmt.Errorf("load fixture: %w", err)
+		}
+	} else {
+		s.generate(opts.Records, opts.Days)
+	}
+	return s, nil
+}
+
+// Handler 返回 gql_POST 接口和 /_sim 控制接口
+func (s *Simulator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/gql_POST", s.handleGraphQL)
+	mux.HandleFunc("/_sim/faults", s.handleFaults)
+	mux.HandleFunc("/_sim/records", s.handleRecords)
+	mux.HandleFunc("/_sim/stats", s.handleStats)
+	return mux
+}
+
+// SetFaults 替换故障配置，与 PUT /_sim/faults 相同
+func (s *Simulator) SetFaults(faults map[string]float64) error {
+	if err := validateFaults(faults); err != nil {
+		return err
+	}
+	if faults == nil {
+		faults = make(map[string]float64)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = faults
+	return nil
+}
+
+// Len 当前记录数
+func (s *Simulator) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.records)
+}
+
+// ParseFaults 解析故障配置，格式为 name[=probability]，逗号分隔
+func ParseFaults(spec string) (map[string]float64, error) {
+	faults := make(map[string]float64)
+	if strings.TrimSpace(spec) == "" {
+		return faults, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		name, value, hasValue := strings.Cut(strings.TrimSpace(part), "=")
+		probability := 1.0
+		if hasValue {
+			p, err := strconv.ParseFloat(value, 64)
+			if err != nil || p < 0 || p > 1 {
+				return nil, fmt.Errorf("invalid probability in %q", part)
+			}
+			probability = p
+		}
+		if err := validateFault(name); err != nil {
+			return nil, err
+		}
+		faults[name] = probability
+	}
+	return faults, nil
+}
+
+func validateFaults(faults map[string]float64) error {
+	for name, p := range faults {
+		if err := validateFault(name); err != nil {
+			return err
+		}
+		if p < 0 || p > 1 {
+			return fmt.Errorf("probability for %s must be between 0 and 1", name)
+		}
+	}
+	return nil
+}
+
+func validateFault(name string) error {
+	for _, f := range FaultNames {
+		if f == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown fault %q, available: %s", name, strings.Join(FaultNames, ","))
+}
+
+// 生成记录 ID，形如 Poe 的 base64 全局 ID
+func (s *Simulator) newID() string {
+	s.nextSeq++
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("PointsHistoryEntry:%d", s.nextSeq)))
+}
+
+// 按权重随机生成一条记录
+func (s *Simulator) randomRecord(at time.Time) record {
+	total := 0
+	for _, b := range simBots {
+		total += b.weight
+	}
+	pick := s.rng.Intn(total)
+	bot := simBots[len(simBots)-1]
+	for _, b := range simBots {
+		if pick < b.weight {
+			bot = b
+			break
+		}
+		pick -= b.weight
+	}
+	return record{
+		ID:           s.newID(),
+		PointCost:    bot.minCost + s.rng.Intn(bot.maxCost-bot.minCost+1),
+		CreationTime: at.UnixMicro(),
+		BotName:      bot.name,
+		BotID:        bot.id,
+	}
+}
+
+// 在最近 days 天内均匀生成 n 条记录
+func (s *Simulator) generate(n, days int) {
+	now := time.Now()
+	span := int64(days) * 24 * int64(time.Hour)
+	for i := 0; i < n; i++ {
+		at := now.Add(-time.Duration(s.rng.Int63n(span)))
+		s.records = append(s.records, s.randomRecord(at))
+	}
+	s.sortRecords()
+}
+
+func (s *Simulator) sortRecords() {
+	sort.Slice(s.records, func(i, j int) bool {
+		if s.records[i].CreationTime != s.records[j].CreationTime {
+			return s.records[i].CreationTime > s.records[j].CreationTime
+		}
+		return s.records[i].ID > s.records[j].ID
+	})
+}
+
+// 加载 fixture：JSON 数组或 JSONL，缺少 ID 的记录自动补齐
+func (s *Simulator) loadFixture(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return err
+	}
+	var records []record
+	if first[0] == '[' {
+		if err := json.NewDecoder(reader).Decode(&records); err != nil {
+			return err
+		}
+	} else {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			var r record
+			if err := json.Unmarshal([]byte(text), &r); err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+			records = append(records, r)
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range records {
+		if r.ID == "" {
+			r.ID = s.newID()
+		}
+		s.records = append(s.records, r)
+	}
+	s.sortRecords()
+	return nil
+}
+
+// 游标编码记录在排序中的位置，新增记录不会影响已发出的游标
+func encodeCursor(r record) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", r.CreationTime, r.ID)))
+}
+
+func decodeCursor(cursor string) (int64, string, error) {
+	raw, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", err
+	}
+	ts, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return 0, "", fmt.Errorf("invalid cursor")
+	}
+	micros, err := strconv.ParseInt(ts, 10, 64)
+	return micros, id, err
+}
+
+// 一页积分历史，cursor 为空时从最新记录开始
+func (s *Simulator) pointsHistoryPage(limit int, cursor string) (map[string]interface{}, error) {
+	start := 0
+	if cursor != "" {
+		ts, id, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		start = sort.Search(len(s.records), func(i int) bool {
+			r := s.records[i]
+			return r.CreationTime < ts || (r.CreationTime == ts && r.ID < id)
+		})
+	}
+	end := start + limit
+	if end > len(s.records) {
+		end = len(s.records)
+	}
+
+	edges := []map[string]interface{}{}
+	endCursor := cursor
+	for _, r := range s.records[start:end] {
+		endCursor = encodeCursor(r)
+		edges = append(edges, map[string]interface{}{
+			"cursor": endCursor,
+			"node": map[string]interface{}{
+				"id":           r.ID,
+				"pointCost":    r.PointCost,
+				"creationTime": r.CreationTime,
+				"bot": map[string]interface{}{
+					"displayName": r.BotName,
+					"id":          r.BotID,
+				},
+			},
+		})
+	}
+
+	return map[string]interface{}{
+		"data": map[string]interface{}{
+			"viewer": map[string]interface{}{
+				"pointsHistoryConnection": map[string]interface{}{
+					"edges": edges,
+					"pageInfo": map[string]interface{}{
+						"endCursor":   endCursor,
+						"hasNextPage": end < len(s.records),
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// 设置页信息：余额为配额减去本周期（每月 1 日重置）的消耗
+func (s *Simulator) settingsPage() map[string]interface{} {
+	now := time.Now()
+	periodStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	nextGrant := periodStart.AddDate(0, 1, 0)
+
+	used := 0
+	for _, r := range s.records {
+		if r.CreationTime < periodStart.UnixMicro() {
+			break
+		}
+		used += r.PointCost
+	}
+	balance := s.allotment - used
+	if balance < 0 {
+		balance = 0
+	}
+
+	return map[string]interface{}{
+		"data": map[string]interface{}{
+			"viewer": map[string]interface{}{
+				"messagePointInfo": map[string]interface{}{
+					"totalMessagePointAllotment": s.allotment,
+					"subscriptionPointBalance":   balance,
+					"computePointNextGrantTime":  nextGrant.UnixMicro(),
+				},
+				"subscription": map[string]interface{}{
+					"expiresTime": nextGrant.UnixMicro(),
+					"subscriptionProduct": map[string]interface{}{
+						"displayName": "Poe Subscription (simulated)",
+					},
+				},
+			},
+		},
+	}
+}
+
+// 按概率决定是否注入故障
+func (s *Simulator) trigger(name string) bool {
+	p := s.faults[name]
+	if p <= 0 || s.rng.Float64() >= p {
+		return false
+	}
+	s.injected[name]++
+	log.Printf("Injecting fault %s", name)
+	return true
+}
+
+// 模拟字段改名
+var schemaDrift = strings.NewReplacer(
+	`"pointsHistoryConnection"`, `"pointsHistory"`,
+	`"pointCost"`, `"cost"`,
+	`"creationTime"`, `"createdAt"`,
+	`"messagePointInfo"`, `"pointInfo"`,
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func graphQLError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{"errors": []map[string]string{{"message": message}}})
+}
+
+func (s *Simulator) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		graphQLError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		QueryName string `json:"queryName"`
+		Variables struct {
+			Limit  int    `json:"limit"`
+			Cursor string `json:"cursor"`
+		} `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		graphQLError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if s.latency > 0 {
+		select {
+		case <-time.After(s.latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[req.QueryName]++
+
+	if (s.cookie != "" && r.Header.Get("cookie") != s.cookie) || s.trigger("expired_cookie") {
+		graphQLError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if s.trigger("rate_limit") {
+		w.Header().Set("Retry-After", strconv.Itoa(s.retryAfter))
+		graphQLError(w, http.StatusTooManyRequests, "Too many requests")
+		return
+	}
+	if s.trigger("server_error") {
+		graphQLError(w, http.StatusBadGateway, "Bad gateway")
+		return
+	}
+
+	var payload map[string]interface{}
+	switch req.QueryName {
+	case queryPointsHistory:
+		limit := req.Variables.Limit
+		if limit <= 0 || limit > 100 {
+			limit = 20
+		}
+		var err error
+		if payload, err = s.pointsHistoryPage(limit, req.Variables.Cursor); err != nil {
+			graphQLError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	case querySettings:
+		payload = s.settingsPage()
+	default:
+		graphQLError(w, http.StatusBadRequest, fmt.Sprintf("unknown queryName %q", req.QueryName))
+		return
+	}
+
+	body, _ := json.Marshal(payload)
+	if s.trigger("schema_drift") {
+		body = []byte(schemaDrift.Replace(string(body)))
+	}
+	if s.trigger("malformed_json") {
+		body = body[:len(body)/2]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// 查看或替换故障配置
+func (s *Simulator) handleFaults(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var faults map[string]float64
+		if err := json.NewDecoder(r.Body).Decode(&faults); err != nil {
+			graphQLError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := validateFaults(faults); err != nil {
+			graphQLError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.faults = faults
+		log.Printf("Faults set to %v", faults)
+	default:
+		graphQLError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.faults)
+}
+
+// 追加新记录，时间从当前时刻起每条间隔 1 秒向前
+func (s *Simulator) handleRecords(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		graphQLError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count <= 0 {
+		count = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for i := 0; i < count; i++ {
+		s.records = append(s.records, s.randomRecord(now.Add(-time.Duration(i)*time.Second)))
+	}
+	s.sortRecords()
+	writeJSON(w, http.StatusOK, map[string]int{"added": count, "total": len(s.records)})
+}
+
+func (s *Simulator) handleStats(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"records":  len(s.records),
+		"requests": s.requests,
+		"injected": s.injected,
+	})
+}
@@ -1,31 +1,70 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
 	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	htmltemplate "html/template"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// 构建信息，通过 -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..." 注入
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
 var db *sql.DB
+
+// Poe 接口地址，可通过 -poe-base-url 或 POE_BASE_URL 指向本地模拟器（cmd/poesim）
+var poeBaseURL = "https://poe.com"
 var appDataDir string
-var autoFetchTicker *time.Ticker
-var autoFetchStop chan bool
-var isAutoFetching bool
-var lastAutoFetchTime time.Time
-var lastAutoFetchResult string
+var processStartTime = time.Now()
 var frontendLogFile *os.File
 
+// 进程级上下文，关闭服务时取消，用于中断进行中的同步和推送
+var appCtx, cancelAppCtx = context.WithCancel(context.Background())
+
+// 进行中的同步、导出推送和后台定时任务，关闭服务时等待其结束
+var backgroundTasks sync.WaitGroup
+
 // 数据库模型
 type PointsHistoryNode struct {
 	ID           string    `json:"id"`
@@ -35,13 +74,17 @@ type PointsHistoryNode struct {
 	BotID        string    `json:"bot_id"`
 	Cursor       string    `json:"cursor"`
 	CreatedAt    time.Time `json:"created_at"`
+	Account      string    `json:"account,omitempty"` // 空表示本机账户
 }
 
 // Poe API 响应结构
 type PoeResponse struct {
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
 	Data struct {
 		Viewer struct {
-			PointsHistoryConnection struct {
+			PointsHistoryConnection *struct {
 				Edges []struct {
 					Node struct {
 						ID           string `json:"id"`
@@ -63,6 +106,24 @@ type PoeResponse struct {
 	} `json:"data"`
 }
 
+// 检查积分历史响应：GraphQL 错误、缺少 pointsHistoryConnection 或记录缺少 id/creationTime
+// 都说明请求失败或接口字段已变化，不能当作没有新记录
+func (r *PoeResponse) validate() error {
+	if len(r.Errors) > 0 {
+		return fmt.Errorf("Poe GraphQL error: %s", r.Errors[0].Message)
+	}
+	conn := r.Data.Viewer.PointsHistoryConnection
+	if conn == nil {
+		return errors.New("unexpected Poe response: missing pointsHistoryConnection")
+	}
+	for _, edge := range conn.Edges {
+		if edge.Node.ID == "" || edge.Node.CreationTime == 0 {
+			return errors.New("unexpected Poe response: record without id or creationTime")
+		}
+	}
+	return nil
+}
+
 // 统计数据结构
 type AggregatedStats struct {
 	Timestamp   string `json:"timestamp"`
@@ -81,12 +142,18 @@ type Config struct {
 	SubscriptionDay      int       `json:"subscription_day"`      // 每月订阅日（1-31）
 	SubscriptionAmount   float64   `json:"subscription_amount"`   // 每月订阅金额
 	SubscriptionCurrency string    `json:"subscription_currency"` // 订阅货币类型（如 HKD, USD, CNY）
+	DisplayCurrency      string    `json:"display_currency"`      // 费用显示货币（默认 USD）
 	AutoFetchInterval    int       `json:"auto_fetch_interval"`   // 自动拉取间隔（分钟）
 	AutoFetchEnabled     bool      `json:"auto_fetch_enabled"`    // 是否启用自动拉取
+	AutoFetchMode        string    `json:"auto_fetch_mode"`       // interval, cron, adaptive
+	AutoFetchCron        string    `json:"auto_fetch_cron"`       // cron 表达式（分 时 日 月 周），cron 模式使用
+	QuietHours           string    `json:"quiet_hours"`           // 静默时段 HH:MM-HH:MM，为空表示无
+	AdaptiveMinInterval  int       `json:"adaptive_min_interval"` // 自适应模式最短间隔（分钟）
+	AdaptiveMaxInterval  int       `json:"adaptive_max_interval"` // 自适应模式最长间隔（分钟）
 	UpdatedAt            time.Time `json:"updated_at"`
 }
 
-// 汇率映射（相对于USD）
+// 内置静态汇率表（相对于USD），未配置其他汇率来源时使用
 var currencyRates = map[string]float64{
 	"USD": 1.0,
 	"HKD": 0.128,  // 1 HKD ≈ 0.128 USD
@@ -97,15 +164,517 @@ var currencyRates = map[string]float64{
 	"TWD": 0.031,  // 1 TWD ≈ 0.031 USD
 }
 
-// 将金额转换为美元
+// 将金额转换为美元（使用当前汇率）
 func convertToUSD(amount float64, currency string) float64 {
-	rate, ok := currencyRates[currency]
+	return convertToUSDAt(amount, currency, time.Now())
+}
+
+// 将金额按指定时间生效的汇率转换为美元
+func convertToUSDAt(amount float64, currency string, at time.Time) float64 {
+	rate, _, ok := getUSDRate(currency, at)
 	if !ok {
+		log.Printf("No exchange rate for currency %q, treating as USD", currency)
 		rate = 1.0 // 默认当作美元处理
 	}
 	return amount * rate
 }
 
+// 汇率报价（1 单位货币折合多少美元）
+type RateQuote struct {
+	Date     string  `json:"date"`
+	Currency string  `json:"currency"`
+	USDRate  float64 `json:"usd_rate"`
+}
+
+// 汇率来源
+type RateProvider interface {
+	Name() string
+	FetchRates() ([]RateQuote, error)
+}
+
+// 内置静态汇率表
+type staticRateProvider struct{}
+
+func (staticRateProvider) Name() string { return "static" }
+
+func (staticRateProvider) FetchRates() ([]RateQuote, error) {
+	today := time.Now().Format("2006-01-02")
+	quotes := make([]RateQuote, 0, len(currencyRates))
+	for currency, rate := range currencyRates {
+		quotes = append(quotes, RateQuote{Date: today, Currency: currency, USDRate: rate})
+	}
+	return quotes, nil
+}
+
+// 从本地 ECB 格式文件（XML 或 CSV）读取汇率
+type fileRateProvider struct {
+	path string
+}
+
+func (p fileRateProvider) Name() string { return "file" }
+
+func (p fileRateProvider) FetchRates() ([]RateQuote, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	return parseECBRates(data)
+}
+
+// 从 URL 拉取 ECB 格式汇率
+type urlRateProvider struct {
+	url    string
+	client *http.Client
+}
+
+func (p urlRateProvider) Name() string { return "url" }
+
+func (p urlRateProvider) FetchRates() ([]RateQuote, error) {
+	req, err := http.NewRequestWithContext(appCtx, "GET", p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rate source returned status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseECBRates(data)
+}
+
+// ECB XML 格式：<Cube><Cube time="..."><Cube currency="USD" rate="1.08"/></Cube></Cube>
+type ecbEnvelope struct {
+	Days []struct {
+		Time  string `xml:"time,attr"`
+		Rates []struct {
+			Currency string  `xml:"currency,attr"`
+			Rate     float64 `xml:"rate,attr"`
+		} `xml:"Cube"`
+	} `xml:"Cube>Cube"`
+}
+
+// 解析 ECB 格式汇率（以 EUR 为基准），自动识别 XML 或 CSV
+func parseECBRates(data []byte) ([]RateQuote, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '<' {
+		return parseECBXML(trimmed)
+	}
+	return parseECBCSV(data)
+}
+
+func parseECBXML(data []byte) ([]RateQuote, error) {
+	var envelope ecbEnvelope
+	if err := xml.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+
+	var quotes []RateQuote
+	for _, day := range envelope.Days {
+		eurRates := map[string]float64{}
+		for _, r := range day.Rates {
+			eurRates[strings.ToUpper(r.Currency)] = r.Rate
+		}
+		dayQuotes, err := eurRatesToUSD(day.Time, eurRates)
+		if err != nil {
+			return nil, err
+		}
+		quotes = append(quotes, dayQuotes...)
+	}
+	if len(quotes) == 0 {
+		return nil, fmt.Errorf("no rates found in XML")
+	}
+	return quotes, nil
+}
+
+// ECB CSV 格式：表头 Date, USD, JPY, ...，每行一个日期
+func parseECBCSV(data []byte) ([]RateQuote, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 || !strings.EqualFold(strings.TrimSpace(records[0][0]), "date") {
+		return nil, fmt.Errorf("CSV must have a header row starting with Date")
+	}
+
+	header := records[0]
+	var quotes []RateQuote
+	for _, record := range records[1:] {
+		if len(record) == 0 || strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		date, err := parseRateDate(strings.TrimSpace(record[0]))
+		if err != nil {
+			return nil, err
+		}
+
+		eurRates := map[string]float64{}
+		for i := 1; i < len(record) && i < len(header); i++ {
+			currency := strings.ToUpper(strings.TrimSpace(header[i]))
+			var rate float64
+			if currency == "" {
+				continue
+			}
+			if _, err := fmt.Sscanf(strings.TrimSpace(record[i]), "%g", &rate); err != nil || rate <= 0 {
+				continue // N/A 或空值
+			}
+			eurRates[currency] = rate
+		}
+
+		dayQuotes, err := eurRatesToUSD(date, eurRates)
+		if err != nil {
+			return nil, err
+		}
+		quotes = append(quotes, dayQuotes...)
+	}
+	if len(quotes) == 0 {
+		return nil, fmt.Errorf("no rates found in CSV")
+	}
+	return quotes, nil
+}
+
+// 解析汇率日期（YYYY-MM-DD 或 ECB 的 "02 January 2006"）
+func parseRateDate(value string) (string, error) {
+	for _, layout := range []string{"2006-01-02", "02 January 2006", "2 January 2006"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Format("2006-01-02"), nil
+		}
+	}
+	return "", fmt.Errorf("invalid rate date %q", value)
+}
+
+// 将以 EUR 为基准的汇率换算为每单位货币折合的美元
+func eurRatesToUSD(date string, eurRates map[string]float64) ([]RateQuote, error) {
+	usdPerEUR, ok := eurRates["USD"]
+	if !ok || usdPerEUR <= 0 {
+		return nil, fmt.Errorf("USD rate missing for %s", date)
+	}
+
+	quotes := []RateQuote{{Date: date, Currency: "EUR", USDRate: usdPerEUR}}
+	for currency, rate := range eurRates {
+		if currency == "EUR" {
+			continue
+		}
+		quotes = append(quotes, RateQuote{Date: date, Currency: currency, USDRate: usdPerEUR / rate})
+	}
+	return quotes, nil
+}
+
+// ISO 4217 现行货币代码
+var iso4217Codes = func() map[string]bool {
+	codes := map[string]bool{}
+	for _, code := range strings.Fields(`
+		AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BRL BSD BTN BWP BYN BZD
+		CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD
+		GNF GTQ GYD HKD HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT
+		LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR
+		NZD OMR PAB PEN PGK PHP PKR PLN PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP
+		STN SVC SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS UAH UGX USD UYU UZS VES VND VUV WST XAF XCD XOF
+		XPF YER ZAR ZMW ZWL`) {
+		codes[code] = true
+	}
+	return codes
+}()
+
+// 常见的非标准写法及对应的 ISO 代码
+var currencyAliases = map[string]string{
+	"RMB": "CNY",
+	"NTD": "TWD",
+	"NT$": "TWD",
+	"HK$": "HKD",
+	"US$": "USD",
+}
+
+// 规范化并校验货币代码，必须是 ISO 4217 代码且有可用汇率
+func normalizeCurrency(currency string) (string, error) {
+	code := strings.ToUpper(strings.TrimSpace(currency))
+	if code == "" {
+		return "USD", nil
+	}
+	if alias, ok := currencyAliases[code]; ok {
+		return "", fmt.Errorf("unsupported currency %q, did you mean %s?", currency, alias)
+	}
+	if !iso4217Codes[code] {
+		return "", fmt.Errorf("unsupported currency %q: not an ISO 4217 code", currency)
+	}
+	if _, _, ok := getUSDRate(code, time.Now()); !ok {
+		return "", fmt.Errorf("unsupported currency %q: no exchange rate available", code)
+	}
+	return code, nil
+}
+
+// 支持的货币及当前汇率
+type CurrencyInfo struct {
+	Code     string  `json:"code"`
+	USDRate  float64 `json:"usd_rate"`
+	RateDate string  `json:"rate_date"` // 空表示来自内置静态表
+}
+
+// 获取支持的货币列表
+func getCurrencies(c *gin.Context) {
+	now := time.Now()
+	rates := getRatesAt(now)
+
+	currencies := make([]CurrencyInfo, 0, len(rates))
+	for code := range rates {
+		if !iso4217Codes[code] {
+			continue
+		}
+		rate, rateDate, _ := getUSDRate(code, now)
+		currencies = append(currencies, CurrencyInfo{Code: code, USDRate: rate, RateDate: rateDate})
+	}
+	sort.Slice(currencies, func(i, j int) bool { return currencies[i].Code < currencies[j].Code })
+
+	c.JSON(http.StatusOK, currencies)
+}
+
+// 汇率设置
+type FXSettings struct {
+	Provider     string `json:"provider"`      // static, file, url
+	Source       string `json:"source"`        // 文件路径或 URL
+	PollInterval int    `json:"poll_interval"` // 刷新间隔（分钟）
+}
+
+// 读取汇率设置
+func loadFXSettings() FXSettings {
+	settings := FXSettings{Provider: "static", PollInterval: 1440}
+	db.QueryRow(`
+		SELECT COALESCE(provider, 'static'), COALESCE(source, ''), COALESCE(poll_interval, 1440)
+		FROM fx_settings WHERE id = 1
+	`).Scan(&settings.Provider, &settings.Source, &settings.PollInterval)
+	return settings
+}
+
+// 根据设置创建汇率来源
+func newRateProvider(settings FXSettings) (RateProvider, error) {
+	switch settings.Provider {
+	case "", "static":
+		return staticRateProvider{}, nil
+	case "file":
+		if settings.Source == "" {
+			return nil, fmt.Errorf("source path is required for file provider")
+		}
+		return fileRateProvider{path: settings.Source}, nil
+	case "url":
+		if !strings.HasPrefix(settings.Source, "http://") && !strings.HasPrefix(settings.Source, "https://") {
+			return nil, fmt.Errorf("source must be an http(s) URL for url provider")
+		}
+		return urlRateProvider{url: settings.Source, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("provider must be static, file or url")
+	}
+}
+
+// 从当前汇率来源拉取汇率并写入 fx_rates 缓存
+func refreshRates() (int, error) {
+	provider, err := newRateProvider(loadFXSettings())
+	if err != nil {
+		return 0, err
+	}
+	// 静态表本身就是查询时的兜底，无需写入缓存
+	if provider.Name() == "static" {
+		return 0, nil
+	}
+	quotes, err := provider.FetchRates()
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(`
+		INSERT OR REPLACE INTO fx_rates (rate_date, currency, usd_rate, source, fetched_at)
+		VALUES (?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+
+	fetchedAt := time.Now()
+	for _, q := range quotes {
+		if _, err := stmt.Exec(q.Date, q.Currency, q.USDRate, provider.Name(), fetchedAt); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	log.Printf("Refreshed %d exchange rates from %s provider", len(quotes), provider.Name())
+	return len(quotes), nil
+}
+
+// 启动汇率定时刷新，关闭服务时退出
+func startRateRefresher() {
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		for {
+			if _, err := refreshRates(); err != nil {
+				log.Printf("Exchange rate refresh error: %v", err)
+			}
+			interval := loadFXSettings().PollInterval
+			if interval <= 0 {
+				interval = 1440
+			}
+			if sleepContext(appCtx, time.Duration(interval)*time.Minute) != nil {
+				return
+			}
+		}
+	}()
+}
+
+// 查询指定时间生效的汇率：优先取当天或之前最近的缓存汇率，
+// 没有更早记录时取最早的缓存汇率，都没有时回退到静态表；
+// 汇率来源设为 static 时忽略缓存，直接使用静态表
+func getUSDRate(currency string, at time.Time) (float64, string, bool) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	date := at.Format("2006-01-02")
+	var rate float64
+	var rateDate string
+
+	if useCachedRates() {
+		err := db.QueryRow(`
+			SELECT usd_rate, rate_date FROM fx_rates
+			WHERE currency = ? AND rate_date <= ?
+			ORDER BY rate_date DESC LIMIT 1
+		`, currency, date).Scan(&rate, &rateDate)
+		if err == nil {
+			return rate, rateDate, true
+		}
+		err = db.QueryRow(`
+			SELECT usd_rate, rate_date FROM fx_rates
+			WHERE currency = ?
+			ORDER BY rate_date ASC LIMIT 1
+		`, currency).Scan(&rate, &rateDate)
+		if err == nil {
+			return rate, rateDate, true
+		}
+	}
+
+	rate, ok := currencyRates[currency]
+	return rate, "", ok
+}
+
+// 当前汇率来源是否使用 fx_rates 缓存
+func useCachedRates() bool {
+	if db == nil {
+		return false
+	}
+	provider := loadFXSettings().Provider
+	return provider != "" && provider != "static"
+}
+
+// 获取指定时间生效的全部汇率
+func getRatesAt(at time.Time) map[string]float64 {
+	currencies := map[string]bool{}
+	for currency := range currencyRates {
+		currencies[currency] = true
+	}
+	if useCachedRates() {
+		if rows, err := db.Query("SELECT DISTINCT currency FROM fx_rates"); err == nil {
+			for rows.Next() {
+				var currency string
+				if rows.Scan(&currency) == nil {
+					currencies[currency] = true
+				}
+			}
+			rows.Close()
+		}
+	}
+
+	rates := make(map[string]float64, len(currencies))
+	for currency := range currencies {
+		if rate, _, ok := getUSDRate(currency, at); ok {
+			rates[currency] = rate
+		}
+	}
+	return rates
+}
+
+// 获取汇率设置
+func getFXSettings(c *gin.Context) {
+	c.JSON(http.StatusOK, loadFXSettings())
+}
+
+// 保存汇率设置并立即刷新
+func saveFXSettings(c *gin.Context) {
+	input := loadFXSettings()
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Provider == "" {
+		input.Provider = "static"
+	}
+	if input.PollInterval <= 0 {
+		input.PollInterval = 1440
+	}
+	if _, err := newRateProvider(input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err := db.Exec(`
+		INSERT OR REPLACE INTO fx_settings (id, provider, source, poll_interval, updated_at)
+		VALUES (1, ?, ?, ?, ?)
+	`, input.Provider, input.Source, input.PollInterval, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	count, err := refreshRates()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": "汇率设置已保存", "refresh_error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "汇率设置已保存", "refreshed": count})
+}
+
+// 手动刷新汇率
+func refreshFXRates(c *gin.Context) {
+	count, err := refreshRates()
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"refreshed": count})
+}
+
+// 获取指定日期生效的汇率（date 默认为今天）
+func getFXRates(c *gin.Context) {
+	at := time.Now()
+	if date := c.Query("date"); date != "" {
+		t, err := time.ParseInLocation("2006-01-02", date, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date, expected YYYY-MM-DD"})
+			return
+		}
+		at = t
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"date":  at.Format("2006-01-02"),
+		"rates": getRatesAt(at),
+	})
+}
+
 // CORS Middleware
 func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -164,7 +733,8 @@ func initDB() {
 		bot_name TEXT NOT NULL,
 		bot_id TEXT NOT NULL,
 		cursor TEXT NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		account TEXT NOT NULL DEFAULT ''
 	);
 	CREATE INDEX IF NOT EXISTS idx_creation_time ON points_history(creation_time);
 	CREATE INDEX IF NOT EXISTS idx_created_at ON points_history(created_at);
@@ -179,6 +749,7 @@ func initDB() {
 		subscription_day INTEGER DEFAULT 1,
 		subscription_amount REAL DEFAULT 0,
 		subscription_currency TEXT DEFAULT 'USD',
+		display_currency TEXT DEFAULT 'USD',
 		auto_fetch_interval INTEGER DEFAULT 30,
 		auto_fetch_enabled INTEGER DEFAULT 0,
 		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
@@ -195,82 +766,435 @@ func initDB() {
 	if _, err := db.Exec(createTable); err != nil {
 		log.Fatal(err)
 	}
-}
 
-// 检查记录是否存在
-func recordExists(id string) (bool, error) {
-	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM points_history WHERE id = ?)", id).Scan(&exists)
-	return exists, err
-}
+	// 迁移失败不退出，/healthz、/readyz 和 /version 仍可用于排查；
+	// 依赖新结构的 /api 路由和后台任务由 schemaErr 停用
+	if schemaErr = migrateSchema(); schemaErr != nil {
+		log.Printf("Schema migration failed: %v", schemaErr)
+		return
+	}
 
-// 插入记录
-func insertRecord(node *PointsHistoryNode) error {
-	_, err := db.Exec(`
-		INSERT INTO points_history (id, point_cost, creation_time, bot_name, bot_id, cursor, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, node.ID, node.PointCost, node.CreationTime, node.BotName, node.BotID, node.Cursor, node.CreatedAt)
-	return err
+	if err := seedSubscriptionPlans(); err != nil {
+		log.Fatal(err)
+	}
 }
 
-// 计算指定月份的订阅周期开始和结束时间（微秒时间戳）
-func getSubscriptionPeriod(year, month, subscriptionDay int) (int64, int64) {
-	// 当前周期开始时间
-	periodStart := time.Date(year, time.Month(month), subscriptionDay, 0, 0, 0, 0, time.Local)
+// 结构迁移失败的原因，为 nil 表示数据库结构已是当前版本
+var schemaErr error
 
-	// 下个周期开始时间（下个月的同一天）
-	nextMonth := month + 1
-	nextYear := year
-	if nextMonth > 12 {
-		nextMonth = 1
-		nextYear++
+// 结构迁移：执行 stmt（建表、建索引），或在 table 缺少 column 时补充该列。
+// 每次启动都会按顺序重新执行全部迁移，因此每一项都必须可重复执行
+type schemaMigration struct {
+	table, column, definition string
+	stmt                      string
+}
+
+func (m schemaMigration) apply() error {
+	if m.stmt != "" {
+		_, err := db.Exec(m.stmt)
+		return err
 	}
-	periodEnd := time.Date(nextYear, time.Month(nextMonth), subscriptionDay, 0, 0, 0, 0, time.Local)
+	if err := ensureColumn(m.table, m.column, m.definition); err != nil {
+		return fmt.Errorf("add %s.%s: %w", m.table, m.column, err)
+	}
+	return nil
+}
 
-	return periodStart.UnixMicro(), periodEnd.UnixMicro()
+// 按顺序追加的结构迁移，只能在末尾添加新项
+var schemaMigrations = []schemaMigration{
+	{table: "config", column: "display_currency", definition: "TEXT DEFAULT 'USD'"},
+	{table: "points_history", column: "account", definition: "TEXT NOT NULL DEFAULT ''"},
+	{table: "config", column: "auto_fetch_mode", definition: "TEXT DEFAULT 'interval'"},
+	{table: "config", column: "auto_fetch_cron", definition: "TEXT DEFAULT ''"},
+	{table: "config", column: "quiet_hours", definition: "TEXT DEFAULT ''"},
+	{table: "config", column: "adaptive_min_interval", definition: "INTEGER DEFAULT 5"},
+	{table: "config", column: "adaptive_max_interval", definition: "INTEGER DEFAULT 120"},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS points_snapshots (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			total_allotment INTEGER NOT NULL,
+			current_balance INTEGER NOT NULL,
+			next_grant_time INTEGER,
+			captured_at INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_snapshots_captured_at ON points_snapshots(captured_at);
+	`},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS point_anomalies (
+			record_id TEXT PRIMARY KEY,
+			bot_name TEXT NOT NULL,
+			point_cost INTEGER NOT NULL,
+			creation_time INTEGER NOT NULL,
+			baseline_median REAL NOT NULL,
+			baseline_mad REAL NOT NULL,
+			score REAL NOT NULL,
+			severity TEXT NOT NULL,
+			detected_at INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_anomalies_creation_time ON point_anomalies(creation_time);
+	`},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS budgets (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			scope TEXT NOT NULL,
+			bot_name TEXT,
+			period TEXT NOT NULL,
+			window_start INTEGER,
+			window_end INTEGER,
+			threshold_type TEXT NOT NULL,
+			threshold REAL NOT NULL,
+			enabled INTEGER DEFAULT 1,
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL,
+			account TEXT NOT NULL DEFAULT ''
+		);
+	`},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS alerts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			budget_id INTEGER NOT NULL,
+			budget_name TEXT NOT NULL,
+			bot_name TEXT NOT NULL DEFAULT '',
+			period_start INTEGER NOT NULL,
+			period_end INTEGER NOT NULL,
+			used_points INTEGER NOT NULL,
+			threshold_points REAL NOT NULL,
+			message TEXT NOT NULL,
+			triggered_at INTEGER NOT NULL,
+			acknowledged INTEGER DEFAULT 0,
+			UNIQUE(budget_id, bot_name, period_start)
+		);
+		CREATE INDEX IF NOT EXISTS idx_alerts_triggered_at ON alerts(triggered_at);
+	`},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS webhook_targets (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			kind TEXT NOT NULL DEFAULT 'generic',
+			url TEXT NOT NULL,
+			secret TEXT,
+			events TEXT DEFAULT '*',
+			template TEXT,
+			enabled INTEGER DEFAULT 1,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			target_id INTEGER NOT NULL,
+			event TEXT NOT NULL,
+			payload TEXT,
+			attempt INTEGER NOT NULL,
+			status_code INTEGER,
+			error TEXT,
+			success INTEGER DEFAULT 0,
+			delivered_at INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_target ON webhook_deliveries(target_id);
+	`},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS email_settings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			smtp_host TEXT,
+			smtp_port INTEGER DEFAULT 25,
+			tls_mode TEXT DEFAULT 'none',
+			username TEXT,
+			password TEXT,
+			from_address TEXT,
+			recipients TEXT,
+			daily_enabled INTEGER DEFAULT 0,
+			daily_hour INTEGER DEFAULT 8,
+			cycle_enabled INTEGER DEFAULT 0,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS fx_rates (
+			rate_date TEXT NOT NULL,
+			currency TEXT NOT NULL,
+			usd_rate REAL NOT NULL,
+			source TEXT,
+			fetched_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (rate_date, currency)
+		);
+		CREATE INDEX IF NOT EXISTS idx_fx_rates_currency ON fx_rates(currency, rate_date);
+	`},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS fx_settings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			provider TEXT DEFAULT 'static',
+			source TEXT,
+			poll_interval INTEGER DEFAULT 1440,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS cycle_allotments (
+			period_start INTEGER PRIMARY KEY,
+			poe_allotment INTEGER,
+			manual_allotment INTEGER,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS subscription_plans (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			effective_from INTEGER NOT NULL UNIQUE,
+			amount REAL NOT NULL DEFAULT 0,
+			currency TEXT NOT NULL DEFAULT 'USD',
+			allotment INTEGER DEFAULT 0,
+			subscription_day INTEGER NOT NULL DEFAULT 1,
+			note TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS point_purchases (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			purchased_at INTEGER NOT NULL,
+			points INTEGER NOT NULL,
+			amount REAL NOT NULL DEFAULT 0,
+			currency TEXT NOT NULL DEFAULT 'USD',
+			source TEXT NOT NULL DEFAULT 'manual',
+			snapshot_id INTEGER,
+			note TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_point_purchases_purchased_at ON point_purchases(purchased_at);
+	`},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS exporters (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			kind TEXT NOT NULL DEFAULT 'influx',
+			endpoint TEXT NOT NULL,
+			auth_header TEXT,
+			batch_size INTEGER DEFAULT 1000,
+			enabled INTEGER DEFAULT 1,
+			last_rowid INTEGER DEFAULT 0,
+			last_pushed_at INTEGER,
+			last_error TEXT,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS app_state (
+			key TEXT PRIMARY KEY,
+			value TEXT,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`},
+	{stmt: `
+		CREATE TABLE IF NOT EXISTS accounts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			cookie TEXT,
+			form_key TEXT,
+			tchannel TEXT,
+			revision TEXT,
+			tag_id TEXT,
+			subscription_day INTEGER DEFAULT 1,
+			subscription_amount REAL DEFAULT 0,
+			subscription_currency TEXT DEFAULT 'USD',
+			source_path TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`},
+	{table: "budgets", column: "account", definition: "TEXT NOT NULL DEFAULT ''"},
 }
 
-// 计算指定时间戳所在的订阅周期
-func getCurrentSubscriptionPeriod(subscriptionDay int, timestamp int64) (int64, int64) {
-	t := time.Unix(timestamp/1000000, 0)
-	year := t.Year()
-	month := int(t.Month())
-	day := t.Day()
+// 当前代码期望的数据库结构版本（记录在 PRAGMA user_version 中）
+func schemaVersion() int {
+	return len(schemaMigrations)
+}
 
-	// 如果当前日期小于订阅日，说明还在上个月的周期内
-	if day < subscriptionDay {
-		month--
-		if month < 1 {
-			month = 12
-			year--
+// 执行结构迁移，全部成功后才提升 user_version，且从不降低
+func migrateSchema() error {
+	var current int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&current); err != nil {
+		return err
+	}
+	for i, m := range schemaMigrations {
+		if err := m.apply(); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
 		}
 	}
-
-	return getSubscriptionPeriod(year, month, subscriptionDay)
+	if current >= schemaVersion() {
+		if current > schemaVersion() {
+			log.Printf("Database schema version %d is newer than this build (%d)", current, schemaVersion())
+		}
+		return nil
+	}
+	_, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersion()))
+	return err
 }
 
-// 获取所有历史记录（用于表格展示）
-func getAllHistory(c *gin.Context) {
+// 结构迁移失败时拒绝 /api 请求，避免在缺表缺列的数据库上读写
+func requireSchema(c *gin.Context) {
+	if schemaErr != nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "database schema migration failed: " + schemaErr.Error()})
+		return
+	}
+	c.Next()
+}
+
+// 如果表中不存在指定列则添加
+func ensureColumn(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// 可执行 SQL 的数据库或事务
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// 检查记录是否存在
+func recordExists(id string) (bool, error) {
+	return recordExistsWith(db, id)
+}
+
+func recordExistsWith(q sqlExecutor, id string) (bool, error) {
+	var exists bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM points_history WHERE id = ?)", id).Scan(&exists)
+	return exists, err
+}
+
+// 插入记录
+func insertRecord(node *PointsHistoryNode) error {
+	return insertRecordWith(db, node)
+}
+
+func insertRecordWith(q sqlExecutor, node *PointsHistoryNode) error {
+	_, err := q.Exec(`
+		INSERT INTO points_history (id, point_cost, creation_time, bot_name, bot_id, cursor, created_at, account)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, node.ID, node.PointCost, node.CreationTime, node.BotName, node.BotID, node.Cursor, node.CreatedAt, node.Account)
+	return err
+}
+
+// 计算指定月份的订阅周期开始和结束时间（微秒时间戳）
+func getSubscriptionPeriod(year, month, subscriptionDay int) (int64, int64) {
+	// 当前周期开始时间
+	periodStart := time.Date(year, time.Month(month), subscriptionDay, 0, 0, 0, 0, time.Local)
+
+	// 下个周期开始时间（下个月的同一天）
+	nextMonth := month + 1
+	nextYear := year
+	if nextMonth > 12 {
+		nextMonth = 1
+		nextYear++
+	}
+	periodEnd := time.Date(nextYear, time.Month(nextMonth), subscriptionDay, 0, 0, 0, 0, time.Local)
+
+	return periodStart.UnixMicro(), periodEnd.UnixMicro()
+}
+
+// 计算指定时间戳所在的订阅周期
+func getCurrentSubscriptionPeriod(subscriptionDay int, timestamp int64) (int64, int64) {
+	t := time.Unix(timestamp/1000000, 0)
+	year := t.Year()
+	month := int(t.Month())
+	day := t.Day()
+
+	// 如果当前日期小于订阅日，说明还在上个月的周期内
+	if day < subscriptionDay {
+		month--
+		if month < 1 {
+			month = 12
+			year--
+		}
+	}
+
+	return getSubscriptionPeriod(year, month, subscriptionDay)
+}
+
+// 计算相对当前周期偏移 offset 个周期的订阅周期（0=当前周期，-1=上个周期）
+func getSubscriptionPeriodByOffset(subscriptionDay, offset int) (int64, int64) {
+	now := time.Now()
+	year := now.Year()
+	month := int(now.Month()) + offset
+
+	// 如果当前日期小于订阅日，当前周期从上个月开始
+	if now.Day() < subscriptionDay {
+		month--
+	}
+	for month < 1 {
+		month += 12
+		year--
+	}
+	for month > 12 {
+		month -= 12
+		year++
+	}
+
+	return getSubscriptionPeriod(year, month, subscriptionDay)
+}
+
+// 带费用的历史记录
+type PointsHistoryWithCost struct {
+	PointsHistoryNode
+	CostUSD      float64 `json:"cost_usd"`
+	Cost         float64 `json:"cost"`
+	CostCurrency string  `json:"cost_currency"`
+}
+
+// 获取所有历史记录（用于表格展示），本机账户的记录附带按所在周期单积分价值计算的费用
+func getAllHistory(c *gin.Context) {
 	limit := c.DefaultQuery("limit", "10000") // 默认最多返回 10000 条
 	offset := c.DefaultQuery("offset", "0")
+	account := requestAccount(c)
+
+	costs, err := newCostCalculator(c.Query("currency"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	query := `
 		SELECT id, point_cost, creation_time, bot_name, bot_id, cursor, created_at
 		FROM points_history
+		WHERE ` + accountFilter + `
 		ORDER BY creation_time DESC
 		LIMIT ? OFFSET ?
 	`
 
-	rows, err := db.Query(query, limit, offset)
+	rows, err := db.Query(query, account, limit, offset)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	defer rows.Close()
 
-	var history []PointsHistoryNode
+	var history []PointsHistoryWithCost
 	for rows.Next() {
-		var node PointsHistoryNode
+		var node PointsHistoryWithCost
 		if err := rows.Scan(
 			&node.ID,
 			&node.PointCost,
@@ -283,880 +1207,6331 @@ func getAllHistory(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		// 订阅价格只适用于本机账户，合并进来的账户不计费用
+		if account == localAccount {
+			node.CostUSD, node.Cost = costs.recordCost(node.ID, node.CreationTime, node.PointCost)
+			node.CostCurrency = costs.currency
+		}
 		history = append(history, node)
 	}
 
 	c.JSON(http.StatusOK, history)
 }
 
-// 获取统计数据
-func getStats(c *gin.Context) {
-	granularity := c.Query("granularity") // minute, hour, halfday, day
-	chartType := c.Query("type")          // discrete, cumulative
-	periodOffset := c.Query("period")     // 周期偏移量（0=当前月，-1=上个月，1=下个月）
+// 导出可选的列（按此顺序输出）
+var exportColumns = []string{"id", "time", "creation_time", "bot_name", "bot_id", "point_cost", "account", "cursor", "created_at", "cost_usd", "cost"}
 
-	if granularity == "" {
-		granularity = "hour"
+// 未指定 columns 时导出的列
+var defaultExportColumns = []string{"id", "time", "creation_time", "bot_name", "bot_id", "point_cost", "account"}
+
+// 导出时每写入多少行刷新一次响应
+const exportFlushRows = 500
+
+// 解析导出列，保持用户指定的顺序
+func parseExportColumns(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return defaultExportColumns, nil
 	}
-	if chartType == "" {
-		chartType = "discrete"
+	var columns []string
+	seen := make(map[string]bool)
+	for _, column := range strings.Split(value, ",") {
+		column = strings.TrimSpace(column)
+		if column == "" || seen[column] {
+			continue
+		}
+		valid := false
+		for _, c := range exportColumns {
+			if c == column {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown column %q, available: %s", column, strings.Join(exportColumns, ","))
+		}
+		seen[column] = true
+		columns = append(columns, column)
 	}
-
-	offset := 0
-	if periodOffset != "" {
-		fmt.Sscanf(periodOffset, "%d", &offset)
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns selected")
 	}
+	return columns, nil
+}
 
-	// 获取订阅日配置
-	var subscriptionDay int
-	err := db.QueryRow("SELECT COALESCE(subscription_day, 1) FROM config ORDER BY id DESC LIMIT 1").Scan(&subscriptionDay)
-	if err != nil {
-		subscriptionDay = 1
+// 账户显示名（空表示本机账户）
+func accountLabel(account string) string {
+	if account == "" {
+		return "local"
 	}
+	return account
+}
 
-	// 计算查询的时间范围
-	now := time.Now()
-	targetMonth := int(now.Month()) + offset
-	targetYear := now.Year()
+// 本机账户在 points_history.account 中为空
+const localAccount = ""
 
-	for targetMonth < 1 {
-		targetMonth += 12
-		targetYear--
-	}
-	for targetMonth > 12 {
-		targetMonth -= 12
-		targetYear++
+// 积分记录的账户过滤条件，参数为账户名
+const accountFilter = "COALESCE(account, '') = ?"
+
+// 解析账户名，local 表示本机账户
+func parseAccount(account string) string {
+	if account == "local" {
+		return localAccount
 	}
+	return account
+}
 
-	periodStart, periodEnd := getSubscriptionPeriod(targetYear, targetMonth, subscriptionDay)
+// 读取请求的 account 参数，未指定时为本机账户
+func requestAccount(c *gin.Context) string {
+	return parseAccount(c.Query("account"))
+}
 
-	// 如果是当前月且当前日期小于订阅日，应该用上个月的周期
-	if offset == 0 && now.Day() < subscriptionDay {
-		targetMonth--
-		if targetMonth < 1 {
-			targetMonth = 12
-			targetYear--
-		}
-		periodStart, periodEnd = getSubscriptionPeriod(targetYear, targetMonth, subscriptionDay)
+// 导出积分历史（format=csv|jsonl|json），逐行从数据库游标写出，不在内存中缓存全部记录
+// 过滤参数：start/end（YYYY-MM-DD 或微秒，end 不含）、bot（逗号分隔）、account；
+// columns 选择导出列，tz 指定格式化时间（time 列）使用的时区
+func exportHistory(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "jsonl" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv, jsonl or json"})
+		return
 	}
 
-	var groupBy string
-
-	switch granularity {
-	case "minute":
-		groupBy = "strftime('%Y-%m-%d %H:%M', datetime(creation_time / 1000000, 'unixepoch', 'localtime'))"
-	case "hour":
-		groupBy = "strftime('%Y-%m-%d %H:00', datetime(creation_time / 1000000, 'unixepoch', 'localtime'))"
-	case "halfday":
-		// 半天：将一天分为上午(00:00-11:59)和下午(12:00-23:59)
-		// 上午显示为 00:00，下午显示为 12:00，便于前端解析
-		groupBy = `
-			strftime('%Y-%m-%d', datetime(creation_time / 1000000, 'unixepoch', 'localtime')) || 
-			CASE 
-				WHEN CAST(strftime('%H', datetime(creation_time / 1000000, 'unixepoch', 'localtime')) AS INTEGER) < 12 
-				THEN ' 00:00' 
-				ELSE ' 12:00' 
-			END
-		`
-	case "day":
-		groupBy = "strftime('%Y-%m-%d', datetime(creation_time / 1000000, 'unixepoch', 'localtime'))"
-	default:
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid granularity"})
+	columns, err := parseExportColumns(c.Query("columns"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	var query string
-	if chartType == "cumulative" {
-		// 累积图表：计算累积总和
-		query = fmt.Sprintf(`
-			WITH time_groups AS (
-				SELECT 
-					%s as time_group,
-					SUM(point_cost) as point_cost,
-					COUNT(*) as record_count
-				FROM points_history
-				WHERE creation_time >= ? AND creation_time < ?
-				GROUP BY time_group
-				ORDER BY time_group
-			)
-			SELECT 
-				time_group,
-				SUM(point_cost) OVER (ORDER BY time_group) as cumulative_cost,
-				SUM(record_count) OVER (ORDER BY time_group) as cumulative_count
-			FROM time_groups
-		`, groupBy)
+	location := time.Local
+	if tz := c.Query("tz"); tz != "" {
+		location, err = time.LoadLocation(tz)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid tz %q", tz)})
+			return
+		}
+	}
+
+	query := `
+		SELECT id, point_cost, creation_time, bot_name, bot_id, cursor, created_at, COALESCE(account, '')
+		FROM points_history
+		WHERE 1 = 1
+	`
+	var args []interface{}
+	for _, param := range []struct{ name, clause string }{
+		{"start", " AND creation_time >= ?"},
+		{"end", " AND creation_time < ?"},
+	} {
+		if value := c.Query(param.name); value != "" {
+			micros, err := parseTimeParam(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			query += param.clause
+			args = append(args, micros)
+		}
+	}
+	if bots := c.Query("bot"); bots != "" {
+		names := strings.Split(bots, ",")
+		placeholders := make([]string, len(names))
+		for i, name := range names {
+			placeholders[i] = "?"
+			args = append(args, strings.TrimSpace(name))
+		}
+		query += " AND bot_name IN (" + strings.Join(placeholders, ",") + ")"
+	}
+	if account, ok := c.GetQuery("account"); ok {
+		query += " AND " + accountFilter
+		args = append(args, parseAccount(account))
+	}
+	if c.Query("order") == "desc" {
+		query += " ORDER BY creation_time DESC, id DESC"
 	} else {
-		// 分立图表：每个时间段的独立数据
-		query = fmt.Sprintf(`
-			SELECT 
-				%s as time_group,
-				SUM(point_cost) as point_cost,
-				COUNT(*) as record_count
-			FROM points_history
-			WHERE creation_time >= ? AND creation_time < ?
-			GROUP BY time_group
-			ORDER BY time_group
-		`, groupBy)
+		query += " ORDER BY creation_time, id"
+	}
+
+	// 仅在导出费用列时计算费用
+	var costs *costCalculator
+	for _, column := range columns {
+		if column == "cost_usd" || column == "cost" {
+			costs, err = newCostCalculator(c.Query("currency"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			break
+		}
 	}
 
-	rows, err := db.Query(query, periodStart, periodEnd)
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	defer rows.Close()
 
-	var stats []AggregatedStats
+	contentTypes := map[string]string{
+		"csv":   "text/csv; charset=utf-8",
+		"jsonl": "application/x-ndjson",
+		"json":  "application/json",
+	}
+	filename := fmt.Sprintf("poe-points-%s.%s", time.Now().Format("20060102-150405"), format)
+	c.Header("Content-Type", contentTypes[format])
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	// 状态码已先发出，中途出错时通过 trailer 告知客户端导出不完整
+	c.Header("Trailer", "X-Export-Error")
+	c.Status(http.StatusOK)
+
+	w := c.Writer
+	csvWriter := csv.NewWriter(w)
+	switch format {
+	case "csv":
+		csvWriter.Write(columns)
+	case "json":
+		w.WriteString("[")
+	}
+
+	count := 0
+	var exportErr error
 	for rows.Next() {
-		var s AggregatedStats
-		if err := rows.Scan(&s.Timestamp, &s.PointCost, &s.RecordCount); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+		var node PointsHistoryNode
+		var account string
+		if exportErr = rows.Scan(&node.ID, &node.PointCost, &node.CreationTime, &node.BotName, &node.BotID,
+			&node.Cursor, &node.CreatedAt, &account); exportErr != nil {
+			break
 		}
-		stats = append(stats, s)
+
+		var costUSD, cost float64
+		if costs != nil {
+			costUSD, cost = costs.recordCost(node.ID, node.CreationTime, node.PointCost)
+		}
+
+		values := make([]interface{}, len(columns))
+		for i, column := range columns {
+			switch column {
+			case "id":
+				values[i] = node.ID
+			case "time":
+				values[i] = time.UnixMicro(node.CreationTime).In(location).Format(time.RFC3339)
+			case "creation_time":
+				values[i] = node.CreationTime
+			case "bot_name":
+				values[i] = node.BotName
+			case "bot_id":
+				values[i] = node.BotID
+			case "point_cost":
+				values[i] = node.PointCost
+			case "account":
+				values[i] = accountLabel(account)
+			case "cursor":
+				values[i] = node.Cursor
+			case "created_at":
+				values[i] = node.CreatedAt.In(location).Format(time.RFC3339)
+			case "cost_usd":
+				values[i] = costUSD
+			case "cost":
+				values[i] = cost
+			}
+		}
+
+		switch format {
+		case "csv":
+			record := make([]string, len(values))
+			for i, v := range values {
+				if f, ok := v.(float64); ok {
+					// 避免小额费用输出为科学计数法（如 2e-05）
+					record[i] = strconv.FormatFloat(f, 'f', -1, 64)
+				} else {
+					record[i] = fmt.Sprint(v)
+				}
+			}
+			csvWriter.Write(record)
+		default:
+			// 按列顺序手动拼接对象，保持字段顺序与 columns 一致
+			var buf bytes.Buffer
+			if format == "json" && count > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("{")
+			for i, column := range columns {
+				if i > 0 {
+					buf.WriteString(",")
+				}
+				key, _ := json.Marshal(column)
+				value, _ := json.Marshal(values[i])
+				buf.Write(key)
+				buf.WriteString(":")
+				buf.Write(value)
+			}
+			buf.WriteString("}")
+			if format == "jsonl" {
+				buf.WriteString("\n")
+			}
+			w.Write(buf.Bytes())
+		}
+
+		count++
+		if count%exportFlushRows == 0 {
+			csvWriter.Flush()
+			w.Flush()
+		}
+	}
+	if exportErr == nil {
+		exportErr = rows.Err()
 	}
 
-	if stats == nil {
-		stats = []AggregatedStats{}
+	if format == "json" {
+		w.WriteString("]")
 	}
+	csvWriter.Flush()
+	if exportErr != nil {
+		log.Printf("Export aborted after %d rows: %v", count, exportErr)
+		w.Header().Set("X-Export-Error", exportErr.Error())
+	}
+	w.Flush()
+}
 
-	// 格式化周期标签
-	startTime := time.Unix(periodStart/1000000, 0)
-	endTime := time.Unix(periodEnd/1000000, 0)
+// 导入时每个事务写入的行数
+const importBatchRows = 500
 
-	periodLabelStr := fmt.Sprintf("%02d.%02d - %02d.%02d",
-		startTime.Month(), startTime.Day(),
-		endTime.Month(), endTime.Day())
+// 导入报告中最多保留的错误行数
+const importMaxErrors = 1000
 
-	c.JSON(http.StatusOK, gin.H{
-		"data":         stats,
-		"period_start": periodStart,
-		"period_end":   periodEnd,
-		"period_label": periodLabelStr,
-	})
+// 导入选项
+type ImportOptions struct {
+	Format  string // csv, jsonl
+	DryRun  bool   // 只校验和查重，不写入
+	Account string // 未在行中指定账户时使用的账户（空表示本机账户）
 }
 
-// 手动触发数据拉取
-func fetchPointsHistory(c *gin.Context) {
-	var input struct {
-		Cookie          string `json:"cookie" binding:"required"`
-		FormKey         string `json:"form_key" binding:"required"`
-		TChannel        string `json:"tchannel" binding:"required"`
-		Revision        string `json:"revision"`
-		TagID           string `json:"tag_id"`
-		SubscriptionDay int    `json:"subscription_day"` // 每月订阅日（1-31）
-		FullSync        bool   `json:"full_sync"`        // 是否全量拉取（覆盖已有数据）
-	}
+// 单行导入错误
+type ImportRowError struct {
+	Row   int    `json:"row"` // 从 1 开始，不含 CSV 表头
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
 
-	if err := c.ShouldBindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// 导入报告
+type ImportReport struct {
+	DryRun          bool             `json:"dry_run"`
+	Total           int              `json:"total"`
+	Inserted        int              `json:"inserted"` // dry-run 时为将要插入的行数
+	Duplicates      int              `json:"duplicates"`
+	Failed          int              `json:"failed"`
+	Errors          []ImportRowError `json:"errors"`
+	ErrorsTruncated bool             `json:"errors_truncated"`
+}
+
+func (r *ImportReport) addError(row int, id string, err error) {
+	r.Failed++
+	if len(r.Errors) >= importMaxErrors {
+		r.ErrorsTruncated = true
 		return
 	}
+	r.Errors = append(r.Errors, ImportRowError{Row: row, ID: id, Error: err.Error()})
+}
 
-	// 设置默认值
-	if input.Revision == "" {
-		input.Revision = "59988163982a4ac4be7c7e7784f006dc48cafcf5"
+// 解析导入的时间戳：微秒整数（也接受秒、毫秒）或 RFC3339 字符串
+func parseImportTimestamp(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UnixMicro(), nil
 	}
-	if input.TagID == "" {
-		input.TagID = "8a0df086c2034f5e97dcb01c426029ee"
+	var n int64
+	if _, err := fmt.Sscanf(value, "%d", &n); err != nil || fmt.Sprint(n) != value {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
 	}
-	if input.SubscriptionDay <= 0 || input.SubscriptionDay > 31 {
-		input.SubscriptionDay = 1
+	switch {
+	case n < 1e11:
+		return n * 1000000, nil
+	case n < 1e14:
+		return n * 1000, nil
 	}
+	return n, nil
+}
 
-	// 计算当前订阅周期的开始时间（用于全量拉取时的截止时间）
-	now := time.Now()
-	currentDay := now.Day()
-	year := now.Year()
-	month := int(now.Month())
+// 将一行数据转换为积分记录，列名与 PointsHistoryNode 的 JSON 字段一致
+func parseImportRow(row map[string]string, defaultAccount string) (*PointsHistoryNode, error) {
+	node := &PointsHistoryNode{
+		ID:      strings.TrimSpace(row["id"]),
+		BotName: row["bot_name"],
+		BotID:   row["bot_id"],
+		Cursor:  row["cursor"],
+		Account: defaultAccount,
+	}
+	if node.ID == "" {
+		return nil, fmt.Errorf("id is required")
+	}
+	if node.BotName == "" {
+		return nil, fmt.Errorf("bot_name is required")
+	}
 
-	// 如果当前日期小于订阅日，使用上个月
-	if currentDay < input.SubscriptionDay {
-		month--
-		if month < 1 {
-			month = 12
-			year--
-		}
+	if _, err := fmt.Sscanf(strings.TrimSpace(row["point_cost"]), "%d", &node.PointCost); err != nil {
+		return nil, fmt.Errorf("invalid point_cost %q", row["point_cost"])
+	}
+	if node.PointCost < 0 {
+		return nil, fmt.Errorf("point_cost must not be negative")
 	}
 
-	subscriptionStartTime := time.Date(year, time.Month(month), input.SubscriptionDay, 0, 0, 0, 0, time.Local)
-	subscriptionStartMicros := subscriptionStartTime.UnixMicro()
+	// 兼容导出文件中格式化的 time 列
+	creationTime := row["creation_time"]
+	if creationTime == "" {
+		creationTime = row["time"]
+	}
+	if creationTime == "" {
+		return nil, fmt.Errorf("creation_time is required")
+	}
+	var err error
+	if node.CreationTime, err = parseImportTimestamp(creationTime); err != nil {
+		return nil, err
+	}
 
-	// 保存配置到数据库
-	// 获取当前的自动拉取设置和订阅费用设置，以免被覆盖
-	var autoFetchInterval, autoFetchEnabled int
-	var subscriptionAmount float64
-	var subscriptionCurrency string
-	db.QueryRow("SELECT COALESCE(auto_fetch_interval, 30), COALESCE(auto_fetch_enabled, 0), COALESCE(subscription_amount, 0), COALESCE(subscription_currency, 'USD') FROM config ORDER BY id DESC LIMIT 1").Scan(&autoFetchInterval, &autoFetchEnabled, &subscriptionAmount, &subscriptionCurrency)
+	node.CreatedAt = time.Now()
+	if createdAt := row["created_at"]; createdAt != "" {
+		t, err := time.Parse(time.RFC3339, createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid created_at %q", createdAt)
+		}
+		node.CreatedAt = t
+	}
 
-	if err := upsertConfig(input.Cookie, input.FormKey, input.TChannel, input.Revision, input.TagID,
-		input.SubscriptionDay, subscriptionAmount, subscriptionCurrency, autoFetchInterval, autoFetchEnabled); err != nil {
-		log.Printf("Failed to save config during fetch: %v", err)
+	if account, ok := row["account"]; ok && account != "local" {
+		node.Account = account
+	} else if ok {
+		node.Account = ""
 	}
+	return node, nil
+}
 
-	newRecords := 0
-	updatedRecords := 0
-	duplicateFound := false
-	reachedSubscriptionStart := false
-	cursor := ""
+// 逐行读取导入数据，next 返回 io.EOF 表示结束
+type importRowReader func() (map[string]string, error)
 
-	for !duplicateFound && !reachedSubscriptionStart {
-		// 构建请求体 - 使用新的 API
-		requestBody := map[string]interface{}{
-			"queryName": "PointsHistoryPageColumnViewerPaginationQuery",
-			"variables": map[string]interface{}{
-				"limit": 20,
-			},
-			"extensions": map[string]string{
-				"hash": "9b68fe8ea0017e5d7701c93a5db8323136f9cb023d514f8595ae0dde220be6d1",
-			},
+func newCSVRowReader(r io.Reader) (importRowReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("empty CSV")
 		}
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff"))
+	}
 
-		// 如果有 cursor，添加到 variables
-		if cursor != "" {
-			requestBody["variables"].(map[string]interface{})["cursor"] = cursor
+	return func() (map[string]string, error) {
+		record, err := reader.Read()
+		if err != nil {
+			return nil, err
 		}
+		if len(record) != len(header) {
+			return nil, fmt.Errorf("expected %d fields, got %d", len(header), len(record))
+		}
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			row[column] = record[i]
+		}
+		return row, nil
+	}, nil
+}
 
-		jsonBody, _ := json.Marshal(requestBody)
-
-		// 创建 HTTP 请求
-		req, err := http.NewRequest("POST", "https://poe.com/api/gql_POST", strings.NewReader(string(jsonBody)))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+func newJSONLRowReader(r io.Reader) importRowReader {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	return func() (map[string]string, error) {
+		var object map[string]interface{}
+		if err := decoder.Decode(&object); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				// 语法错误后无法继续定位下一行
+				return nil, fmt.Errorf("%w: %v", errImportAborted, err)
+			}
+			return nil, err
+		}
+		row := make(map[string]string, len(object))
+		for key, value := range object {
+			if value != nil {
+				row[key] = fmt.Sprint(value)
+			}
 		}
+		return row, nil
+	}
+}
 
-		// 设置请求头
-		req.Header.Set("accept", "*/*")
-		req.Header.Set("accept-language", "zh-CN,zh;q=0.9,en;q=0.8")
-		req.Header.Set("content-type", "application/json")
-		req.Header.Set("cookie", input.Cookie)
-		req.Header.Set("origin", "https://poe.com")
-		req.Header.Set("poe-formkey", input.FormKey)
-		req.Header.Set("poe-queryname", "PointsHistoryPageColumnViewerPaginationQuery")
-		req.Header.Set("poe-revision", input.Revision)
-		req.Header.Set("poe-tag-id", input.TagID)
-		req.Header.Set("poe-tchannel", input.TChannel)
-		req.Header.Set("poegraphql", "1")
-		req.Header.Set("referer", "https://poe.com/points_history")
-		req.Header.Set("user-agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/142.0.0.0 Safari/537.36")
+var errImportAborted = errors.New("import aborted")
 
-		// 发送请求
-		client := &http.Client{Timeout: 30 * time.Second}
-		resp, err := client.Do(req)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+// 导入积分历史：按 id 去重（与 recordExists 相同的判断），分批在事务中写入
+func importHistory(r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	var next importRowReader
+	switch opts.Format {
+	case "csv", "":
+		var err error
+		if next, err = newCSVRowReader(r); err != nil {
+			return nil, err
 		}
-		defer resp.Body.Close()
+	case "jsonl":
+		next = newJSONLRowReader(r)
+	default:
+		return nil, fmt.Errorf("format must be csv or jsonl")
+	}
 
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+	report := &ImportReport{DryRun: opts.DryRun, Errors: []ImportRowError{}}
+	seen := make(map[string]bool)
 
-		// 解析响应
-		var poeResp PoeResponse
-		if err := json.Unmarshal(body, &poeResp); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse response", "details": err.Error()})
-			return
+	var tx *sql.Tx
+	batch := 0
+	commit := func() error {
+		if tx == nil {
+			return nil
+		}
+		err := tx.Commit()
+		tx = nil
+		batch = 0
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
 		}
+	}()
 
-		// 处理每条记录
-		for _, edge := range poeResp.Data.Viewer.PointsHistoryConnection.Edges {
-			// 检查是否达到本订阅周期的开始时间
-			if edge.Node.CreationTime <= subscriptionStartMicros {
-				reachedSubscriptionStart = true
-				log.Printf("Reached subscription start time: %s", subscriptionStartTime.Format("2006-01-02 15:04:05"))
+	for rowNum := 1; ; rowNum++ {
+		row, err := next()
+		if err == io.EOF {
+			break
+		}
+		report.Total++
+		if err != nil {
+			report.addError(rowNum, "", err)
+			if errors.Is(err, errImportAborted) {
 				break
 			}
+			continue
+		}
 
-			// 检查是否已存在
-			exists, err := recordExists(edge.Node.ID)
-			if err != nil {
-				log.Printf("Error checking record: %v", err)
-				continue
-			}
+		node, err := parseImportRow(row, opts.Account)
+		if err != nil {
+			report.addError(rowNum, row["id"], err)
+			continue
+		}
 
-			// 如果不是全量拉取模式，遇到重复就停止
-			if exists && !input.FullSync {
-				duplicateFound = true
-				break
-			}
+		// 文件内重复的 id 同样视为重复
+		if seen[node.ID] {
+			report.Duplicates++
+			continue
+		}
+		seen[node.ID] = true
 
-			// 插入或更新记录
-			node := &PointsHistoryNode{
-				ID:           edge.Node.ID,
-				PointCost:    edge.Node.PointCost,
-				CreationTime: edge.Node.CreationTime,
-				BotName:      edge.Node.Bot.DisplayName,
-				BotID:        edge.Node.Bot.ID,
-				Cursor:       edge.Cursor,
-				CreatedAt:    time.Unix(edge.Node.CreationTime/1000000, 0),
-			}
+		var exists bool
+		if tx != nil {
+			exists, err = recordExistsWith(tx, node.ID)
+		} else {
+			exists, err = recordExists(node.ID)
+		}
+		if err != nil {
+			return report, err
+		}
+		if exists {
+			report.Duplicates++
+			continue
+		}
 
-			if exists {
-				// 更新现有记录
-				_, err := db.Exec(`
-					UPDATE points_history 
-					SET point_cost = ?, creation_time = ?, bot_name = ?, bot_id = ?, cursor = ?, created_at = ?
-					WHERE id = ?
-				`, node.PointCost, node.CreationTime, node.BotName, node.BotID, node.Cursor, node.CreatedAt, node.ID)
-				if err != nil {
-					log.Printf("Error updating record: %v", err)
-					continue
+		if !opts.DryRun {
+			if tx == nil {
+				if tx, err = db.Begin(); err != nil {
+					return report, err
 				}
-				updatedRecords++
-			} else {
-				// 插入新记录
-				if err := insertRecord(node); err != nil {
-					log.Printf("Error inserting record: %v", err)
-					continue
+			}
+			if err := insertRecordWith(tx, node); err != nil {
+				report.addError(rowNum, node.ID, err)
+				continue
+			}
+			batch++
+			if batch >= importBatchRows {
+				if err := commit(); err != nil {
+					return report, err
 				}
-				newRecords++
 			}
 		}
-
-		// 检查是否有下一页
-		if !poeResp.Data.Viewer.PointsHistoryConnection.PageInfo.HasNextPage || duplicateFound {
-			break
-		}
-
-		// 更新 cursor
-		cursor = poeResp.Data.Viewer.PointsHistoryConnection.PageInfo.EndCursor
-
-		// 添加延迟，避免请求过快
-		time.Sleep(1 * time.Second)
+		report.Inserted++
 	}
 
-	message := fmt.Sprintf("Successfully fetched %d new records", newRecords)
-	if updatedRecords > 0 {
-		message = fmt.Sprintf("Successfully fetched %d new records, updated %d existing records", newRecords, updatedRecords)
+	if err := commit(); err != nil {
+		return report, err
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"new_records":     newRecords,
-		"updated_records": updatedRecords,
-		"message":         message,
-	})
+	return report, nil
 }
 
-// 获取最新记录
-func getLatestRecords(c *gin.Context) {
-	limit := c.DefaultQuery("limit", "20")
+// 根据文件名或 Content-Type 推断导入格式
+func detectImportFormat(filename, contentType string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jsonl", ".ndjson":
+		return "jsonl"
+	case ".csv":
+		return "csv"
+	}
+	if strings.Contains(contentType, "ndjson") || strings.Contains(contentType, "jsonl") {
+		return "jsonl"
+	}
+	return "csv"
+}
 
-	rows, err := db.Query(`
-		SELECT id, point_cost, creation_time, bot_name, bot_id, cursor, created_at
-		FROM points_history
-		ORDER BY creation_time DESC
-		LIMIT ?
-	`, limit)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+// 导入积分历史（format=csv|jsonl，dry_run=true 只校验不写入，account 指定默认账户）
+// 请求体为文件内容，或 multipart 表单中的 file 字段
+func importHistoryHandler(c *gin.Context) {
+	opts := ImportOptions{
+		Format:  c.Query("format"),
+		DryRun:  c.Query("dry_run") == "true" || c.Query("dry_run") == "1",
+		Account: c.Query("account"),
+	}
+	if opts.Account == "local" {
+		opts.Account = ""
 	}
-	defer rows.Close()
 
-	var records []PointsHistoryNode
-	for rows.Next() {
-		var r PointsHistoryNode
-		if err := rows.Scan(&r.ID, &r.PointCost, &r.CreationTime, &r.BotName, &r.BotID, &r.Cursor, &r.CreatedAt); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	var body io.Reader = c.Request.Body
+	contentType := c.GetHeader("Content-Type")
+	filename := ""
+	if strings.HasPrefix(contentType, "multipart/form-data") {
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		records = append(records, r)
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer file.Close()
+		body = file
+		filename = fileHeader.Filename
+		contentType = fileHeader.Header.Get("Content-Type")
 	}
-
-	if records == nil {
-		records = []PointsHistoryNode{}
+	if opts.Format == "" {
+		opts.Format = detectImportFormat(filename, contentType)
 	}
 
-	c.JSON(http.StatusOK, records)
-}
-
-// 获取用户积分信息
-func getUserPointsInfo(c *gin.Context) {
-	// 从数据库获取配置
-	var config Config
-	err := db.QueryRow(`
-		SELECT COALESCE(cookie, '') as cookie, COALESCE(form_key, '') as form_key, 
-		       COALESCE(tchannel, '') as tchannel, COALESCE(revision, '') as revision, 
-		       COALESCE(tag_id, '') as tag_id
-		FROM config ORDER BY id DESC LIMIT 1
-	`).Scan(&config.Cookie, &config.FormKey, &config.TChannel, &config.Revision, &config.TagID)
-
-	if err != nil || config.Cookie == "" {
-		c.JSON(http.StatusOK, gin.H{"error": "No config found"})
+	// 与手动和自动拉取互斥，避免同时写入相同记录
+	release, ok := scheduler.acquire("import")
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "A sync is already in progress"})
 		return
 	}
+	defer release()
 
-	// 构建请求体
-	requestBody := map[string]interface{}{
-		"queryName": "settingsPageQuery",
-		"variables": map[string]interface{}{},
-		"extensions": map[string]string{
-			"hash": "39ca34ece084fd810ccc8394942a2a584651433a57e7455ae80546a2e7893b5f",
-		},
-	}
-
-	jsonBody, _ := json.Marshal(requestBody)
-	req, err := http.NewRequest("POST", "https://poe.com/api/gql_POST", strings.NewReader(string(jsonBody)))
+	report, err := importHistory(body, opts)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		status := http.StatusInternalServerError
+		if report == nil {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error(), "report": report})
 		return
 	}
 
-	// 设置请求头
-	req.Header.Set("accept", "*/*")
-	req.Header.Set("content-type", "application/json")
-	req.Header.Set("cookie", config.Cookie)
-	req.Header.Set("poe-formkey", config.FormKey)
-	req.Header.Set("poe-tchannel", config.TChannel)
-	req.Header.Set("poe-revision", config.Revision)
-	req.Header.Set("poe-tag-id", config.TagID)
-	req.Header.Set("poe-queryname", "settingsPageQuery")
-	req.Header.Set("poegraphql", "1")
+	c.JSON(http.StatusOK, report)
+}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+// 命令行导入：poe-points-monitor import [-format csv|jsonl] [-dry-run] [-account name] <file>...
+func runImportCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "Input format: csv or jsonl (default: detect from file extension)")
+	dryRun := fs.Bool("dry-run", false, "Validate and check for duplicates without writing")
+	account := fs.String("account", "", "Account for rows without an account column")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: poe-points-monitor import [-format csv|jsonl] [-dry-run] [-account name] <file>...")
+		return 2
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	initDB()
+	defer db.Close()
+	if schemaErr != nil {
+		fmt.Fprintf(os.Stderr, "database schema migration failed: %v\n", schemaErr)
+		return 1
 	}
 
-	// 解析响应
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+	exitCode := 0
+	for _, path := range fs.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			exitCode = 1
+			continue
+		}
 
-	// 提取积分信息
-	data := result["data"].(map[string]interface{})
-	viewer := data["viewer"].(map[string]interface{})
-	messagePointInfo := viewer["messagePointInfo"].(map[string]interface{})
-	subscription := viewer["subscription"].(map[string]interface{})
+		opts := ImportOptions{Format: *format, DryRun: *dryRun, Account: *account}
+		if opts.Format == "" {
+			opts.Format = detectImportFormat(path, "")
+		}
+		report, err := importHistory(file, opts)
+		file.Close()
+
+		if report != nil {
+			output, _ := json.MarshalIndent(report, "", "  ")
+			fmt.Printf("%s:\n%s\n", path, output)
+			if report.Failed > 0 {
+				exitCode = 1
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			exitCode = 1
+		}
+	}
+	return exitCode
+}
 
-	// 计算已使用积分
-	totalAllotment := int64(messagePointInfo["totalMessagePointAllotment"].(float64))
-	currentBalance := int64(messagePointInfo["subscriptionPointBalance"].(float64))
-	usedPoints := totalAllotment - currentBalance
+// 合并报告中最多列出的冲突记录数
+const mergeMaxConflicts = 1000
+
+// 合并选项
+type MergeOptions struct {
+	Path          string // 要合并的 points.db 路径
+	SourceLabel   string // 报告和账户中记录的来源（上传文件时为原文件名），为空时使用路径
+	Account       string // 对方配置作为该名称的账户保存，对方记录也归属该账户
+	IncludeLayout bool   // 是否同时合并布局配置
+	Conflict      string // keep（保留本地，默认）或 theirs（使用对方的 point_cost）
+	DryRun        bool   // 只统计，不写入
+}
 
-	// 获取当前周期的开始时间（通过下次重置时间推算）
-	nextGrantTime := int64(messagePointInfo["computePointNextGrantTime"].(float64))
-	expiresTime := int64(subscription["expiresTime"].(float64))
+// 同一 id 的 point_cost 不一致
+type MergeConflict struct {
+	ID           string `json:"id"`
+	BotName      string `json:"bot_name"`
+	CreationTime int64  `json:"creation_time"`
+	OurCost      int    `json:"our_point_cost"`
+	TheirCost    int    `json:"their_point_cost"`
+}
 
-	// 计算当前周期开始时间（假设是一个月前）
-	currentTime := time.Now().UnixMicro()
-	cycleStartTime := nextGrantTime - 30*24*60*60*1000000 // 30天前
+// 合并报告
+type MergeReport struct {
+	Source             string          `json:"source"`
+	Account            string          `json:"account"`
+	AccountStatus      string          `json:"account_status"` // created, updated, none（对方没有配置）
+	ConflictPolicy     string          `json:"conflict_policy"`
+	DryRun             bool            `json:"dry_run"`
+	Added              int64           `json:"added"`
+	Updated            int64           `json:"updated"`
+	Unchanged          int64           `json:"unchanged"`
+	Conflicts          int64           `json:"conflicts"`
+	ConflictRecords    []MergeConflict `json:"conflict_records"`
+	ConflictsTruncated bool            `json:"conflicts_truncated"`
+	LayoutMerged       bool            `json:"layout_merged"`
+}
 
-	// 从数据库获取本周期内的总消耗
-	var totalUsedInCycle int
-	db.QueryRow(`
-		SELECT COALESCE(SUM(point_cost), 0) 
-		FROM points_history 
-		WHERE creation_time >= ?
-	`, cycleStartTime).Scan(&totalUsedInCycle)
+// 判断附加数据库中的表是否包含指定列
+func attachedColumnExists(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, schema, table, column string) bool {
+	var count int
+	err := q.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM pragma_table_info('%s', '%s') WHERE name = ?", table, schema), column).Scan(&count)
+	return err == nil && count > 0
+}
 
-	// 计算每日平均消耗
-	daysInCycle := float64(currentTime-cycleStartTime) / (24 * 60 * 60 * 1000000)
-	if daysInCycle < 1 {
-		daysInCycle = 1
+// 通过 ATTACH 合并另一个 points.db：积分记录按 id 合并，配置保存为新账户，布局可选
+func mergeDatabase(opts MergeOptions) (*MergeReport, error) {
+	if strings.TrimSpace(opts.Account) == "" || opts.Account == "local" {
+		return nil, fmt.Errorf("account name is required and must not be \"local\"")
+	}
+	if opts.Conflict == "" {
+		opts.Conflict = "keep"
+	}
+	if opts.Conflict != "keep" && opts.Conflict != "theirs" {
+		return nil, fmt.Errorf("conflict must be keep or theirs")
 	}
-	avgPerDay := int(float64(totalUsedInCycle) / daysInCycle)
 
-	// 预计剩余天数
-	var remainingDays int
-	if avgPerDay > 0 {
-		remainingDays = int(float64(currentBalance) / float64(avgPerDay))
+	source, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(source); err != nil {
+		return nil, err
+	}
+	if ownPath, _ := filepath.Abs(filepath.Join(appDataDir, "points.db")); ownPath == source {
+		return nil, fmt.Errorf("cannot merge the database into itself")
+	}
+
+	// ATTACH 只对当前连接生效，整个合并过程使用同一个连接
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS other", source); err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE other")
+
+	var hasHistory bool
+	if err := conn.QueryRowContext(ctx, `
+		SELECT EXISTS(SELECT 1 FROM other.sqlite_master WHERE type = 'table' AND name = 'points_history')
+	`).Scan(&hasHistory); err != nil {
+		return nil, fmt.Errorf("%s is not a points database: %v", source, err)
+	}
+	if !hasHistory {
+		return nil, fmt.Errorf("%s has no points_history table", source)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if opts.SourceLabel != "" {
+		source = opts.SourceLabel
+	}
+	report := &MergeReport{
+		Source:          source,
+		Account:         opts.Account,
+		AccountStatus:   "none",
+		ConflictPolicy:  opts.Conflict,
+		DryRun:          opts.DryRun,
+		ConflictRecords: []MergeConflict{},
+	}
+
+	// 同一 id 的积分不一致的记录
+	rows, err := tx.Query(`
+		SELECT m.id, m.bot_name, m.creation_time, m.point_cost, o.point_cost
+		FROM main.points_history m
+		JOIN other.points_history o ON o.id = m.id
+		WHERE o.point_cost != m.point_cost
+		ORDER BY m.creation_time
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var conflict MergeConflict
+		if err := rows.Scan(&conflict.ID, &conflict.BotName, &conflict.CreationTime, &conflict.OurCost, &conflict.TheirCost); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		report.Conflicts++
+		if len(report.ConflictRecords) < mergeMaxConflicts {
+			report.ConflictRecords = append(report.ConflictRecords, conflict)
+		} else {
+			report.ConflictsTruncated = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := tx.QueryRow(`
+		SELECT COUNT(*) FROM main.points_history m
+		JOIN other.points_history o ON o.id = m.id
+		WHERE o.point_cost = m.point_cost
+	`).Scan(&report.Unchanged); err != nil {
+		return nil, err
+	}
+
+	if opts.Conflict == "theirs" && report.Conflicts > 0 {
+		result, err := tx.Exec(`
+			UPDATE main.points_history
+			SET point_cost = (SELECT o.point_cost FROM other.points_history o WHERE o.id = points_history.id)
+			WHERE id IN (
+				SELECT o.id FROM other.points_history o
+				JOIN main.points_history m ON m.id = o.id
+				WHERE o.point_cost != m.point_cost
+			)
+		`)
+		if err != nil {
+			return nil, err
+		}
+		report.Updated, _ = result.RowsAffected()
+	}
+
+	// 新增的记录归属合并的账户（对方已标记账户的记录保留原账户）
+	accountExpr := "?"
+	if attachedColumnExists(tx, "other", "points_history", "account") {
+		accountExpr = "CASE WHEN COALESCE(o.account, '') = '' THEN ? ELSE o.account END"
+	}
+	result, err := tx.Exec(`
+		INSERT INTO main.points_history (id, point_cost, creation_time, bot_name, bot_id, cursor, created_at, account)
+		SELECT o.id, o.point_cost, o.creation_time, o.bot_name, o.bot_id, o.cursor, o.created_at, `+accountExpr+`
+		FROM other.points_history o
+		WHERE NOT EXISTS (SELECT 1 FROM main.points_history m WHERE m.id = o.id)
+	`, opts.Account)
+	if err != nil {
+		return nil, err
+	}
+	report.Added, _ = result.RowsAffected()
+
+	// 对方最新的配置保存为账户
+	var hasConfig bool
+	tx.QueryRow("SELECT EXISTS(SELECT 1 FROM other.sqlite_master WHERE type = 'table' AND name = 'config')").Scan(&hasConfig)
+	if hasConfig {
+		var cookie, formKey, tchannel, revision, tagID, currency string
+		var subscriptionDay int
+		var amount float64
+		err := tx.QueryRow(`
+			SELECT COALESCE(cookie, ''), COALESCE(form_key, ''), COALESCE(tchannel, ''), COALESCE(revision, ''),
+			       COALESCE(tag_id, ''), COALESCE(subscription_day, 1), COALESCE(subscription_amount, 0),
+			       COALESCE(subscription_currency, 'USD')
+			FROM other.config ORDER BY id DESC LIMIT 1
+		`).Scan(&cookie, &formKey, &tchannel, &revision, &tagID, &subscriptionDay, &amount, &currency)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if err == nil {
+			var exists bool
+			tx.QueryRow("SELECT EXISTS(SELECT 1 FROM main.accounts WHERE name = ?)", opts.Account).Scan(&exists)
+			report.AccountStatus = "created"
+			if exists {
+				report.AccountStatus = "updated"
+			}
+			if _, err := tx.Exec(`
+				INSERT INTO main.accounts (name, cookie, form_key, tchannel, revision, tag_id,
+				                           subscription_day, subscription_amount, subscription_currency, source_path, updated_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(name) DO UPDATE SET
+					cookie = excluded.cookie, form_key = excluded.form_key, tchannel = excluded.tchannel,
+					revision = excluded.revision, tag_id = excluded.tag_id, subscription_day = excluded.subscription_day,
+					subscription_amount = excluded.subscription_amount, subscription_currency = excluded.subscription_currency,
+					source_path = excluded.source_path, updated_at = excluded.updated_at
+			`, opts.Account, cookie, formKey, tchannel, revision, tagID, subscriptionDay, amount, currency, source, time.Now()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if opts.IncludeLayout {
+		var hasLayout bool
+		tx.QueryRow("SELECT EXISTS(SELECT 1 FROM other.sqlite_master WHERE type = 'table' AND name = 'layout_config')").Scan(&hasLayout)
+		if hasLayout {
+			result, err := tx.Exec(`
+				INSERT OR REPLACE INTO main.layout_config (id, sidebar_width, grid_layout, updated_at)
+				SELECT 1, sidebar_width, grid_layout, ? FROM other.layout_config ORDER BY id DESC LIMIT 1
+			`, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			affected, _ := result.RowsAffected()
+			report.LayoutMerged = affected > 0
+		}
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// 合并另一个 points.db（JSON 请求体指定 path，或以 multipart 表单的 file 字段上传）
+// 参数：account（必填）、layout=true、conflict=keep|theirs、dry_run=true
+func mergeDatabaseHandler(c *gin.Context) {
+	opts := MergeOptions{
+		Account:       c.Query("account"),
+		IncludeLayout: c.Query("layout") == "true",
+		Conflict:      c.Query("conflict"),
+		DryRun:        c.Query("dry_run") == "true" || c.Query("dry_run") == "1",
+	}
+
+	if strings.HasPrefix(c.GetHeader("Content-Type"), "multipart/form-data") {
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		tmp, err := os.CreateTemp("", "merge-*.db")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		if err := c.SaveUploadedFile(fileHeader, tmp.Name()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		opts.Path = tmp.Name()
+		opts.SourceLabel = fileHeader.Filename
 	} else {
-		remainingDays = 999
+		var input struct {
+			Path          string `json:"path"`
+			Account       string `json:"account"`
+			IncludeLayout bool   `json:"include_layout"`
+			Conflict      string `json:"conflict"`
+			DryRun        bool   `json:"dry_run"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		opts.Path = input.Path
+		if input.Account != "" {
+			opts.Account = input.Account
+		}
+		if input.Conflict != "" {
+			opts.Conflict = input.Conflict
+		}
+		opts.IncludeLayout = opts.IncludeLayout || input.IncludeLayout
+		opts.DryRun = opts.DryRun || input.DryRun
+	}
+	if opts.Path == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path or file is required"})
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"total_allotment":      totalAllotment,
-		"current_balance":      currentBalance,
-		"used_points":          usedPoints,
-		"usage_percentage":     float64(usedPoints) / float64(totalAllotment) * 100,
-		"avg_per_day":          avgPerDay,
-		"remaining_days":       remainingDays,
-		"next_grant_time":      nextGrantTime,
-		"expires_time":         expiresTime,
-		"subscription_product": subscription["subscriptionProduct"].(map[string]interface{})["displayName"],
-	})
+	// 与手动和自动拉取互斥，避免同时写入相同记录
+	release, ok := scheduler.acquire("merge")
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "A sync is already in progress"})
+		return
+	}
+	defer release()
+
+	report, err := mergeDatabase(opts)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
 }
 
-// 获取机器人统计
-func getBotStats(c *gin.Context) {
+// 账户信息（不返回凭证）
+type Account struct {
+	Name                 string  `json:"name"`
+	SubscriptionDay      int     `json:"subscription_day"`
+	SubscriptionAmount   float64 `json:"subscription_amount"`
+	SubscriptionCurrency string  `json:"subscription_currency"`
+	SourcePath           string  `json:"source_path,omitempty"`
+	RecordCount          int     `json:"record_count"`
+	TotalPoints          int     `json:"total_points"`
+}
+
+// 获取账户列表（含本机账户 local）及各账户的记录数
+func getAccounts(c *gin.Context) {
+	accounts := []Account{}
+	index := make(map[string]int)
+
+	local, err := getSubscriptionSettings()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	accounts = append(accounts, Account{Name: "local", SubscriptionDay: local.Day, SubscriptionAmount: local.Amount, SubscriptionCurrency: local.Currency})
+	index[""] = 0
+
 	rows, err := db.Query(`
-		SELECT 
-			bot_name,
-			SUM(point_cost) as total_cost,
-			COUNT(*) as count
-		FROM points_history
-		GROUP BY bot_name
-		ORDER BY total_cost DESC
+		SELECT name, COALESCE(subscription_day, 1), COALESCE(subscription_amount, 0),
+		       COALESCE(subscription_currency, 'USD'), COALESCE(source_path, '')
+		FROM accounts ORDER BY name
 	`)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
-
-	type BotStat struct {
-		BotName   string `json:"bot_name"`
-		TotalCost int    `json:"total_cost"`
-		Count     int    `json:"count"`
+	for rows.Next() {
+		var a Account
+		if err := rows.Scan(&a.Name, &a.SubscriptionDay, &a.SubscriptionAmount, &a.SubscriptionCurrency, &a.SourcePath); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		index[a.Name] = len(accounts)
+		accounts = append(accounts, a)
 	}
+	rows.Close()
 
-	var stats []BotStat
+	rows, err = db.Query(`
+		SELECT COALESCE(account, ''), COUNT(*), COALESCE(SUM(point_cost), 0)
+		FROM points_history GROUP BY COALESCE(account, '')
+	`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
 	for rows.Next() {
-		var s BotStat
-		if err := rows.Scan(&s.BotName, &s.TotalCost, &s.Count); err != nil {
+		var name string
+		var count, points int
+		if err := rows.Scan(&name, &count, &points); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		i, ok := index[name]
+		if !ok {
+			// 导入时指定、但没有合并配置的账户
+			i = len(accounts)
+			index[name] = i
+			accounts = append(accounts, Account{Name: name})
+		}
+		accounts[i].RecordCount = count
+		accounts[i].TotalPoints = points
+	}
+
+	c.JSON(http.StatusOK, accounts)
+}
+
+// 命令行合并：poe-points-monitor merge -account name [-layout] [-conflict keep|theirs] [-dry-run] <points.db>
+func runMergeCommand(args []string) int {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	account := fs.String("account", "", "Account name for the merged database (required)")
+	layout := fs.Bool("layout", false, "Also merge the layout configuration")
+	conflict := fs.String("conflict", "keep", "Conflict policy for differing point_cost: keep or theirs")
+	dryRun := fs.Bool("dry-run", false, "Report what would change without writing")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: poe-points-monitor merge -account name [-layout] [-conflict keep|theirs] [-dry-run] <points.db>")
+		return 2
+	}
+
+	initDB()
+	defer db.Close()
+	if schemaErr != nil {
+		fmt.Fprintf(os.Stderr, "database schema migration failed: %v\n", schemaErr)
+		return 1
+	}
+
+	report, err := mergeDatabase(MergeOptions{
+		Path:          fs.Arg(0),
+		Account:       *account,
+		IncludeLayout: *layout,
+		Conflict:      *conflict,
+		DryRun:        *dryRun,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	output, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(output))
+	return 0
+}
+
+var errInvalidGranularity = errors.New("invalid granularity")
+
+// 按时间粒度聚合区间内的积分消耗（chartType: discrete 或 cumulative）
+func queryAggregatedStats(granularity, chartType string, periodStart, periodEnd int64, account string) ([]AggregatedStats, error) {
+	var groupBy string
+
+	switch granularity {
+	case "minute":
+		groupBy = "strftime('%Y-%m-%d %H:%M', datetime(creation_time / 1000000, 'unixepoch', 'localtime'))"
+	case "hour":
+		groupBy = "strftime('%Y-%m-%d %H:00', datetime(creation_time / 1000000, 'unixepoch', 'localtime'))"
+	case "halfday":
+		// 半天：将一天分为上午(00:00-11:59)和下午(12:00-23:59)
+		// 上午显示为 00:00，下午显示为 12:00，便于前端解析
+		groupBy = `
+			strftime('%Y-%m-%d', datetime(creation_time / 1000000, 'unixepoch', 'localtime')) || 
+			CASE 
+				WHEN CAST(strftime('%H', datetime(creation_time / 1000000, 'unixepoch', 'localtime')) AS INTEGER) < 12 
+				THEN ' 00:00' 
+				ELSE ' 12:00' 
+			END
+		`
+	case "day":
+		groupBy = "strftime('%Y-%m-%d', datetime(creation_time / 1000000, 'unixepoch', 'localtime'))"
+	default:
+		return nil, errInvalidGranularity
+	}
+
+	var query string
+	if chartType == "cumulative" {
+		// 累积图表：计算累积总和
+		query = fmt.Sprintf(`
+			WITH time_groups AS (
+				SELECT 
+					%s as time_group,
+					SUM(point_cost) as point_cost,
+					COUNT(*) as record_count
+				FROM points_history
+				WHERE creation_time >= ? AND creation_time < ? AND `+accountFilter+`
+				GROUP BY time_group
+				ORDER BY time_group
+			)
+			SELECT 
+				time_group,
+				SUM(point_cost) OVER (ORDER BY time_group) as cumulative_cost,
+				SUM(record_count) OVER (ORDER BY time_group) as cumulative_count
+			FROM time_groups
+		`, groupBy)
+	} else {
+		// 分立图表：每个时间段的独立数据
+		query = fmt.Sprintf(`
+			SELECT 
+				%s as time_group,
+				SUM(point_cost) as point_cost,
+				COUNT(*) as record_count
+			FROM points_history
+			WHERE creation_time >= ? AND creation_time < ? AND `+accountFilter+`
+			GROUP BY time_group
+			ORDER BY time_group
+		`, groupBy)
+	}
+
+	rows, err := db.Query(query, periodStart, periodEnd, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []AggregatedStats
+	for rows.Next() {
+		var s AggregatedStats
+		if err := rows.Scan(&s.Timestamp, &s.PointCost, &s.RecordCount); err != nil {
+			return nil, err
+		}
 		stats = append(stats, s)
 	}
 
-	if stats == nil {
-		stats = []BotStat{}
+	if stats == nil {
+		stats = []AggregatedStats{}
+	}
+
+	return stats, rows.Err()
+}
+
+// 获取统计数据
+func getStats(c *gin.Context) {
+	granularity := c.Query("granularity") // minute, hour, halfday, day
+	chartType := c.Query("type")          // discrete, cumulative
+	periodOffset := c.Query("period")     // 周期偏移量（0=当前月，-1=上个月，1=下个月）
+
+	if granularity == "" {
+		granularity = "hour"
+	}
+	if chartType == "" {
+		chartType = "discrete"
+	}
+
+	offset := 0
+	if periodOffset != "" {
+		fmt.Sscanf(periodOffset, "%d", &offset)
+	}
+
+	// 计算查询的时间范围（以当前所在的订阅周期为基准偏移）
+	periodStart, periodEnd := getPlanPeriodByOffset(offset)
+
+	stats, err := queryAggregatedStats(granularity, chartType, periodStart, periodEnd, requestAccount(c))
+	if err == errInvalidGranularity {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid granularity"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":         stats,
+		"period_start": periodStart,
+		"period_end":   periodEnd,
+		"period_label": formatPeriodLabel(periodStart, periodEnd),
+	})
+}
+
+// 手动触发数据拉取
+func fetchPointsHistory(c *gin.Context) {
+	var input struct {
+		Cookie          string `json:"cookie" binding:"required"`
+		FormKey         string `json:"form_key" binding:"required"`
+		TChannel        string `json:"tchannel" binding:"required"`
+		Revision        string `json:"revision"`
+		TagID           string `json:"tag_id"`
+		SubscriptionDay int    `json:"subscription_day"` // 每月订阅日（1-31）
+		FullSync        bool   `json:"full_sync"`        // 是否全量拉取（覆盖已有数据）
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 与自动拉取互斥，避免同时写入相同记录
+	release, ok := scheduler.acquire("manual")
+	if !ok {
+		appMetrics.recordSync("manual", "skipped", time.Now(), 0)
+		c.JSON(http.StatusConflict, gin.H{"error": "A sync is already in progress"})
+		return
+	}
+	defer release()
+	backgroundTasks.Add(1)
+	defer backgroundTasks.Done()
+
+	// 客户端断开或服务关闭时中断拉取
+	ctx, cancel := withAppCancel(c.Request.Context())
+	defer cancel()
+
+	started := time.Now()
+	newRecords := 0
+	canceled := false
+	defer func() {
+		outcome := "success"
+		if canceled {
+			outcome = "canceled"
+		} else if c.Writer.Status() >= http.StatusBadRequest {
+			outcome = "error"
+		}
+		appMetrics.recordSync("manual", outcome, started, newRecords)
+	}()
+	abortCanceled := func() {
+		canceled = true
+		log.Printf("Fetch canceled after %d new records: %v", newRecords, ctx.Err())
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Fetch canceled", "new_records": newRecords})
+	}
+
+	// 设置默认值
+	if input.Revision == "" {
+		input.Revision = "59988163982a4ac4be7c7e7784f006dc48cafcf5"
+	}
+	if input.TagID == "" {
+		input.TagID = "8a0df086c2034f5e97dcb01c426029ee"
+	}
+	if input.SubscriptionDay <= 0 || input.SubscriptionDay > 31 {
+		input.SubscriptionDay = 1
+	}
+
+	// 保存凭据到数据库
+	// 获取当前的自动拉取设置和订阅设置，以免被覆盖；订阅日只在尚无配置时取请求值，
+	// 订阅方案变更只由保存配置接口记录
+	var autoFetchInterval, autoFetchEnabled int
+	var subscriptionAmount float64
+	var subscriptionCurrency, displayCurrency string
+	subscriptionDay := input.SubscriptionDay
+	db.QueryRow("SELECT COALESCE(auto_fetch_interval, 30), COALESCE(auto_fetch_enabled, 0), COALESCE(subscription_day, 1), COALESCE(subscription_amount, 0), COALESCE(subscription_currency, 'USD'), COALESCE(display_currency, 'USD') FROM config ORDER BY id DESC LIMIT 1").Scan(&autoFetchInterval, &autoFetchEnabled, &subscriptionDay, &subscriptionAmount, &subscriptionCurrency, &displayCurrency)
+
+	if err := upsertConfig(input.Cookie, input.FormKey, input.TChannel, input.Revision, input.TagID,
+		subscriptionDay, subscriptionAmount, subscriptionCurrency, displayCurrency, autoFetchInterval, autoFetchEnabled); err != nil {
+		log.Printf("Failed to save config during fetch: %v", err)
+	}
+
+	// 当前订阅周期的开始时间（按生效的订阅方案），作为拉取的截止时间
+	subscriptionStartMicros, _ := getPlanPeriodByOffset(0)
+
+	updatedRecords := 0
+	duplicateFound := false
+	reachedSubscriptionStart := false
+	cursor := ""
+
+	// 上次中断留下的续传游标，在本次增量部分完成后依次继续
+	pending := loadResumeCursors()
+	resuming := false
+	saveProgress := func() {
+		pending = saveSyncProgress(pending, resuming, cursor)
+	}
+
+	for {
+		// 构建请求体 - 使用新的 API
+		requestBody := map[string]interface{}{
+			"queryName": "PointsHistoryPageColumnViewerPaginationQuery",
+			"variables": map[string]interface{}{
+				"limit": 20,
+			},
+			"extensions": map[string]string{
+				"hash": "9b68fe8ea0017e5d7701c93a5db8323136f9cb023d514f8595ae0dde220be6d1",
+			},
+		}
+
+		// 如果有 cursor，添加到 variables
+		if cursor != "" {
+			requestBody["variables"].(map[string]interface{})["cursor"] = cursor
+		}
+
+		jsonBody, _ := json.Marshal(requestBody)
+
+		// 创建 HTTP 请求
+		req, err := http.NewRequestWithContext(ctx, "POST", poeBaseURL+"/api/gql_POST", strings.NewReader(string(jsonBody)))
+		if err != nil {
+			saveProgress()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// 设置请求头
+		req.Header.Set("accept", "*/*")
+		req.Header.Set("accept-language", "zh-CN,zh;q=0.9,en;q=0.8")
+		req.Header.Set("content-type", "application/json")
+		req.Header.Set("cookie", input.Cookie)
+		req.Header.Set("origin", poeBaseURL)
+		req.Header.Set("poe-formkey", input.FormKey)
+		req.Header.Set("poe-queryname", "PointsHistoryPageColumnViewerPaginationQuery")
+		req.Header.Set("poe-revision", input.Revision)
+		req.Header.Set("poe-tag-id", input.TagID)
+		req.Header.Set("poe-tchannel", input.TChannel)
+		req.Header.Set("poegraphql", "1")
+		req.Header.Set("referer", poeBaseURL+"/points_history")
+		req.Header.Set("user-agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/142.0.0.0 Safari/537.36")
+
+		// 发送请求（瞬时错误会自动重试）
+		resp, body, err := doPoeRequest(req)
+		if err != nil {
+			saveProgress()
+			if ctx.Err() != nil {
+				abortCanceled()
+			} else {
+				notifySyncFailure("manual", 0, fmt.Sprintf("Error: %v", err), newRecords)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "new_records": newRecords})
+			}
+			return
+		}
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			saveProgress()
+			notifySyncFailure("manual", resp.StatusCode, "", newRecords)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Poe credentials expired, please update cookie and form key", "new_records": newRecords})
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			saveProgress()
+			message := fmt.Sprintf("Poe returned status %d", resp.StatusCode)
+			notifySyncFailure("manual", resp.StatusCode, message, newRecords)
+			c.JSON(http.StatusBadGateway, gin.H{"error": message, "new_records": newRecords})
+			return
+		}
+
+		// 解析响应
+		var poeResp PoeResponse
+		if err := json.Unmarshal(body, &poeResp); err != nil {
+			saveProgress()
+			appMetrics.recordAPIParseError("PointsHistoryPageColumnViewerPaginationQuery")
+			notifySyncFailure("manual", 0, fmt.Sprintf("Parse error: %v", err), newRecords)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse response", "details": err.Error()})
+			return
+		}
+		if err := poeResp.validate(); err != nil {
+			saveProgress()
+			appMetrics.recordAPIParseError("PointsHistoryPageColumnViewerPaginationQuery")
+			log.Printf("Fetch: %v", err)
+			notifySyncFailure("manual", 0, err.Error(), newRecords)
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "new_records": newRecords})
+			return
+		}
+
+		// 处理每条记录
+		for _, edge := range poeResp.Data.Viewer.PointsHistoryConnection.Edges {
+			// 检查是否达到本订阅周期的开始时间
+			if edge.Node.CreationTime <= subscriptionStartMicros {
+				reachedSubscriptionStart = true
+				log.Printf("Reached subscription start time: %s", time.UnixMicro(subscriptionStartMicros).Format("2006-01-02 15:04:05"))
+				break
+			}
+
+			// 检查是否已存在
+			exists, err := recordExists(edge.Node.ID)
+			if err != nil {
+				log.Printf("Error checking record: %v", err)
+				continue
+			}
+
+			// 如果不是全量拉取模式，遇到重复就停止
+			if exists && !input.FullSync {
+				duplicateFound = true
+				break
+			}
+
+			// 插入或更新记录
+			node := &PointsHistoryNode{
+				ID:           edge.Node.ID,
+				PointCost:    edge.Node.PointCost,
+				CreationTime: edge.Node.CreationTime,
+				BotName:      edge.Node.Bot.DisplayName,
+				BotID:        edge.Node.Bot.ID,
+				Cursor:       edge.Cursor,
+				CreatedAt:    time.Unix(edge.Node.CreationTime/1000000, 0),
+			}
+
+			if exists {
+				// 更新现有记录
+				_, err := db.Exec(`
+					UPDATE points_history 
+					SET point_cost = ?, creation_time = ?, bot_name = ?, bot_id = ?, cursor = ?, created_at = ?
+					WHERE id = ?
+				`, node.PointCost, node.CreationTime, node.BotName, node.BotID, node.Cursor, node.CreatedAt, node.ID)
+				if err != nil {
+					log.Printf("Error updating record: %v", err)
+					continue
+				}
+				updatedRecords++
+			} else {
+				// 插入新记录
+				if err := insertRecord(node); err != nil {
+					log.Printf("Error inserting record: %v", err)
+					continue
+				}
+				newRecords++
+			}
+		}
+
+		// 本轮结束后继续处理续传游标
+		pageInfo := poeResp.Data.Viewer.PointsHistoryConnection.PageInfo
+		if !pageInfo.HasNextPage || duplicateFound || reachedSubscriptionStart {
+			if resuming {
+				if len(poeResp.Data.Viewer.PointsHistoryConnection.Edges) == 0 {
+					// 续传页没有任何记录，游标可能已失效，保留到下次重试，超过次数后丢弃
+					log.Printf("Saved cursor returned an empty page, keeping it for retry")
+					saveProgress()
+					recordEmptyResume(pending)
+					break
+				}
+				pending = pending[1:]
+			}
+			if len(pending) == 0 {
+				break
+			}
+			resuming, cursor = true, startResume(pending)
+			duplicateFound, reachedSubscriptionStart = false, false
+			continue
+		}
+
+		// 更新 cursor（请求间隔由 poeLimiter 控制）
+		cursor = pageInfo.EndCursor
+	}
+	if err := saveResumeCursors(pending); err != nil {
+		log.Printf("Failed to save resume cursor: %v", err)
+	}
+
+	afterSync(newRecords)
+
+	message := fmt.Sprintf("Successfully fetched %d new records", newRecords)
+	if updatedRecords > 0 {
+		message = fmt.Sprintf("Successfully fetched %d new records, updated %d existing records", newRecords, updatedRecords)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"new_records":     newRecords,
+		"updated_records": updatedRecords,
+		"message":         message,
+	})
+}
+
+// 获取最新记录
+func getLatestRecords(c *gin.Context) {
+	limit := c.DefaultQuery("limit", "20")
+
+	rows, err := db.Query(`
+		SELECT id, point_cost, creation_time, bot_name, bot_id, cursor, created_at
+		FROM points_history
+		WHERE `+accountFilter+`
+		ORDER BY creation_time DESC
+		LIMIT ?
+	`, requestAccount(c), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var records []PointsHistoryNode
+	for rows.Next() {
+		var r PointsHistoryNode
+		if err := rows.Scan(&r.ID, &r.PointCost, &r.CreationTime, &r.BotName, &r.BotID, &r.Cursor, &r.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		records = append(records, r)
+	}
+
+	if records == nil {
+		records = []PointsHistoryNode{}
+	}
+
+	c.JSON(http.StatusOK, records)
+}
+
+// 获取用户积分信息
+func getUserPointsInfo(c *gin.Context) {
+	// 从数据库获取配置
+	var config Config
+	err := db.QueryRow(`
+		SELECT COALESCE(cookie, '') as cookie, COALESCE(form_key, '') as form_key, 
+		       COALESCE(tchannel, '') as tchannel, COALESCE(revision, '') as revision, 
+		       COALESCE(tag_id, '') as tag_id
+		FROM config ORDER BY id DESC LIMIT 1
+	`).Scan(&config.Cookie, &config.FormKey, &config.TChannel, &config.Revision, &config.TagID)
+
+	if err != nil || config.Cookie == "" {
+		c.JSON(http.StatusOK, gin.H{"error": "No config found"})
+		return
+	}
+
+	// 构建请求体
+	requestBody := map[string]interface{}{
+		"queryName": "settingsPageQuery",
+		"variables": map[string]interface{}{},
+		"extensions": map[string]string{
+			"hash": "39ca34ece084fd810ccc8394942a2a584651433a57e7455ae80546a2e7893b5f",
+		},
+	}
+
+	ctx, cancel := withAppCancel(c.Request.Context())
+	defer cancel()
+
+	jsonBody, _ := json.Marshal(requestBody)
+	req, err := http.NewRequestWithContext(ctx, "POST", poeBaseURL+"/api/gql_POST", strings.NewReader(string(jsonBody)))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 设置请求头
+	req.Header.Set("accept", "*/*")
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("cookie", config.Cookie)
+	req.Header.Set("poe-formkey", config.FormKey)
+	req.Header.Set("poe-tchannel", config.TChannel)
+	req.Header.Set("poe-revision", config.Revision)
+	req.Header.Set("poe-tag-id", config.TagID)
+	req.Header.Set("poe-queryname", "settingsPageQuery")
+	req.Header.Set("poegraphql", "1")
+
+	resp, body, err := doPoeRequest(req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Poe returned status %d", resp.StatusCode)})
+		return
+	}
+
+	// 解析响应
+	var result map[string]interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		appMetrics.recordAPIParseError("settingsPageQuery")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 提取积分信息
+	data := result["data"].(map[string]interface{})
+	viewer := data["viewer"].(map[string]interface{})
+	messagePointInfo := viewer["messagePointInfo"].(map[string]interface{})
+	subscription := viewer["subscription"].(map[string]interface{})
+
+	// 计算已使用积分
+	totalAllotment := int64(messagePointInfo["totalMessagePointAllotment"].(float64))
+	currentBalance := int64(messagePointInfo["subscriptionPointBalance"].(float64))
+	usedPoints := totalAllotment - currentBalance
+
+	// 获取当前周期的开始时间（通过下次重置时间推算）
+	nextGrantTime := int64(messagePointInfo["computePointNextGrantTime"].(float64))
+	expiresTime := int64(subscription["expiresTime"].(float64))
+
+	currentTime := time.Now().UnixMicro()
+
+	// 记录余额快照，供预测等离线计算和加购识别使用
+	if err := recordPointsSnapshot(totalAllotment, currentBalance, nextGrantTime, currentTime); err != nil {
+		log.Printf("Failed to save points snapshot: %v", err)
+	}
+
+	// 记录本订阅周期的积分配额，用于积分价值计算
+	periodStart, _ := getPlanPeriodByOffset(0)
+	if err := recordPoeAllotment(periodStart, totalAllotment); err != nil {
+		log.Printf("Failed to save cycle allotment: %v", err)
+	}
+
+	// 计算当前周期开始时间（假设是一个月前）
+	cycleStartTime := nextGrantTime - 30*24*60*60*1000000 // 30天前
+
+	// 从数据库获取本周期内的总消耗
+	var totalUsedInCycle int
+	db.QueryRow(`
+		SELECT COALESCE(SUM(point_cost), 0) 
+		FROM points_history 
+		WHERE creation_time >= ? AND `+accountFilter+`
+	`, cycleStartTime, localAccount).Scan(&totalUsedInCycle)
+
+	// 计算每日平均消耗
+	daysInCycle := float64(currentTime-cycleStartTime) / (24 * 60 * 60 * 1000000)
+	if daysInCycle < 1 {
+		daysInCycle = 1
+	}
+	avgPerDay := int(float64(totalUsedInCycle) / daysInCycle)
+
+	// 预计剩余天数
+	var remainingDays int
+	if avgPerDay > 0 {
+		remainingDays = int(float64(currentBalance) / float64(avgPerDay))
+	} else {
+		remainingDays = 999
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total_allotment":      totalAllotment,
+		"current_balance":      currentBalance,
+		"used_points":          usedPoints,
+		"usage_percentage":     float64(usedPoints) / float64(totalAllotment) * 100,
+		"avg_per_day":          avgPerDay,
+		"remaining_days":       remainingDays,
+		"next_grant_time":      nextGrantTime,
+		"expires_time":         expiresTime,
+		"subscription_product": subscription["subscriptionProduct"].(map[string]interface{})["displayName"],
+	})
+}
+
+// 机器人统计
+type BotStat struct {
+	BotName      string  `json:"bot_name"`
+	TotalCost    int     `json:"total_cost"`
+	Count        int     `json:"count"`
+	CostUSD      float64 `json:"cost_usd"`
+	Cost         float64 `json:"cost"`
+	CostCurrency string  `json:"cost_currency,omitempty"`
+}
+
+// 查询机器人消耗统计（periodStart 和 periodEnd 都为 0 时统计全部记录）
+// costs 不为 nil 时按天汇总后归入各自的订阅周期，用该周期的单积分价值计算费用
+func queryBotStats(periodStart, periodEnd int64, account string, costs *costCalculator) ([]BotStat, error) {
+	query := `
+		SELECT 
+			bot_name,
+			date(creation_time / 1000000, 'unixepoch', 'localtime') as day,
+			SUM(point_cost) as total_cost,
+			COUNT(*) as count
+		FROM points_history
+		WHERE ` + accountFilter + `
+	`
+	args := []interface{}{account}
+	if periodStart != 0 || periodEnd != 0 {
+		query += " AND creation_time >= ? AND creation_time < ?"
+		args = append(args, periodStart, periodEnd)
+	}
+	query += `
+		GROUP BY bot_name, day
+	`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byBot := make(map[string]*BotStat)
+	for rows.Next() {
+		var botName, day string
+		var points, count int
+		if err := rows.Scan(&botName, &day, &points, &count); err != nil {
+			return nil, err
+		}
+
+		s, ok := byBot[botName]
+		if !ok {
+			s = &BotStat{BotName: botName}
+			byBot[botName] = s
+		}
+		s.TotalCost += points
+		s.Count += count
+
+		if costs != nil {
+			dayStart, err := time.ParseInLocation("2006-01-02", day, time.Local)
+			if err != nil {
+				return nil, err
+			}
+			costUSD, cost := costs.cost(dayStart.UnixMicro(), points)
+			s.CostUSD += costUSD
+			s.Cost += cost
+			s.CostCurrency = costs.currency
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// 超出订阅配额的部分按加购积分的价格计价
+	if costs != nil {
+		adjustments, err := costs.purchaseAdjustmentsByBot(periodStart, periodEnd)
+		if err != nil {
+			return nil, err
+		}
+		for botName, a := range adjustments {
+			if s, ok := byBot[botName]; ok {
+				s.CostUSD += a[0]
+				s.Cost += a[1]
+			}
+		}
+	}
+
+	stats := make([]BotStat, 0, len(byBot))
+	for _, s := range byBot {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].TotalCost != stats[j].TotalCost {
+			return stats[i].TotalCost > stats[j].TotalCost
+		}
+		return stats[i].BotName < stats[j].BotName
+	})
+
+	return stats, nil
+}
+
+// 获取机器人统计，费用只对本机账户计算
+func getBotStats(c *gin.Context) {
+	costs, err := newCostCalculator(c.Query("currency"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account := requestAccount(c)
+	if account != localAccount {
+		costs = nil
+	}
+	stats, err := queryBotStats(0, 0, account, costs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// 获取配置
+func getConfig(c *gin.Context) {
+	var config Config
+	var autoFetchEnabled int
+	var subscriptionCurrency sql.NullString
+	var subscriptionAmount sql.NullFloat64
+	err := db.QueryRow(`
+		SELECT id, COALESCE(cookie, '') as cookie, COALESCE(form_key, '') as form_key, 
+		       COALESCE(tchannel, '') as tchannel, COALESCE(revision, '') as revision, 
+		       COALESCE(tag_id, '') as tag_id, COALESCE(subscription_day, 1) as subscription_day,
+		       subscription_amount, subscription_currency,
+		       COALESCE(display_currency, 'USD') as display_currency,
+		       COALESCE(auto_fetch_interval, 30) as auto_fetch_interval,
+		       COALESCE(auto_fetch_enabled, 0) as auto_fetch_enabled,
+		       COALESCE(auto_fetch_mode, 'interval'), COALESCE(auto_fetch_cron, ''), COALESCE(quiet_hours, ''),
+		       COALESCE(adaptive_min_interval, 5), COALESCE(adaptive_max_interval, 120),
+		       updated_at
+		FROM config ORDER BY id DESC LIMIT 1
+	`).Scan(&config.ID, &config.Cookie, &config.FormKey, &config.TChannel,
+		&config.Revision, &config.TagID, &config.SubscriptionDay,
+		&subscriptionAmount, &subscriptionCurrency, &config.DisplayCurrency,
+		&config.AutoFetchInterval, &autoFetchEnabled,
+		&config.AutoFetchMode, &config.AutoFetchCron, &config.QuietHours,
+		&config.AdaptiveMinInterval, &config.AdaptiveMaxInterval, &config.UpdatedAt)
+
+	config.AutoFetchEnabled = autoFetchEnabled == 1
+	if subscriptionAmount.Valid {
+		config.SubscriptionAmount = subscriptionAmount.Float64
+	}
+	if subscriptionCurrency.Valid && subscriptionCurrency.String != "" {
+		config.SubscriptionCurrency = subscriptionCurrency.String
+	} else {
+		config.SubscriptionCurrency = "USD"
+	}
+
+	if err == sql.ErrNoRows {
+		// 返回空配置
+		c.JSON(http.StatusOK, Config{
+			Revision:             "59988163982a4ac4be7c7e7784f006dc48cafcf5",
+			TagID:                "8a0df086c2034f5e97dcb01c426029ee",
+			SubscriptionDay:      1,
+			SubscriptionAmount:   0,
+			SubscriptionCurrency: "USD",
+			DisplayCurrency:      "USD",
+			AutoFetchInterval:    30,
+			AutoFetchEnabled:     false,
+			AutoFetchMode:        autoFetchModeInterval,
+			AdaptiveMinInterval:  5,
+			AdaptiveMaxInterval:  120,
+		})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, config)
+}
+
+// 内部辅助函数：保存配置到数据库（处理插入或更新）
+func upsertConfig(cookie, formKey, tchannel, revision, tagID string, subscriptionDay int, subscriptionAmount float64, subscriptionCurrency, displayCurrency string, autoFetchInterval, autoFetchEnabled int) error {
+	var existingID int
+	err := db.QueryRow("SELECT id FROM config ORDER BY id DESC LIMIT 1").Scan(&existingID)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// 不存在配置，执行插入
+			_, err = db.Exec(`
+				INSERT INTO config (cookie, form_key, tchannel, revision, tag_id, subscription_day, 
+				                    subscription_amount, subscription_currency, display_currency,
+				                    auto_fetch_interval, auto_fetch_enabled, updated_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`, cookie, formKey, tchannel, revision, tagID, subscriptionDay, subscriptionAmount, subscriptionCurrency, displayCurrency, autoFetchInterval, autoFetchEnabled, time.Now())
+		}
+		// 如果是其他错误，直接返回
+		return err
+	}
+
+	// 存在配置，执行更新
+	_, err = db.Exec(`
+		UPDATE config 
+		SET cookie = ?, form_key = ?, tchannel = ?, revision = ?, tag_id = ?, 
+		    subscription_day = ?, subscription_amount = ?, subscription_currency = ?, display_currency = ?,
+		    auto_fetch_interval = ?, auto_fetch_enabled = ?, updated_at = ?
+		WHERE id = ?
+	`, cookie, formKey, tchannel, revision, tagID, subscriptionDay, subscriptionAmount, subscriptionCurrency, displayCurrency, autoFetchInterval, autoFetchEnabled, time.Now(), existingID)
+	return err
+}
+
+// 保存/更新配置
+func saveConfig(c *gin.Context) {
+	var input struct {
+		Cookie               string  `json:"cookie"`
+		FormKey              string  `json:"form_key"`
+		TChannel             string  `json:"tchannel"`
+		Revision             string  `json:"revision"`
+		TagID                string  `json:"tag_id"`
+		SubscriptionDay      int     `json:"subscription_day"`
+		SubscriptionAmount   float64 `json:"subscription_amount"`
+		SubscriptionCurrency string  `json:"subscription_currency"`
+		AutoFetchInterval    int     `json:"auto_fetch_interval"`
+		AutoFetchEnabled     bool    `json:"auto_fetch_enabled"`
+		// 显示货币和调度设置：未提供时保持原值
+		DisplayCurrency     *string `json:"display_currency"`
+		AutoFetchMode       *string `json:"auto_fetch_mode"`
+		AutoFetchCron       *string `json:"auto_fetch_cron"`
+		QuietHours          *string `json:"quiet_hours"`
+		AdaptiveMinInterval *int    `json:"adaptive_min_interval"`
+		AdaptiveMaxInterval *int    `json:"adaptive_max_interval"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 规范化货币代码（默认 USD），不支持的货币直接拒绝
+	currency, err := normalizeCurrency(input.SubscriptionCurrency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.SubscriptionCurrency = currency
+
+	displayCurrency := "USD"
+	db.QueryRow("SELECT COALESCE(display_currency, 'USD') FROM config ORDER BY id DESC LIMIT 1").Scan(&displayCurrency)
+	if input.DisplayCurrency != nil {
+		if displayCurrency, err = normalizeCurrency(*input.DisplayCurrency); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// 合并并校验调度设置
+	var mode, cronExpr, quiet string
+	var adaptiveMin, adaptiveMax int
+	db.QueryRow(`
+		SELECT COALESCE(auto_fetch_mode, 'interval'), COALESCE(auto_fetch_cron, ''), COALESCE(quiet_hours, ''),
+		       COALESCE(adaptive_min_interval, 5), COALESCE(adaptive_max_interval, 120)
+		FROM config ORDER BY id DESC LIMIT 1
+	`).Scan(&mode, &cronExpr, &quiet, &adaptiveMin, &adaptiveMax)
+	if mode == "" {
+		mode, adaptiveMin, adaptiveMax = autoFetchModeInterval, 5, 120
+	}
+	if input.AutoFetchMode != nil {
+		mode = *input.AutoFetchMode
+	}
+	if input.AutoFetchCron != nil {
+		cronExpr = strings.TrimSpace(*input.AutoFetchCron)
+	}
+	if input.QuietHours != nil {
+		quiet = strings.TrimSpace(*input.QuietHours)
+	}
+	if input.AdaptiveMinInterval != nil {
+		adaptiveMin = *input.AdaptiveMinInterval
+	}
+	if input.AdaptiveMaxInterval != nil {
+		adaptiveMax = *input.AdaptiveMaxInterval
+	}
+	plan, err := newFetchPlan(mode, input.AutoFetchInterval, cronExpr, quiet, adaptiveMin, adaptiveMax)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	autoFetchEnabledInt := 0
+	if input.AutoFetchEnabled {
+		autoFetchEnabledInt = 1
+	}
+
+	// 使用统一的保存逻辑
+	if err := upsertConfig(input.Cookie, input.FormKey, input.TChannel, input.Revision, input.TagID,
+		input.SubscriptionDay, input.SubscriptionAmount, input.SubscriptionCurrency, displayCurrency,
+		input.AutoFetchInterval, autoFetchEnabledInt); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := recordPlanChange(input.SubscriptionDay, input.SubscriptionAmount, input.SubscriptionCurrency); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := db.Exec(`
+		UPDATE config
+		SET auto_fetch_mode = ?, auto_fetch_cron = ?, quiet_hours = ?, adaptive_min_interval = ?, adaptive_max_interval = ?
+		WHERE id = (SELECT MAX(id) FROM config)
+	`, plan.mode, cronExpr, quiet, plan.adaptiveMin, plan.adaptiveMax); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 重启自动拉取定时器
+	restartAutoFetchTimer()
+
+	c.JSON(http.StatusOK, gin.H{"message": "配置已保存"})
+}
+
+// 获取布局配置
+func getLayoutConfig(c *gin.Context) {
+	var sidebarWidth int
+	var gridLayout sql.NullString
+
+	err := db.QueryRow("SELECT COALESCE(sidebar_width, 400), grid_layout FROM layout_config ORDER BY id DESC LIMIT 1").Scan(&sidebarWidth, &gridLayout)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusOK, gin.H{
+			"sidebar_width": 400,
+			"grid_layout":   nil,
+		})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var layout interface{}
+	if gridLayout.Valid && gridLayout.String != "" {
+		json.Unmarshal([]byte(gridLayout.String), &layout)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"sidebar_width": sidebarWidth,
+		"grid_layout":   layout,
+	})
+}
+
+// 保存布局配置
+func saveLayoutConfig(c *gin.Context) {
+	var input struct {
+		SidebarWidth *int        `json:"sidebar_width"`
+		GridLayout   interface{} `json:"grid_layout"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 获取现有配置
+	var currentWidth int
+	var currentLayout sql.NullString
+	db.QueryRow("SELECT COALESCE(sidebar_width, 400), grid_layout FROM layout_config ORDER BY id DESC LIMIT 1").Scan(&currentWidth, &currentLayout)
+
+	newWidth := currentWidth
+	if input.SidebarWidth != nil {
+		newWidth = *input.SidebarWidth
+		// 限制宽度范围
+		if newWidth < 300 {
+			newWidth = 300
+		}
+		if newWidth > 600 {
+			newWidth = 600
+		}
+	}
+
+	newLayout := currentLayout.String
+	if input.GridLayout != nil {
+		layoutBytes, _ := json.Marshal(input.GridLayout)
+		newLayout = string(layoutBytes)
+	}
+
+	_, err := db.Exec("INSERT OR REPLACE INTO layout_config (id, sidebar_width, grid_layout, updated_at) VALUES (1, ?, ?, ?)",
+		newWidth, newLayout, time.Now())
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "布局已保存"})
+}
+
+// 接收前端日志
+func logFrontend(c *gin.Context) {
+	var logEntry struct {
+		Timestamp string      `json:"timestamp"`
+		Level     string      `json:"level"`
+		Message   string      `json:"message"`
+		Data      interface{} `json:"data"`
+	}
+
+	if err := c.ShouldBindJSON(&logEntry); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 写入日志文件
+	if frontendLogFile != nil {
+		logLine := fmt.Sprintf("[%s] [%s] %s", logEntry.Timestamp, logEntry.Level, logEntry.Message)
+		if logEntry.Data != nil {
+			dataJSON, _ := json.Marshal(logEntry.Data)
+			logLine += fmt.Sprintf(" | Data: %s", string(dataJSON))
+		}
+		logLine += "\n"
+
+		frontendLogFile.WriteString(logLine)
+		frontendLogFile.Sync() // 立即刷新到磁盘
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "logged"})
+}
+
+// 获取自动拉取状态
+func getAutoFetchStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, scheduler.status())
+}
+
+// 默认周期积分配额（没有任何记录时使用）
+const defaultTotalAllotment = 1000000
+
+// 周期积分配额
+type CycleAllotment struct {
+	PeriodStart        int64  `json:"period_start"`
+	PoeAllotment       *int64 `json:"poe_allotment"`    // Poe 返回的配额
+	ManualAllotment    *int64 `json:"manual_allotment"` // 手动覆盖（如加购积分）
+	EffectiveAllotment int64  `json:"effective_allotment"`
+	Source             string `json:"source"`
+}
+
+// 记录 Poe 返回的周期配额（不影响手动覆盖）
+func recordPoeAllotment(periodStart, allotment int64) error {
+	if allotment <= 0 {
+		return nil
+	}
+	_, err := db.Exec(`
+		INSERT INTO cycle_allotments (period_start, poe_allotment, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(period_start) DO UPDATE SET poe_allotment = excluded.poe_allotment, updated_at = excluded.updated_at
+	`, periodStart, allotment, time.Now())
+	return err
+}
+
+// 获取周期生效的积分配额：本周期手动覆盖 > 订阅方案配额 > 本周期 Poe 配额 > 之前最近的 Poe 配额 > 默认值
+// planAllotment 为 0 表示方案未指定配额
+func getAllotmentForPeriod(periodStart, planAllotment int64) (int64, string) {
+	var poeAllotment, manualAllotment sql.NullInt64
+	err := db.QueryRow(`
+		SELECT poe_allotment, manual_allotment FROM cycle_allotments WHERE period_start = ?
+	`, periodStart).Scan(&poeAllotment, &manualAllotment)
+	if err == nil {
+		if manualAllotment.Valid && manualAllotment.Int64 > 0 {
+			return manualAllotment.Int64, "manual"
+		}
+	}
+	if planAllotment > 0 {
+		return planAllotment, "plan"
+	}
+	if err == nil {
+		if poeAllotment.Valid && poeAllotment.Int64 > 0 {
+			return poeAllotment.Int64, "poe"
+		}
+	}
+
+	var previous int64
+	err = db.QueryRow(`
+		SELECT poe_allotment FROM cycle_allotments
+		WHERE period_start < ? AND poe_allotment > 0
+		ORDER BY period_start DESC LIMIT 1
+	`, periodStart).Scan(&previous)
+	if err == nil {
+		return previous, "poe"
+	}
+
+	return defaultTotalAllotment, "default"
+}
+
+// 获取各周期的积分配额
+func getAllotments(c *gin.Context) {
+	plans, err := loadPlanSchedule()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT period_start, poe_allotment, manual_allotment
+		FROM cycle_allotments ORDER BY period_start DESC
+	`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	allotments := []CycleAllotment{}
+	for rows.Next() {
+		var a CycleAllotment
+		var poeAllotment, manualAllotment sql.NullInt64
+		if err := rows.Scan(&a.PeriodStart, &poeAllotment, &manualAllotment); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if poeAllotment.Valid {
+			a.PoeAllotment = &poeAllotment.Int64
+		}
+		if manualAllotment.Valid {
+			a.ManualAllotment = &manualAllotment.Int64
+		}
+		a.EffectiveAllotment, a.Source = getAllotmentForPeriod(a.PeriodStart, plans.at(a.PeriodStart).Allotment)
+		allotments = append(allotments, a)
+	}
+
+	c.JSON(http.StatusOK, allotments)
+}
+
+// 设置或清除周期积分配额的手动覆盖（allotment 为 0 或不传表示清除）
+func setAllotmentOverride(c *gin.Context) {
+	var input struct {
+		Period    int   `json:"period"` // 周期偏移量（0=当前周期）
+		Allotment int64 `json:"allotment"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Allotment < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "allotment must not be negative"})
+		return
+	}
+
+	plans, err := loadPlanSchedule()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	periodStart, _ := plans.periodByOffset(input.Period)
+
+	var manual interface{}
+	if input.Allotment > 0 {
+		manual = input.Allotment
+	}
+	_, err = db.Exec(`
+		INSERT INTO cycle_allotments (period_start, manual_allotment, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(period_start) DO UPDATE SET manual_allotment = excluded.manual_allotment, updated_at = excluded.updated_at
+	`, periodStart, manual, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	allotment, source := getAllotmentForPeriod(periodStart, plans.at(periodStart).Allotment)
+	c.JSON(http.StatusOK, gin.H{
+		"period_start":        periodStart,
+		"effective_allotment": allotment,
+		"source":              source,
+	})
+}
+
+// 订阅费用统计信息
+type SubscriptionCostInfo struct {
+	SubscriptionDay       int                `json:"subscription_day"`
+	SubscriptionAmount    float64            `json:"subscription_amount"`
+	SubscriptionCurrency  string             `json:"subscription_currency"`
+	SubscriptionAmountUSD float64            `json:"subscription_amount_usd"`
+	PlanID                int64              `json:"plan_id"` // 0 表示尚未建立订阅方案，使用配置
+	Plans                 []PlanSegment      `json:"plans"`   // 周期内各方案生效的区间
+	PeriodStart           int64              `json:"period_start"`
+	PeriodEnd             int64              `json:"period_end"`
+	TotalPointsUsed       int                `json:"total_points_used"`
+	TotalAllotment        int64              `json:"total_allotment"`
+	AllotmentSource       string             `json:"allotment_source"` // manual, poe, default
+	PointValueUSD         float64            `json:"point_value_usd"`
+	UsedPointsValueUSD    float64            `json:"used_points_value_usd"`
+	RateDate              string             `json:"rate_date"` // 所用汇率的日期（空表示内置静态表）
+	CurrencyRates         map[string]float64 `json:"currency_rates"`
+
+	// 加购积分（订阅配额用完后才消耗，未用完的结转到后续周期）
+	SubscriptionPointsUsed   int64   `json:"subscription_points_used"`
+	PurchasedPointsUsed      int64   `json:"purchased_points_used"`
+	PurchasedPointsValueUSD  float64 `json:"purchased_points_value_usd"`
+	PurchasedPointsBought    int64   `json:"purchased_points_bought"` // 本周期购买的积分
+	PurchasedAmountUSD       float64 `json:"purchased_amount_usd"`
+	PurchasedPointsRemaining int64   `json:"purchased_points_remaining"` // 截至周期结束剩余的加购积分
+	EffectivePointValueUSD   float64 `json:"effective_point_value_usd"`  // 已用积分的综合单价
+
+	// 以显示货币表示的金额
+	DisplayCurrency            string  `json:"display_currency"`
+	DisplayRate                float64 `json:"display_rate"`      // 1 USD 折合的显示货币
+	DisplayRateDate            string  `json:"display_rate_date"` // 空表示内置静态表
+	SubscriptionAmountDisplay  float64 `json:"subscription_amount_display"`
+	PointValueDisplay          float64 `json:"point_value_display"`
+	UsedPointsValueDisplay     float64 `json:"used_points_value_display"`
+	EffectivePointValueDisplay float64 `json:"effective_point_value_display"`
+}
+
+// 美元到显示货币的换算
+type DisplayConversion struct {
+	Currency string  `json:"currency"`
+	Rate     float64 `json:"rate"`      // 1 USD 折合的显示货币
+	RateDate string  `json:"rate_date"` // 空表示内置静态表
+}
+
+// 将美元金额换算为显示货币
+func (d DisplayConversion) FromUSD(amountUSD float64) float64 {
+	return amountUSD * d.Rate
+}
+
+// 获取配置的默认显示货币
+func getDefaultDisplayCurrency() string {
+	var currency string
+	err := db.QueryRow("SELECT COALESCE(display_currency, 'USD') FROM config ORDER BY id DESC LIMIT 1").Scan(&currency)
+	if err != nil || currency == "" {
+		return "USD"
+	}
+	return currency
+}
+
+// 获取指定时间的显示货币换算（currency 为空时使用配置的默认显示货币）
+func getDisplayConversion(currency string, at time.Time) (DisplayConversion, error) {
+	if strings.TrimSpace(currency) == "" {
+		currency = getDefaultDisplayCurrency()
+	}
+	code, err := normalizeCurrency(currency)
+	if err != nil {
+		return DisplayConversion{}, err
+	}
+
+	usdRate, rateDate, ok := getUSDRate(code, at)
+	if !ok || usdRate <= 0 {
+		return DisplayConversion{}, fmt.Errorf("no exchange rate for %s", code)
+	}
+	return DisplayConversion{Currency: code, Rate: 1 / usdRate, RateDate: rateDate}, nil
+}
+
+// 订阅配置
+type SubscriptionSettings struct {
+	Day      int
+	Amount   float64
+	Currency string
+}
+
+// 读取最新的订阅配置（未配置时订阅日为 1 号、货币为 USD）
+func getSubscriptionSettings() (SubscriptionSettings, error) {
+	settings := SubscriptionSettings{Day: 1, Currency: "USD"}
+	err := db.QueryRow(`
+		SELECT COALESCE(subscription_day, 1), COALESCE(subscription_amount, 0), COALESCE(subscription_currency, 'USD')
+		FROM config ORDER BY id DESC LIMIT 1
+	`).Scan(&settings.Day, &settings.Amount, &settings.Currency)
+	if err == sql.ErrNoRows {
+		return settings, nil
+	}
+	if settings.Day <= 0 || settings.Day > 31 {
+		settings.Day = 1
+	}
+	return settings, err
+}
+
+// 订阅方案（从 effective_from 起生效，直到下一个方案生效）
+type SubscriptionPlan struct {
+	ID              int64     `json:"id"`
+	EffectiveFrom   int64     `json:"effective_from"` // 微秒，本地时间当天 0 点
+	Amount          float64   `json:"amount"`
+	Currency        string    `json:"currency"`
+	Allotment       int64     `json:"allotment"` // 0 表示使用检测到的配额
+	SubscriptionDay int       `json:"subscription_day"`
+	Note            string    `json:"note"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// 按生效时间升序排列的订阅方案
+type planSchedule []SubscriptionPlan
+
+// 加载订阅方案，尚未建立方案时以当前配置作为唯一方案
+func loadPlanSchedule() (planSchedule, error) {
+	rows, err := db.Query(`
+		SELECT id, effective_from, amount, currency, COALESCE(allotment, 0), subscription_day, COALESCE(note, ''), created_at
+		FROM subscription_plans ORDER BY effective_from, id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans planSchedule
+	for rows.Next() {
+		var p SubscriptionPlan
+		if err := rows.Scan(&p.ID, &p.EffectiveFrom, &p.Amount, &p.Currency, &p.Allotment, &p.SubscriptionDay, &p.Note, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		plans = append(plans, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(plans) == 0 {
+		settings, err := getSubscriptionSettings()
+		if err != nil {
+			return nil, err
+		}
+		plans = planSchedule{{Amount: settings.Amount, Currency: settings.Currency, SubscriptionDay: settings.Day}}
+	}
+	return plans, nil
+}
+
+// 时间戳生效的方案下标（早于所有方案时使用最早的方案）
+func (ps planSchedule) indexAt(timestamp int64) int {
+	idx := sort.Search(len(ps), func(i int) bool { return ps[i].EffectiveFrom > timestamp }) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return idx
+}
+
+// 时间戳生效的方案
+func (ps planSchedule) at(timestamp int64) SubscriptionPlan {
+	return ps[ps.indexAt(timestamp)]
+}
+
+// 计算时间戳所在的订阅周期，续费日变更时周期在新方案生效时切分
+func (ps planSchedule) periodAt(timestamp int64) (int64, int64) {
+	idx := ps.indexAt(timestamp)
+	periodStart, periodEnd := getCurrentSubscriptionPeriod(ps[idx].SubscriptionDay, timestamp)
+
+	for j := idx; j > 0 && ps[j].EffectiveFrom > periodStart; j-- {
+		if ps[j-1].SubscriptionDay != ps[j].SubscriptionDay {
+			periodStart = ps[j].EffectiveFrom
+			break
+		}
+	}
+	for j := idx + 1; j < len(ps) && ps[j].EffectiveFrom < periodEnd; j++ {
+		if ps[j-1].SubscriptionDay != ps[j].SubscriptionDay {
+			periodEnd = ps[j].EffectiveFrom
+			break
+		}
+	}
+	return periodStart, periodEnd
+}
+
+// 计算相对当前周期偏移 offset 个周期的订阅周期（0=当前周期，-1=上个周期）
+func (ps planSchedule) periodByOffset(offset int) (int64, int64) {
+	periodStart, periodEnd := ps.periodAt(time.Now().UnixMicro())
+	for ; offset < 0; offset++ {
+		periodStart, periodEnd = ps.periodAt(periodStart - 1)
+	}
+	for ; offset > 0; offset-- {
+		periodStart, periodEnd = ps.periodAt(periodEnd)
+	}
+	return periodStart, periodEnd
+}
+
+// 按订阅方案计算相对当前周期偏移 offset 个周期的订阅周期
+func getPlanPeriodByOffset(offset int) (int64, int64) {
+	plans, err := loadPlanSchedule()
+	if err != nil {
+		log.Printf("Failed to load subscription plans: %v", err)
+		return getSubscriptionPeriodByOffset(1, offset)
+	}
+	return plans.periodByOffset(offset)
+}
+
+// 获取当前生效的订阅方案
+func getCurrentPlan() SubscriptionPlan {
+	plans, err := loadPlanSchedule()
+	if err != nil {
+		log.Printf("Failed to load subscription plans: %v", err)
+		return SubscriptionPlan{Currency: "USD", SubscriptionDay: 1}
+	}
+	return plans.at(time.Now().UnixMicro())
+}
+
+// 订阅周期内某一方案的计价信息
+type CyclePricing struct {
+	PeriodStart           int64
+	PlanID                int64
+	SubscriptionAmount    float64
+	SubscriptionCurrency  string
+	SubscriptionAmountUSD float64
+	RateDate              string
+	TotalAllotment        int64
+	AllotmentSource       string
+	PointValueUSD         float64
+}
+
+// 计算方案在周期内的单积分美元价值：订阅费用按周期开始（或方案生效）时的汇率转换为美元，再除以积分配额
+func getCyclePricing(plan SubscriptionPlan, periodStart int64) CyclePricing {
+	priceTime := time.UnixMicro(periodStart)
+	if plan.EffectiveFrom > periodStart {
+		priceTime = time.UnixMicro(plan.EffectiveFrom)
+	}
+	amountUSD := convertToUSDAt(plan.Amount, plan.Currency, priceTime)
+	_, rateDate, _ := getUSDRate(plan.Currency, priceTime)
+
+	// 积分配额优先级：手动覆盖 > 方案配额 > Poe 返回值 > 默认 100 万
+	allotment, source := getAllotmentForPeriod(periodStart, plan.Allotment)
+
+	return CyclePricing{
+		PeriodStart:           periodStart,
+		PlanID:                plan.ID,
+		SubscriptionAmount:    plan.Amount,
+		SubscriptionCurrency:  plan.Currency,
+		SubscriptionAmountUSD: amountUSD,
+		RateDate:              rateDate,
+		TotalAllotment:        allotment,
+		AllotmentSource:       source,
+		PointValueUSD:         amountUSD / float64(allotment),
+	}
+}
+
+// 按记录创建时生效的方案和所在订阅周期计算费用，并缓存各周期的计价与显示货币汇率
+type costCalculator struct {
+	plans    planSchedule
+	currency string
+	fallback DisplayConversion
+	pricing  map[[2]int64]CyclePricing
+	display  map[int64]DisplayConversion
+
+	purchases *purchaseLedger
+}
+
+// 创建费用计算器，displayCurrency 为空时使用默认显示货币
+func newCostCalculator(displayCurrency string) (*costCalculator, error) {
+	plans, err := loadPlanSchedule()
+	if err != nil {
+		return nil, err
+	}
+	fallback, err := getDisplayConversion(displayCurrency, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &costCalculator{
+		plans:    plans,
+		currency: fallback.Currency,
+		fallback: fallback,
+		pricing:  make(map[[2]int64]CyclePricing),
+		display:  make(map[int64]DisplayConversion),
+	}, nil
+}
+
+// 获取时间戳生效方案在所在周期的计价信息
+func (cc *costCalculator) pricingAt(timestamp int64) CyclePricing {
+	plan := cc.plans.at(timestamp)
+	periodStart, _ := cc.plans.periodAt(timestamp)
+	key := [2]int64{periodStart, plan.ID}
+	if pricing, ok := cc.pricing[key]; ok {
+		return pricing
+	}
+	pricing := getCyclePricing(plan, periodStart)
+	cc.pricing[key] = pricing
+	return pricing
+}
+
+// 获取周期开始时的显示货币换算
+func (cc *costCalculator) displayAt(periodStart int64) DisplayConversion {
+	if display, ok := cc.display[periodStart]; ok {
+		return display
+	}
+	display, err := getDisplayConversion(cc.currency, time.UnixMicro(periodStart))
+	if err != nil {
+		display = cc.fallback
+	}
+	cc.display[periodStart] = display
+	return display
+}
+
+// 计算在指定时间消耗的积分对应的美元和显示货币费用
+func (cc *costCalculator) cost(timestamp int64, points int) (float64, float64) {
+	pricing := cc.pricingAt(timestamp)
+	costUSD := float64(points) * pricing.PointValueUSD
+	return costUSD, cc.displayAt(pricing.PeriodStart).FromUSD(costUSD)
+}
+
+// 周期内单个方案生效的区间
+type PlanSegment struct {
+	PlanID        int64   `json:"plan_id"`
+	Start         int64   `json:"start"`
+	End           int64   `json:"end"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	PointsUsed    int     `json:"points_used"`
+	PointValueUSD float64 `json:"point_value_usd"`
+	ValueUSD      float64 `json:"value_usd"`
+}
+
+// 计算周期内各方案生效的区间及其消耗的积分价值
+func (cc *costCalculator) segments(periodStart, periodEnd int64) ([]PlanSegment, error) {
+	var segments []PlanSegment
+	for i := cc.plans.indexAt(periodStart); i < len(cc.plans); i++ {
+		plan := cc.plans[i]
+		start, end := periodStart, periodEnd
+		if plan.EffectiveFrom > start {
+			start = plan.EffectiveFrom
+		}
+		if i+1 < len(cc.plans) && cc.plans[i+1].EffectiveFrom < end {
+			end = cc.plans[i+1].EffectiveFrom
+		}
+		if start >= periodEnd {
+			break
+		}
+		if start >= end {
+			continue
+		}
+
+		var points int
+		if err := db.QueryRow(`
+			SELECT COALESCE(SUM(point_cost), 0) FROM points_history
+			WHERE creation_time >= ? AND creation_time < ? AND `+accountFilter+`
+		`, start, end, localAccount).Scan(&points); err != nil {
+			return nil, err
+		}
+
+		pricing := cc.pricingAt(start)
+		segments = append(segments, PlanSegment{
+			PlanID:        plan.ID,
+			Start:         start,
+			End:           end,
+			Amount:        plan.Amount,
+			Currency:      plan.Currency,
+			PointsUsed:    points,
+			PointValueUSD: pricing.PointValueUSD,
+			ValueUSD:      float64(points) * pricing.PointValueUSD,
+		})
+	}
+	return segments, nil
+}
+
+// 计算指定订阅周期（相对当前周期的偏移）的费用统计，displayCurrency 为空时使用默认显示货币
+// 周期内方案变更时，已用积分按各自生效方案的单积分价值分段计算，订阅费用取周期内最后生效的方案
+func buildSubscriptionCostInfo(periodOffset int, displayCurrency string) (*SubscriptionCostInfo, error) {
+	costs, err := newCostCalculator(displayCurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	// 计算订阅周期
+	periodStart, periodEnd := costs.plans.periodByOffset(periodOffset)
+
+	segments, err := costs.segments(periodStart, periodEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	// 汇总本周期的积分消耗及其美元价值
+	var totalPointsUsed int
+	var usedPointsValueUSD float64
+	for _, s := range segments {
+		totalPointsUsed += s.PointsUsed
+		usedPointsValueUSD += s.ValueUSD
+	}
+
+	// 订阅配额用完后消耗的加购积分按购买价格计价
+	purchases, err := costs.purchaseSummary(periodStart, periodEnd)
+	if err != nil {
+		return nil, err
+	}
+	usedPointsValueUSD += purchases.AdjustmentUSD
+
+	var effectivePointValueUSD float64
+	if totalPointsUsed > 0 {
+		effectivePointValueUSD = usedPointsValueUSD / float64(totalPointsUsed)
+	}
+
+	pricingTime := periodEnd - 1
+	if now := time.Now().UnixMicro(); now < pricingTime {
+		pricingTime = now
+	}
+	plan := costs.plans.at(pricingTime)
+	pricing := costs.pricingAt(pricingTime)
+	periodStartTime := time.UnixMicro(periodStart)
+
+	// 按周期开始时的汇率换算为显示货币
+	display := costs.displayAt(periodStart)
+
+	return &SubscriptionCostInfo{
+		SubscriptionDay:       plan.SubscriptionDay,
+		SubscriptionAmount:    pricing.SubscriptionAmount,
+		SubscriptionCurrency:  pricing.SubscriptionCurrency,
+		SubscriptionAmountUSD: pricing.SubscriptionAmountUSD,
+		PlanID:                plan.ID,
+		Plans:                 segments,
+		PeriodStart:           periodStart,
+		PeriodEnd:             periodEnd,
+		TotalPointsUsed:       totalPointsUsed,
+		TotalAllotment:        pricing.TotalAllotment,
+		AllotmentSource:       pricing.AllotmentSource,
+		PointValueUSD:         pricing.PointValueUSD,
+		UsedPointsValueUSD:    usedPointsValueUSD,
+		RateDate:              pricing.RateDate,
+
+		SubscriptionPointsUsed:   int64(totalPointsUsed) - purchases.PointsUsed,
+		PurchasedPointsUsed:      purchases.PointsUsed,
+		PurchasedPointsValueUSD:  purchases.CostUSD,
+		PurchasedPointsBought:    purchases.PointsBought,
+		PurchasedAmountUSD:       purchases.AmountUSD,
+		PurchasedPointsRemaining: purchases.PointsRemaining,
+		EffectivePointValueUSD:   effectivePointValueUSD,
+		CurrencyRates:            getRatesAt(periodStartTime),
+
+		DisplayCurrency:            display.Currency,
+		DisplayRate:                display.Rate,
+		DisplayRateDate:            display.RateDate,
+		SubscriptionAmountDisplay:  display.FromUSD(pricing.SubscriptionAmountUSD),
+		PointValueDisplay:          display.FromUSD(pricing.PointValueUSD),
+		UsedPointsValueDisplay:     display.FromUSD(usedPointsValueUSD),
+		EffectivePointValueDisplay: display.FromUSD(effectivePointValueUSD),
+	}, nil
+}
+
+// 获取订阅费用统计信息
+func getSubscriptionCostInfo(c *gin.Context) {
+	offset := 0
+	if periodOffset := c.Query("period"); periodOffset != "" {
+		fmt.Sscanf(periodOffset, "%d", &offset)
+	}
+
+	// 校验显示货币
+	if currency := c.Query("currency"); currency != "" {
+		if _, err := normalizeCurrency(currency); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	info, err := buildSubscriptionCostInfo(offset, c.Query("currency"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, info)
+}
+
+// 初次升级时以现有配置建立覆盖全部历史的订阅方案
+func seedSubscriptionPlans() error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM subscription_plans").Scan(&count); err != nil || count > 0 {
+		return err
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM config)").Scan(&exists); err != nil || !exists {
+		return err
+	}
+
+	settings, err := getSubscriptionSettings()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO subscription_plans (effective_from, amount, currency, allotment, subscription_day, note, created_at)
+		VALUES (0, ?, ?, 0, ?, ?, ?)
+	`, settings.Amount, settings.Currency, settings.Day, "migrated from config", time.Now())
+	return err
+}
+
+// 配置中的订阅设置变更时记录新方案（从今天起生效），避免按新价格重算过去的周期
+func recordPlanChange(subscriptionDay int, amount float64, currency string) error {
+	if subscriptionDay <= 0 || subscriptionDay > 31 {
+		subscriptionDay = 1
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM subscription_plans").Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		_, err := db.Exec(`
+			INSERT INTO subscription_plans (effective_from, amount, currency, allotment, subscription_day, created_at)
+			VALUES (0, ?, ?, 0, ?, ?)
+		`, amount, currency, subscriptionDay, time.Now())
+		return err
+	}
+
+	now := time.Now()
+	current := getCurrentPlan()
+	if current.Amount == amount && current.Currency == currency && current.SubscriptionDay == subscriptionDay {
+		return nil
+	}
+
+	// 今天已有生效的方案时直接修改，否则新增一条
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).UnixMicro()
+	_, err := db.Exec(`
+		INSERT INTO subscription_plans (effective_from, amount, currency, allotment, subscription_day, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(effective_from) DO UPDATE SET
+			amount = excluded.amount, currency = excluded.currency, subscription_day = excluded.subscription_day
+	`, today, amount, currency, current.Allotment, subscriptionDay, now)
+	return err
+}
+
+// 将配置中的订阅设置同步为当前生效的方案
+func syncConfigWithCurrentPlan() error {
+	plan := getCurrentPlan()
+	_, err := db.Exec(`
+		UPDATE config SET subscription_day = ?, subscription_amount = ?, subscription_currency = ?, updated_at = ?
+		WHERE id = (SELECT id FROM config ORDER BY id DESC LIMIT 1)
+	`, plan.SubscriptionDay, plan.Amount, plan.Currency, time.Now())
+	return err
+}
+
+// 订阅方案请求体（effective_date 为 YYYY-MM-DD 时优先于 effective_from）
+type planInput struct {
+	SubscriptionPlan
+	EffectiveDate string `json:"effective_date"`
+}
+
+// 校验并规范化订阅方案，生效时间对齐到本地时间当天 0 点
+func validatePlan(input *planInput) error {
+	p := &input.SubscriptionPlan
+	if input.EffectiveDate != "" {
+		effectiveFrom, err := parseTimeParam(input.EffectiveDate)
+		if err != nil {
+			return err
+		}
+		p.EffectiveFrom = effectiveFrom
+	}
+	if p.EffectiveFrom < 0 {
+		return fmt.Errorf("effective_from must not be negative")
+	}
+	if p.EffectiveFrom > 0 {
+		t := time.UnixMicro(p.EffectiveFrom)
+		p.EffectiveFrom = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local).UnixMicro()
+	}
+	if p.Amount < 0 {
+		return fmt.Errorf("amount must not be negative")
+	}
+	if p.Allotment < 0 {
+		return fmt.Errorf("allotment must not be negative")
+	}
+	if p.SubscriptionDay == 0 {
+		p.SubscriptionDay = 1
+	}
+	if p.SubscriptionDay < 1 || p.SubscriptionDay > 31 {
+		return fmt.Errorf("subscription_day must be between 1 and 31")
+	}
+	currency, err := normalizeCurrency(p.Currency)
+	if err != nil {
+		return err
+	}
+	p.Currency = currency
+	return nil
+}
+
+// 判断是否为唯一约束冲突
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// 获取订阅方案列表
+func getPlans(c *gin.Context) {
+	rows, err := db.Query(`
+		SELECT id, effective_from, amount, currency, COALESCE(allotment, 0), subscription_day, COALESCE(note, ''), created_at
+		FROM subscription_plans ORDER BY effective_from DESC, id DESC
+	`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	plans := []SubscriptionPlan{}
+	for rows.Next() {
+		var p SubscriptionPlan
+		if err := rows.Scan(&p.ID, &p.EffectiveFrom, &p.Amount, &p.Currency, &p.Allotment, &p.SubscriptionDay, &p.Note, &p.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		plans = append(plans, p)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"plans":           plans,
+		"current_plan_id": getCurrentPlan().ID,
+	})
+}
+
+// 创建订阅方案
+func createPlan(c *gin.Context) {
+	var input planInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validatePlan(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	p := input.SubscriptionPlan
+	p.CreatedAt = time.Now()
+	result, err := db.Exec(`
+		INSERT INTO subscription_plans (effective_from, amount, currency, allotment, subscription_day, note, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, p.EffectiveFrom, p.Amount, p.Currency, p.Allotment, p.SubscriptionDay, p.Note, p.CreatedAt)
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A plan already takes effect on that day"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	p.ID, _ = result.LastInsertId()
+
+	if err := syncConfigWithCurrentPlan(); err != nil {
+		log.Printf("Failed to sync config with current plan: %v", err)
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// 更新订阅方案
+func updatePlan(c *gin.Context) {
+	var existing SubscriptionPlan
+	err := db.QueryRow(`
+		SELECT id, effective_from, amount, currency, COALESCE(allotment, 0), subscription_day, COALESCE(note, ''), created_at
+		FROM subscription_plans WHERE id = ?
+	`, c.Param("id")).Scan(&existing.ID, &existing.EffectiveFrom, &existing.Amount, &existing.Currency,
+		&existing.Allotment, &existing.SubscriptionDay, &existing.Note, &existing.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 未提供的字段保持原值
+	input := planInput{SubscriptionPlan: existing}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.ID = existing.ID
+	input.CreatedAt = existing.CreatedAt
+	if err := validatePlan(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	p := input.SubscriptionPlan
+	_, err = db.Exec(`
+		UPDATE subscription_plans
+		SET effective_from = ?, amount = ?, currency = ?, allotment = ?, subscription_day = ?, note = ?
+		WHERE id = ?
+	`, p.EffectiveFrom, p.Amount, p.Currency, p.Allotment, p.SubscriptionDay, p.Note, p.ID)
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A plan already takes effect on that day"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := syncConfigWithCurrentPlan(); err != nil {
+		log.Printf("Failed to sync config with current plan: %v", err)
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// 删除订阅方案
+func deletePlan(c *gin.Context) {
+	result, err := db.Exec("DELETE FROM subscription_plans WHERE id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+
+	if err := syncConfigWithCurrentPlan(); err != nil {
+		log.Printf("Failed to sync config with current plan: %v", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "订阅方案已删除"})
+}
+
+// 快照间余额增长超过该值（且未到重置时间）时视为购买了加购积分
+const purchaseDetectionMinPoints = 1000
+
+// 加购积分记录
+type PointPurchase struct {
+	ID          int64     `json:"id"`
+	PurchasedAt int64     `json:"purchased_at"` // 微秒
+	Points      int64     `json:"points"`
+	Amount      float64   `json:"amount"` // 0 表示价格未知，按所在周期的订阅单价计价
+	Currency    string    `json:"currency"`
+	Source      string    `json:"source"` // manual, detected
+	SnapshotID  *int64    `json:"snapshot_id,omitempty"`
+	Note        string    `json:"note"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+const purchaseColumns = `id, purchased_at, points, amount, currency, source, snapshot_id, COALESCE(note, ''), created_at`
+
+func scanPurchase(scanner interface{ Scan(...interface{}) error }) (PointPurchase, error) {
+	var p PointPurchase
+	var snapshotID sql.NullInt64
+	err := scanner.Scan(&p.ID, &p.PurchasedAt, &p.Points, &p.Amount, &p.Currency, &p.Source, &snapshotID, &p.Note, &p.CreatedAt)
+	if snapshotID.Valid {
+		p.SnapshotID = &snapshotID.Int64
+	}
+	return p, err
+}
+
+// 加载全部加购记录（按购买时间升序）
+func loadPurchases() ([]PointPurchase, error) {
+	rows, err := db.Query("SELECT " + purchaseColumns + " FROM point_purchases ORDER BY purchased_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var purchases []PointPurchase
+	for rows.Next() {
+		p, err := scanPurchase(rows)
+		if err != nil {
+			return nil, err
+		}
+		purchases = append(purchases, p)
+	}
+	return purchases, rows.Err()
+}
+
+// 保存余额快照，并与上一次快照比较以识别加购积分
+func recordPointsSnapshot(totalAllotment, currentBalance, nextGrantTime, capturedAt int64) error {
+	var prevBalance, prevNextGrant, prevCapturedAt int64
+	prevErr := db.QueryRow(`
+		SELECT current_balance, COALESCE(next_grant_time, 0), captured_at
+		FROM points_snapshots ORDER BY captured_at DESC, id DESC LIMIT 1
+	`).Scan(&prevBalance, &prevNextGrant, &prevCapturedAt)
+
+	result, err := db.Exec(`
+		INSERT INTO points_snapshots (total_allotment, current_balance, next_grant_time, captured_at)
+		VALUES (?, ?, ?, ?)
+	`, totalAllotment, currentBalance, nextGrantTime, capturedAt)
+	if err != nil {
+		return err
+	}
+	if prevErr != nil || prevNextGrant != nextGrantTime {
+		// 没有上一次快照，或期间发生了每月重置
+		return nil
+	}
+
+	// 余额应为上次余额减去期间消耗，超出部分即为加购积分
+	usedBetween, err := sumPointsBetween(prevCapturedAt, capturedAt, localAccount)
+	if err != nil {
+		return err
+	}
+
+	jump := currentBalance - (prevBalance - usedBetween)
+	if jump < purchaseDetectionMinPoints {
+		return nil
+	}
+
+	snapshotID, _ := result.LastInsertId()
+	if _, err := db.Exec(`
+		INSERT INTO point_purchases (purchased_at, points, amount, currency, source, snapshot_id, note, created_at)
+		VALUES (?, ?, 0, 'USD', 'detected', ?, ?, ?)
+	`, capturedAt, jump, snapshotID, "detected from balance jump", time.Now()); err != nil {
+		return err
+	}
+	log.Printf("Detected point purchase of %d points", jump)
+	return nil
+}
+
+// 加购积分批次（先购先用）
+type purchaseLot struct {
+	PurchasedAt int64
+	Points      int64
+	Remaining   int64
+	PointUSD    float64 // 0 表示价格未知
+}
+
+// 超出订阅配额、由加购积分支付的记录
+type ledgerEntry struct {
+	RecordID        string
+	BotName         string
+	CreationTime    int64
+	PeriodStart     int64
+	PurchasedPoints int64
+	CostUSD         float64 // 加购积分的实际费用
+	AdjustmentUSD   float64 // 相对按订阅单价计价的差额
+}
+
+// 积分消耗账本：每个周期先消耗订阅配额，超出部分按购买顺序消耗加购积分，加购积分跨周期结转
+type purchaseLedger struct {
+	lots     []purchaseLot
+	entries  []ledgerEntry
+	byRecord map[string]int
+}
+
+// 构建积分消耗账本（没有加购记录时返回空账本）
+func (cc *costCalculator) ledger() (*purchaseLedger, error) {
+	if cc.purchases != nil {
+		return cc.purchases, nil
+	}
+
+	ledger := &purchaseLedger{byRecord: make(map[string]int)}
+	purchases, err := loadPurchases()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range purchases {
+		lot := purchaseLot{PurchasedAt: p.PurchasedAt, Points: p.Points, Remaining: p.Points}
+		if p.Amount > 0 && p.Points > 0 {
+			lot.PointUSD = convertToUSDAt(p.Amount, p.Currency, time.UnixMicro(p.PurchasedAt)) / float64(p.Points)
+		}
+		ledger.lots = append(ledger.lots, lot)
+	}
+	if len(ledger.lots) == 0 {
+		cc.purchases = ledger
+		return ledger, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT id, bot_name, point_cost, creation_time FROM points_history
+		WHERE creation_time >= ? AND `+accountFilter+`
+		ORDER BY creation_time, id
+	`, ledger.lots[0].PurchasedAt, localAccount)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var currentPeriod int64 = -1
+	var usedInPeriod int64
+	for rows.Next() {
+		var id, botName string
+		var points, creationTime int64
+		if err := rows.Scan(&id, &botName, &points, &creationTime); err != nil {
+			return nil, err
+		}
+
+		pricing := cc.pricingAt(creationTime)
+		if pricing.PeriodStart != currentPeriod {
+			currentPeriod = pricing.PeriodStart
+			// 从周期开始累计，包含首个加购之前的消耗
+			if usedInPeriod, err = sumPointsBetween(pricing.PeriodStart, creationTime, localAccount); err != nil {
+				return nil, err
+			}
+		}
+
+		overflow := usedInPeriod + points - pricing.TotalAllotment
+		if overflow > points {
+			overflow = points
+		}
+		usedInPeriod += points
+		if overflow <= 0 {
+			continue
+		}
+
+		entry := ledgerEntry{RecordID: id, BotName: botName, CreationTime: creationTime, PeriodStart: pricing.PeriodStart}
+		for i := range ledger.lots {
+			lot := &ledger.lots[i]
+			if overflow == 0 || lot.PurchasedAt > creationTime {
+				break
+			}
+			if lot.Remaining == 0 {
+				continue
+			}
+			take := overflow
+			if lot.Remaining < take {
+				take = lot.Remaining
+			}
+			lot.Remaining -= take
+			overflow -= take
+
+			lotUSD := lot.PointUSD
+			if lotUSD == 0 {
+				lotUSD = pricing.PointValueUSD
+			}
+			entry.PurchasedPoints += take
+			entry.CostUSD += float64(take) * lotUSD
+			entry.AdjustmentUSD += float64(take) * (lotUSD - pricing.PointValueUSD)
+		}
+		if entry.PurchasedPoints > 0 {
+			ledger.byRecord[id] = len(ledger.entries)
+			ledger.entries = append(ledger.entries, entry)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	cc.purchases = ledger
+	return ledger, nil
+}
+
+// 计算单条记录的费用，超出订阅配额的部分按加购积分计价
+func (cc *costCalculator) recordCost(recordID string, timestamp int64, points int) (float64, float64) {
+	costUSD, _ := cc.cost(timestamp, points)
+	if ledger, err := cc.ledger(); err == nil {
+		if i, ok := ledger.byRecord[recordID]; ok {
+			costUSD += ledger.entries[i].AdjustmentUSD
+		}
+	} else {
+		log.Printf("Failed to build purchase ledger: %v", err)
+	}
+	periodStart, _ := cc.plans.periodAt(timestamp)
+	return costUSD, cc.displayAt(periodStart).FromUSD(costUSD)
+}
+
+// 汇总区间内各机器人由加购积分带来的费用差额（美元、显示货币）
+func (cc *costCalculator) purchaseAdjustmentsByBot(start, end int64) (map[string][2]float64, error) {
+	ledger, err := cc.ledger()
+	if err != nil {
+		return nil, err
+	}
+	adjustments := make(map[string][2]float64)
+	for _, e := range ledger.entries {
+		if (start != 0 || end != 0) && (e.CreationTime < start || e.CreationTime >= end) {
+			continue
+		}
+		a := adjustments[e.BotName]
+		a[0] += e.AdjustmentUSD
+		a[1] += cc.displayAt(e.PeriodStart).FromUSD(e.AdjustmentUSD)
+		adjustments[e.BotName] = a
+	}
+	return adjustments, nil
+}
+
+// 区间内的加购积分收支
+type PurchaseSummary struct {
+	PointsUsed      int64
+	CostUSD         float64
+	AdjustmentUSD   float64
+	PointsBought    int64
+	AmountUSD       float64
+	PointsRemaining int64 // 截至区间结束时剩余的加购积分
+}
+
+// 汇总区间内消耗和购买的加购积分
+func (cc *costCalculator) purchaseSummary(start, end int64) (PurchaseSummary, error) {
+	var summary PurchaseSummary
+	ledger, err := cc.ledger()
+	if err != nil {
+		return summary, err
+	}
+
+	var consumedBeforeEnd int64
+	for _, e := range ledger.entries {
+		if e.CreationTime < end {
+			consumedBeforeEnd += e.PurchasedPoints
+		}
+		if e.CreationTime >= start && e.CreationTime < end {
+			summary.PointsUsed += e.PurchasedPoints
+			summary.CostUSD += e.CostUSD
+			summary.AdjustmentUSD += e.AdjustmentUSD
+		}
+	}
+
+	var boughtBeforeEnd int64
+	for _, lot := range ledger.lots {
+		if lot.PurchasedAt >= end {
+			continue
+		}
+		boughtBeforeEnd += lot.Points
+		if lot.PurchasedAt >= start {
+			summary.PointsBought += lot.Points
+			summary.AmountUSD += float64(lot.Points) * lot.PointUSD
+		}
+	}
+	summary.PointsRemaining = boughtBeforeEnd - consumedBeforeEnd
+	return summary, nil
+}
+
+// 加购记录请求体（purchase_date 为 YYYY-MM-DD 时优先于 purchased_at）
+type purchaseInput struct {
+	PointPurchase
+	PurchaseDate string `json:"purchase_date"`
+}
+
+// 校验并规范化加购记录
+func validatePurchase(input *purchaseInput) error {
+	p := &input.PointPurchase
+	if input.PurchaseDate != "" {
+		purchasedAt, err := parseTimeParam(input.PurchaseDate)
+		if err != nil {
+			return err
+		}
+		p.PurchasedAt = purchasedAt
+	}
+	if p.PurchasedAt <= 0 {
+		return fmt.Errorf("purchased_at or purchase_date is required")
+	}
+	if p.Points <= 0 {
+		return fmt.Errorf("points must be positive")
+	}
+	if p.Amount < 0 {
+		return fmt.Errorf("amount must not be negative")
+	}
+	currency, err := normalizeCurrency(p.Currency)
+	if err != nil {
+		return err
+	}
+	p.Currency = currency
+	return nil
+}
+
+// 获取加购记录
+func getPurchases(c *gin.Context) {
+	purchases, err := loadPurchases()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if purchases == nil {
+		purchases = []PointPurchase{}
+	}
+	c.JSON(http.StatusOK, purchases)
+}
+
+// 手动录入加购记录
+func createPurchase(c *gin.Context) {
+	var input purchaseInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validatePurchase(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	p := input.PointPurchase
+	p.Source = "manual"
+	p.SnapshotID = nil
+	p.CreatedAt = time.Now()
+	result, err := db.Exec(`
+		INSERT INTO point_purchases (purchased_at, points, amount, currency, source, note, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, p.PurchasedAt, p.Points, p.Amount, p.Currency, p.Source, p.Note, p.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	p.ID, _ = result.LastInsertId()
+
+	c.JSON(http.StatusOK, p)
+}
+
+// 更新加购记录（如为自动识别的记录补充价格）
+func updatePurchase(c *gin.Context) {
+	existing, err := scanPurchase(db.QueryRow("SELECT "+purchaseColumns+" FROM point_purchases WHERE id = ?", c.Param("id")))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Purchase not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 未提供的字段保持原值
+	input := purchaseInput{PointPurchase: existing}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.ID = existing.ID
+	input.Source = existing.Source
+	input.SnapshotID = existing.SnapshotID
+	input.CreatedAt = existing.CreatedAt
+	if err := validatePurchase(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	p := input.PointPurchase
+	_, err = db.Exec(`
+		UPDATE point_purchases SET purchased_at = ?, points = ?, amount = ?, currency = ?, note = ?
+		WHERE id = ?
+	`, p.PurchasedAt, p.Points, p.Amount, p.Currency, p.Note, p.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, p)
+}
+
+// 删除加购记录
+func deletePurchase(c *gin.Context) {
+	result, err := db.Exec("DELETE FROM point_purchases WHERE id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Purchase not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "加购记录已删除"})
+}
+
+// 单个机器人在一个订阅周期内的费用分摊
+type BotCostShare struct {
+	BotName string  `json:"bot_name"`
+	Points  int     `json:"points"`
+	Count   int     `json:"count"`
+	Share   float64 `json:"share"` // 占本周期已用积分的比例（0~1）
+	CostUSD float64 `json:"cost_usd"`
+	Cost    float64 `json:"cost"`
+}
+
+// 一个订阅周期的机器人费用分摊
+type CycleBotCosts struct {
+	PeriodStart           int64          `json:"period_start"`
+	PeriodEnd             int64          `json:"period_end"`
+	Label                 string         `json:"label"`
+	SubscriptionAmountUSD float64        `json:"subscription_amount_usd"`
+	TotalAllotment        int64          `json:"total_allotment"`
+	AllotmentSource       string         `json:"allotment_source"`
+	PointValueUSD         float64        `json:"point_value_usd"`
+	DisplayRate           float64        `json:"display_rate"`
+	TotalPoints           int            `json:"total_points"`
+	TotalCostUSD          float64        `json:"total_cost_usd"`
+	TotalCost             float64        `json:"total_cost"`
+	UnusedCostUSD         float64        `json:"unused_cost_usd"` // 未用完的积分对应的订阅费用
+	UnusedCost            float64        `json:"unused_cost"`
+	Bots                  []BotCostShare `json:"bots"`
+}
+
+// 按订阅周期统计各机器人的费用分摊（用于向内部项目分摊成本）
+// 参数 period 为最近一个周期的偏移（默认 0），cycles 为向前统计的周期数（默认 1，最多 24）
+func getCostByBot(c *gin.Context) {
+	offset := 0
+	if v := c.Query("period"); v != "" {
+		fmt.Sscanf(v, "%d", &offset)
+	}
+	cycles := 1
+	if v := c.Query("cycles"); v != "" {
+		fmt.Sscanf(v, "%d", &cycles)
+	}
+	if cycles < 1 || cycles > 24 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cycles must be between 1 and 24"})
+		return
+	}
+
+	costs, err := newCostCalculator(c.Query("currency"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result := make([]CycleBotCosts, 0, cycles)
+	for i := 0; i < cycles; i++ {
+		periodStart, periodEnd := costs.plans.periodByOffset(offset - i)
+		display := costs.displayAt(periodStart)
+
+		// 周期内以最后生效的方案作为订阅费用
+		pricingTime := periodEnd - 1
+		if now := time.Now().UnixMicro(); now < pricingTime {
+			pricingTime = now
+		}
+		pricing := costs.pricingAt(pricingTime)
+
+		// 方案按天生效，按天汇总后用各自生效方案的单积分价值计算费用
+		rows, err := db.Query(`
+			SELECT bot_name, date(creation_time / 1000000, 'unixepoch', 'localtime') as day,
+			       SUM(point_cost) as points, COUNT(*) as count
+			FROM points_history
+			WHERE creation_time >= ? AND creation_time < ? AND `+accountFilter+`
+			GROUP BY bot_name, day
+		`, periodStart, periodEnd, localAccount)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		cycle := CycleBotCosts{
+			PeriodStart:           periodStart,
+			PeriodEnd:             periodEnd,
+			Label:                 formatPeriodLabel(periodStart, periodEnd),
+			SubscriptionAmountUSD: pricing.SubscriptionAmountUSD,
+			TotalAllotment:        pricing.TotalAllotment,
+			AllotmentSource:       pricing.AllotmentSource,
+			PointValueUSD:         pricing.PointValueUSD,
+			DisplayRate:           display.Rate,
+			Bots:                  []BotCostShare{},
+		}
+		byBot := make(map[string]*BotCostShare)
+		for rows.Next() {
+			var botName, day string
+			var points, count int
+			if err := rows.Scan(&botName, &day, &points, &count); err != nil {
+				rows.Close()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			dayStart, err := time.ParseInLocation("2006-01-02", day, time.Local)
+			if err != nil {
+				rows.Close()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			dayTime := dayStart.UnixMicro()
+			if dayTime < periodStart {
+				dayTime = periodStart
+			}
+
+			share, ok := byBot[botName]
+			if !ok {
+				share = &BotCostShare{BotName: botName}
+				byBot[botName] = share
+			}
+			costUSD, _ := costs.cost(dayTime, points)
+			share.Points += points
+			share.Count += count
+			share.CostUSD += costUSD
+			cycle.TotalPoints += points
+			cycle.TotalCostUSD += costUSD
+		}
+		rows.Close()
+
+		// 未用完的订阅费用按订阅单价计算
+		if unused := pricing.SubscriptionAmountUSD - cycle.TotalCostUSD; unused > 0 {
+			cycle.UnusedCostUSD = unused
+			cycle.UnusedCost = display.FromUSD(unused)
+		}
+
+		// 超出订阅配额的部分按加购积分的价格计价
+		adjustments, err := costs.purchaseAdjustmentsByBot(periodStart, periodEnd)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for botName, a := range adjustments {
+			if share, ok := byBot[botName]; ok {
+				share.CostUSD += a[0]
+				cycle.TotalCostUSD += a[0]
+			}
+		}
+
+		for _, share := range byBot {
+			if cycle.TotalPoints > 0 {
+				share.Share = float64(share.Points) / float64(cycle.TotalPoints)
+			}
+			share.Cost = display.FromUSD(share.CostUSD)
+			cycle.Bots = append(cycle.Bots, *share)
+		}
+		sort.Slice(cycle.Bots, func(x, y int) bool {
+			if cycle.Bots[x].Points != cycle.Bots[y].Points {
+				return cycle.Bots[x].Points > cycle.Bots[y].Points
+			}
+			return cycle.Bots[x].BotName < cycle.Bots[y].BotName
+		})
+		cycle.TotalCost = display.FromUSD(cycle.TotalCostUSD)
+
+		result = append(result, cycle)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"display_currency": costs.currency,
+		"cycles":           result,
+	})
+}
+
+// 对比区间
+type CompareRange struct {
+	Label        string `json:"label"`
+	PeriodStart  int64  `json:"period_start"`
+	PeriodEnd    int64  `json:"period_end"`
+	Days         int    `json:"days"`
+	TotalPoints  int    `json:"total_points"`
+	MessageCount int    `json:"message_count"`
+}
+
+// 单个机器人的周期对比
+type BotCompare struct {
+	BotName      string   `json:"bot_name"`
+	APoints      int      `json:"a_points"`
+	BPoints      int      `json:"b_points"`
+	ACount       int      `json:"a_count"`
+	BCount       int      `json:"b_count"`
+	PointsDelta  int      `json:"points_delta"`
+	PointsChange *float64 `json:"points_change_pct"`
+}
+
+// 按天对齐的累积曲线点（第 N 天）
+type CompareCurvePoint struct {
+	Day         int  `json:"day"`
+	ACumulative *int `json:"a_cumulative"`
+	BCumulative *int `json:"b_cumulative"`
+}
+
+const microsPerDay = 24 * 60 * 60 * 1000000
+
+// 解析对比区间参数：period:<偏移量> 或 range:<开始>,<结束>
+// 开始/结束可以是 YYYY-MM-DD（本地时间，结束不含当天）或微秒时间戳
+func parseCompareRange(spec string, plans planSchedule) (int64, int64, string, error) {
+	kind, value, found := strings.Cut(spec, ":")
+	if !found {
+		return 0, 0, "", fmt.Errorf("invalid range %q, expected period:<offset> or range:<start>,<end>", spec)
+	}
+
+	switch kind {
+	case "period":
+		var offset int
+		if _, err := fmt.Sscanf(value, "%d", &offset); err != nil {
+			return 0, 0, "", fmt.Errorf("invalid period offset %q", value)
+		}
+		start, end := plans.periodByOffset(offset)
+		return start, end, formatPeriodLabel(start, end), nil
+	case "range":
+		startStr, endStr, found := strings.Cut(value, ",")
+		if !found {
+			return 0, 0, "", fmt.Errorf("invalid range %q, expected range:<start>,<end>", value)
+		}
+		start, err := parseTimeParam(startStr)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		end, err := parseTimeParam(endStr)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		if end <= start {
+			return 0, 0, "", fmt.Errorf("range end must be after start")
+		}
+		return start, end, formatPeriodLabel(start, end), nil
+	default:
+		return 0, 0, "", fmt.Errorf("unknown range type %q", kind)
+	}
+}
+
+// 解析时间参数：YYYY-MM-DD（本地时间）或微秒时间戳
+func parseTimeParam(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t.UnixMicro(), nil
+	}
+	var micros int64
+	if _, err := fmt.Sscanf(value, "%d", &micros); err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected YYYY-MM-DD or microseconds", value)
+	}
+	return micros, nil
+}
+
+// 格式化周期标签（如 01.15 - 02.15）
+func formatPeriodLabel(periodStart, periodEnd int64) string {
+	startTime := time.UnixMicro(periodStart)
+	endTime := time.UnixMicro(periodEnd)
+	return fmt.Sprintf("%02d.%02d - %02d.%02d",
+		startTime.Month(), startTime.Day(),
+		endTime.Month(), endTime.Day())
+}
+
+// 计算百分比变化，基准为 0 时返回 nil
+func percentChange(from, to int) *float64 {
+	if from == 0 {
+		return nil
+	}
+	pct := float64(to-from) / float64(from) * 100
+	return &pct
+}
+
+// 查询区间内每天（相对区间开始）的积分消耗
+func queryDailyPoints(periodStart, periodEnd int64, account string) (map[int]int, error) {
+	rows, err := db.Query(`
+		SELECT (creation_time - ?) / ? as day_index, SUM(point_cost)
+		FROM points_history
+		WHERE creation_time >= ? AND creation_time < ? AND `+accountFilter+`
+		GROUP BY day_index
+	`, periodStart, microsPerDay, periodStart, periodEnd, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	daily := make(map[int]int)
+	for rows.Next() {
+		var day, points int
+		if err := rows.Scan(&day, &points); err != nil {
+			return nil, err
+		}
+		daily[day] = points
+	}
+	return daily, rows.Err()
+}
+
+// 构建按天累积曲线，区间未开始的天（未来）为 nil
+func buildCumulativeCurve(periodStart, periodEnd int64, days int, account string) ([]*int, error) {
+	daily, err := queryDailyPoints(periodStart, periodEnd, account)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMicro()
+	curve := make([]*int, days)
+	cumulative := 0
+	for i := 0; i < days; i++ {
+		if periodStart+int64(i)*microsPerDay > now {
+			break
+		}
+		cumulative += daily[i]
+		value := cumulative
+		curve[i] = &value
+	}
+	return curve, nil
+}
+
+// 周期对比
+func comparePeriods(c *gin.Context) {
+	account := requestAccount(c)
+	plans, err := loadPlanSchedule()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	aStart, aEnd, aLabel, err := parseCompareRange(c.DefaultQuery("a", "period:-1"), plans)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	bStart, bEnd, bLabel, err := parseCompareRange(c.DefaultQuery("b", "period:0"), plans)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	a := CompareRange{Label: aLabel, PeriodStart: aStart, PeriodEnd: aEnd}
+	b := CompareRange{Label: bLabel, PeriodStart: bStart, PeriodEnd: bEnd}
+	bots := map[string]*BotCompare{}
+	var botOrder []string
+
+	for i, r := range []*CompareRange{&a, &b} {
+		r.Days = int((r.PeriodEnd - r.PeriodStart + microsPerDay - 1) / microsPerDay)
+
+		rows, err := db.Query(`
+			SELECT bot_name, SUM(point_cost), COUNT(*)
+			FROM points_history
+			WHERE creation_time >= ? AND creation_time < ? AND `+accountFilter+`
+			GROUP BY bot_name
+			ORDER BY SUM(point_cost) DESC
+		`, r.PeriodStart, r.PeriodEnd, account)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		for rows.Next() {
+			var botName string
+			var points, count int
+			if err := rows.Scan(&botName, &points, &count); err != nil {
+				rows.Close()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			r.TotalPoints += points
+			r.MessageCount += count
+
+			bot, ok := bots[botName]
+			if !ok {
+				bot = &BotCompare{BotName: botName}
+				bots[botName] = bot
+				botOrder = append(botOrder, botName)
+			}
+			if i == 0 {
+				bot.APoints, bot.ACount = points, count
+			} else {
+				bot.BPoints, bot.BCount = points, count
+			}
+		}
+		rows.Close()
+	}
+
+	botStats := make([]BotCompare, 0, len(botOrder))
+	for _, name := range botOrder {
+		bot := bots[name]
+		bot.PointsDelta = bot.BPoints - bot.APoints
+		bot.PointsChange = percentChange(bot.APoints, bot.BPoints)
+		botStats = append(botStats, *bot)
+	}
+
+	// 按天对齐的累积曲线（A 的第 N 天 vs B 的第 N 天）
+	days := a.Days
+	if b.Days > days {
+		days = b.Days
+	}
+	aCurve, err := buildCumulativeCurve(a.PeriodStart, a.PeriodEnd, a.Days, account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	bCurve, err := buildCumulativeCurve(b.PeriodStart, b.PeriodEnd, b.Days, account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	curve := make([]CompareCurvePoint, days)
+	for i := 0; i < days; i++ {
+		curve[i].Day = i + 1
+		if i < len(aCurve) {
+			curve[i].ACumulative = aCurve[i]
+		}
+		if i < len(bCurve) {
+			curve[i].BCumulative = bCurve[i]
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"a":    a,
+		"b":    b,
+		"bots": botStats,
+		"delta": gin.H{
+			"total_points":             b.TotalPoints - a.TotalPoints,
+			"message_count":            b.MessageCount - a.MessageCount,
+			"total_points_change_pct":  percentChange(a.TotalPoints, b.TotalPoints),
+			"message_count_change_pct": percentChange(a.MessageCount, b.MessageCount),
+		},
+		"curve": curve,
+	})
+}
+
+// 预测曲线点（按天）
+type ForecastPoint struct {
+	Date     string `json:"date"`
+	Expected int    `json:"expected_cumulative"`
+	Low      int    `json:"low_cumulative"`
+	High     int    `json:"high_cumulative"`
+}
+
+// 预测的耗尽时间（微秒时间戳，周期内不会耗尽时为 nil）
+type RunOutTimes struct {
+	Expected *int64 `json:"expected"`
+	Earliest *int64 `json:"earliest"`
+	Latest   *int64 `json:"latest"`
+}
+
+// 90% 置信区间对应的 z 值
+const forecastZ = 1.645
+
+// 回看窗口天数的范围，默认 28 天
+const (
+	forecastDefaultLookbackDays = 28
+	forecastMinLookbackDays     = 7
+	forecastMaxLookbackDays     = 365
+)
+
+// 获取最新余额快照，并扣除快照之后的消耗得到当前估算余额，没有快照时 ok 为 false；
+// 快照早于本周期开始（周期已重置）时改用本周期配额减去本周期消耗
+func getEstimatedBalance() (balance int64, ok bool, err error) {
+	var capturedAt int64
+	err = db.QueryRow(`
+		SELECT current_balance, captured_at
+		FROM points_snapshots ORDER BY captured_at DESC LIMIT 1
+	`).Scan(&balance, &capturedAt)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	periodStart, _ := getPlanPeriodByOffset(0)
+	if capturedAt < periodStart {
+		balance, _ = getAllotmentForPeriod(periodStart, getCurrentPlan().Allotment)
+		capturedAt = periodStart
+	}
+
+	usedSince, err := sumPointsBetween(capturedAt, math.MaxInt64, localAccount)
+	if err != nil {
+		return 0, false, err
+	}
+	return balance - usedSince, true, nil
+}
+
+// 账户在 [start, end) 内消耗的积分
+func sumPointsBetween(start, end int64, account string) (int64, error) {
+	var total int64
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(point_cost), 0) FROM points_history
+		WHERE creation_time >= ? AND creation_time < ? AND `+accountFilter+`
+	`, start, end, account).Scan(&total)
+	return total, err
+}
+
+// 计算星期×小时的消耗率（每小时平均积分）以及日消耗残差标准差
+func buildSeasonalProfile(windowStart, windowEnd int64, account string) (profile [7][24]float64, dailyStdDev float64, err error) {
+	rows, err := db.Query(`
+		SELECT creation_time, point_cost FROM points_history
+		WHERE creation_time >= ? AND creation_time < ? AND `+accountFilter+`
+	`, windowStart, windowEnd, account)
+	if err != nil {
+		return profile, 0, err
+	}
+	defer rows.Close()
+
+	var sums [7][24]float64
+	dailyTotals := map[string]float64{}
+	for rows.Next() {
+		var creationTime int64
+		var pointCost int
+		if err := rows.Scan(&creationTime, &pointCost); err != nil {
+			return profile, 0, err
+		}
+		t := time.UnixMicro(creationTime)
+		sums[t.Weekday()][t.Hour()] += float64(pointCost)
+		dailyTotals[t.Format("2006-01-02")] += float64(pointCost)
+	}
+	if err := rows.Err(); err != nil {
+		return profile, 0, err
+	}
+
+	// 统计窗口内每个星期×小时槽位出现的次数
+	var occurrences [7][24]int
+	for t := time.UnixMicro(windowStart).Truncate(time.Hour); t.UnixMicro() < windowEnd; t = t.Add(time.Hour) {
+		occurrences[t.Weekday()][t.Hour()]++
+	}
+	for wd := 0; wd < 7; wd++ {
+		for h := 0; h < 24; h++ {
+			if occurrences[wd][h] > 0 {
+				profile[wd][h] = sums[wd][h] / float64(occurrences[wd][h])
+			}
+		}
+	}
+
+	// 日残差：实际日消耗 - 季节性模型预期日消耗
+	var squares float64
+	days := 0
+	for day := time.UnixMicro(windowStart); day.UnixMicro() < windowEnd; day = day.AddDate(0, 0, 1) {
+		var expected float64
+		for h := 0; h < 24; h++ {
+			expected += profile[day.Weekday()][h]
+		}
+		diff := dailyTotals[day.Format("2006-01-02")] - expected
+		squares += diff * diff
+		days++
+	}
+	if days > 1 {
+		dailyStdDev = math.Sqrt(squares / float64(days-1))
+	}
+
+	return profile, dailyStdDev, nil
+}
+
+// 近期趋势系数：最近 7 天消耗 / 整个窗口的日均消耗，限制在 [0.5, 2]
+func computeTrendFactor(windowStart, windowEnd int64, account string) (float64, error) {
+	recentStart := windowEnd - 7*microsPerDay
+	if recentStart < windowStart {
+		return 1, nil
+	}
+
+	windowTotal, err := sumPointsBetween(windowStart, windowEnd, account)
+	if err != nil {
+		return 0, err
+	}
+	recentTotal, err := sumPointsBetween(recentStart, windowEnd, account)
+	if err != nil {
+		return 0, err
+	}
+
+	windowDays := float64(windowEnd-windowStart) / microsPerDay
+	if windowTotal <= 0 || windowDays <= 0 {
+		return 1, nil
+	}
+
+	factor := (float64(recentTotal) / 7) / (float64(windowTotal) / windowDays)
+	return math.Max(0.5, math.Min(2, factor)), nil
+}
+
+// 周期末消耗预测
+func getForecast(c *gin.Context) {
+	lookbackDays := forecastDefaultLookbackDays
+	if v := c.Query("lookback_days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid lookback_days"})
+			return
+		}
+		lookbackDays = max(forecastMinLookbackDays, min(forecastMaxLookbackDays, days))
+	}
+
+	account := requestAccount(c)
+	now := time.Now()
+	nowMicros := now.UnixMicro()
+	periodStart, periodEnd := getPlanPeriodByOffset(0)
+
+	windowStart := now.AddDate(0, 0, -lookbackDays).UnixMicro()
+	profile, dailyStdDev, err := buildSeasonalProfile(windowStart, nowMicros, account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	trendFactor, err := computeTrendFactor(windowStart, nowMicros, account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	used, err := sumPointsBetween(periodStart, nowMicros, account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	usedInCycle := int(used)
+
+	// 当前余额：优先使用请求参数，否则使用最新快照推算（快照只有本机账户）
+	var balance int64
+	hasBalance := false
+	if v := c.Query("balance"); v != "" {
+		if _, err := fmt.Sscanf(v, "%d", &balance); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid balance"})
+			return
+		}
+		hasBalance = true
+	} else if account == localAccount {
+		balance, hasBalance, err = getEstimatedBalance()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// 按小时向前推演到周期结束
+	hourlyVariance := dailyStdDev * dailyStdDev / 24
+	var expected float64
+	var runOut RunOutTimes
+	var curve []ForecastPoint
+	hours := 0
+	for t := now.Truncate(time.Hour).Add(time.Hour); t.UnixMicro() <= periodEnd; t = t.Add(time.Hour) {
+		expected += profile[t.Weekday()][t.Hour()] * trendFactor
+		hours++
+		band := forecastZ * math.Sqrt(hourlyVariance*float64(hours))
+		low := math.Max(0, expected-band)
+		high := expected + band
+
+		if hasBalance {
+			ts := t.UnixMicro()
+			if runOut.Earliest == nil && high >= float64(balance) {
+				runOut.Earliest = &ts
+			}
+			if runOut.Expected == nil && expected >= float64(balance) {
+				runOut.Expected = &ts
+			}
+			if runOut.Latest == nil && low >= float64(balance) {
+				runOut.Latest = &ts
+			}
+		}
+
+		if t.Hour() == 0 || t.UnixMicro()+int64(time.Hour/time.Microsecond) > periodEnd {
+			curve = append(curve, ForecastPoint{
+				Date:     t.Add(-time.Minute).Format("2006-01-02"),
+				Expected: usedInCycle + int(expected),
+				Low:      usedInCycle + int(low),
+				High:     usedInCycle + int(high),
+			})
+		}
+	}
+
+	if curve == nil {
+		curve = []ForecastPoint{}
+	}
+
+	band := forecastZ * math.Sqrt(hourlyVariance*float64(hours))
+	result := gin.H{
+		"period_start":          periodStart,
+		"period_end":            periodEnd,
+		"lookback_days":         lookbackDays,
+		"trend_factor":          trendFactor,
+		"used_in_cycle":         usedInCycle,
+		"projected_remaining":   int(expected),
+		"projected_total":       usedInCycle + int(expected),
+		"projected_total_low":   usedInCycle + int(math.Max(0, expected-band)),
+		"projected_total_high":  usedInCycle + int(expected+band),
+		"confidence":            0.9,
+		"curve":                 curve,
+		"current_balance":       nil,
+		"projected_end_balance": nil,
+		"will_run_out":          false,
+		"run_out_time":          runOut,
+	}
+	if hasBalance {
+		result["current_balance"] = balance
+		result["projected_end_balance"] = balance - int64(expected)
+		result["will_run_out"] = runOut.Expected != nil
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 异常消耗记录
+type PointAnomaly struct {
+	RecordID       string  `json:"record_id"`
+	BotName        string  `json:"bot_name"`
+	PointCost      int     `json:"point_cost"`
+	CreationTime   int64   `json:"creation_time"`
+	BaselineMedian float64 `json:"baseline_median"`
+	BaselineMAD    float64 `json:"baseline_mad"`
+	Score          float64 `json:"score"`
+	Severity       string  `json:"severity"`
+	DetectedAt     int64   `json:"detected_at"`
+}
+
+const (
+	anomalyWindowSize  = 200 // 每个机器人滚动基线的记录数
+	anomalyMinSamples  = 20  // 基线最少样本数
+	anomalyThreshold   = 3.5 // 稳健 z 分数阈值
+	anomalyStateKey    = "anomaly_rowid_watermark"
+	anomalyLegacyKey   = "anomaly_watermark" // 旧版按 creation_time 记录的水位线
+	anomalyScanPeriod  = 10 * time.Minute
+	madConsistencyRate = 1.4826 // MAD 转换为标准差估计的系数
+)
+
+var anomalyMu sync.Mutex
+
+// 读取应用状态值
+func getAppState(key string) (string, bool) {
+	var value string
+	if err := db.QueryRow("SELECT value FROM app_state WHERE key = ?", key).Scan(&value); err != nil {
+		return "", false
+	}
+	return value, true
+}
+
+// 同步中断时保存的续传游标（JSON 数组），每个游标指向一段尚未拉取的旧记录
+const resumeCursorsKey = "sync_resume_cursors"
+
+// 续传游标连续多次没有进展或保存过久都会被丢弃，避免每次同步都请求一个失效的游标
+const (
+	resumeCursorMaxAttempts = 5
+	resumeCursorMaxAge      = 7 * 24 * time.Hour
+)
+
+type resumeCursor struct {
+	Cursor   string `json:"cursor"`
+	Attempts int    `json:"attempts"` // 从该游标续传但返回空页的次数，请求失败不计
+	SavedAt  int64  `json:"saved_at"` // 最近一次推进的时间（Unix 秒）
+}
+
+// 读取续传游标，丢弃超过重试次数或过期的游标
+func loadResumeCursors() []resumeCursor {
+	value, ok := getAppState(resumeCursorsKey)
+	if !ok || value == "" {
+		return nil
+	}
+	var cursors []resumeCursor
+	if err := json.Unmarshal([]byte(value), &cursors); err != nil {
+		// 兼容旧版本保存的字符串数组
+		var legacy []string
+		if json.Unmarshal([]byte(value), &legacy) != nil {
+			log.Printf("Ignoring invalid resume cursors: %v", err)
+			return nil
+		}
+		for _, cursor := range legacy {
+			cursors = append(cursors, resumeCursor{Cursor: cursor, SavedAt: time.Now().Unix()})
+		}
+	}
+
+	kept := cursors[:0]
+	for _, rc := range cursors {
+		age := time.Since(time.Unix(rc.SavedAt, 0))
+		if rc.Attempts >= resumeCursorMaxAttempts || age > resumeCursorMaxAge {
+			// 游标之后的旧记录不会再补齐，需要告知用户
+			message := fmt.Sprintf("Dropped resume cursor after %d empty pages (saved %s ago), older records behind it will not be fetched",
+				rc.Attempts, age.Round(time.Minute))
+			log.Print(message)
+			notifyEvent(eventResumeDropped, message, rc)
+			continue
+		}
+		kept = append(kept, rc)
+	}
+	if len(kept) != len(cursors) {
+		if err := saveResumeCursors(kept); err != nil {
+			log.Printf("Failed to save resume cursor: %v", err)
+		}
+	}
+	return kept
+}
+
+func saveResumeCursors(cursors []resumeCursor) error {
+	if len(cursors) == 0 {
+		_, err := db.Exec("DELETE FROM app_state WHERE key = ?", resumeCursorsKey)
+		return err
+	}
+	data, err := json.Marshal(cursors)
+	if err != nil {
+		return err
+	}
+	return setAppState(resumeCursorsKey, string(data))
+}
+
+// 记录同步进度：续传中更新当前游标，否则追加新的续传游标
+func saveSyncProgress(pending []resumeCursor, resuming bool, cursor string) []resumeCursor {
+	if cursor != "" {
+		if resuming {
+			if pending[0].Cursor != cursor {
+				pending[0] = resumeCursor{Cursor: cursor, SavedAt: time.Now().Unix()}
+			}
+		} else {
+			pending = append(pending, resumeCursor{Cursor: cursor, SavedAt: time.Now().Unix()})
+		}
+	}
+	if err := saveResumeCursors(pending); err != nil {
+		log.Printf("Failed to save resume cursor: %v", err)
+	}
+	return pending
+}
+
+// 续传页为空时记一次尝试并保存，下次读取时超过上限的游标被丢弃；
+// 网络错误、5xx 和取消不是游标的问题，不计入尝试次数
+func recordEmptyResume(pending []resumeCursor) {
+	pending[0].Attempts++
+	if err := saveResumeCursors(pending); err != nil {
+		log.Printf("Failed to save resume cursor: %v", err)
+	}
+}
+
+// 开始从第一个续传游标继续
+func startResume(pending []resumeCursor) string {
+	log.Printf("Resuming interrupted sync from saved cursor (%d pending, %d/%d empty pages so far)",
+		len(pending), pending[0].Attempts, resumeCursorMaxAttempts)
+	return pending[0].Cursor
+}
+
+// 查看保存的续传游标
+func getResumeCursors(c *gin.Context) {
+	cursors := loadResumeCursors()
+	if cursors == nil {
+		cursors = []resumeCursor{}
+	}
+	c.JSON(http.StatusOK, gin.H{"cursors": cursors, "max_attempts": resumeCursorMaxAttempts})
+}
+
+// 清空续传游标，放弃尚未补齐的旧记录
+func resetResumeCursors(c *gin.Context) {
+	release, ok := scheduler.acquire("reset")
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "A sync is already in progress"})
+		return
+	}
+	defer release()
+
+	if err := saveResumeCursors(nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "续传游标已清空"})
+}
+
+// 写入应用状态值
+func setAppState(key, value string) error {
+	_, err := db.Exec(`
+		INSERT INTO app_state (key, value, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at
+	`, key, value, time.Now())
+	return err
+}
+
+// 计算中位数（会对 values 排序）
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
+
+// 计算中位数和中位数绝对偏差
+func medianMAD(window []int) (float64, float64) {
+	values := make([]float64, len(window))
+	for i, v := range window {
+		values[i] = float64(v)
+	}
+	med := median(values)
+
+	deviations := make([]float64, len(window))
+	for i, v := range window {
+		deviations[i] = math.Abs(float64(v) - med)
+	}
+	return med, median(deviations)
+}
+
+// 根据稳健 z 分数划分严重程度
+func anomalySeverity(score float64) string {
+	switch {
+	case score >= 10:
+		return "critical"
+	case score >= 6:
+		return "high"
+	default:
+		return "medium"
+	}
+}
+
+// 加载某个机器人在指定时间之前的最近记录作为初始基线
+func loadAnomalyBaseline(botName string, before int64) ([]int, error) {
+	rows, err := db.Query(`
+		SELECT point_cost FROM points_history
+		WHERE bot_name = ? AND creation_time < ? AND `+accountFilter+`
+		ORDER BY creation_time DESC, rowid DESC
+		LIMIT ?
+	`, botName, before, localAccount, anomalyWindowSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var window []int
+	for rows.Next() {
+		var cost int
+		if err := rows.Scan(&cost); err != nil {
+			return nil, err
+		}
+		window = append(window, cost)
+	}
+	// 反转为时间正序，便于滑动
+	for i, j := 0, len(window)-1; i < j; i, j = i+1, j-1 {
+		window[i], window[j] = window[j], window[i]
+	}
+	return window, rows.Err()
+}
+
+// 读取异常分析的 rowid 水位线；旧版水位线按 creation_time 记录，
+// 首次升级时换算为其后最早记录之前的 rowid，避免重复分析历史记录
+func loadAnomalyWatermark() (int64, error) {
+	var watermark int64
+	if value, ok := getAppState(anomalyStateKey); ok {
+		fmt.Sscanf(value, "%d", &watermark)
+		return watermark, nil
+	}
+	value, ok := getAppState(anomalyLegacyKey)
+	if !ok {
+		return 0, nil
+	}
+	var legacy int64
+	fmt.Sscanf(value, "%d", &legacy)
+	err := db.QueryRow(`
+		SELECT COALESCE(
+			(SELECT MIN(rowid) - 1 FROM points_history WHERE creation_time > ?),
+			(SELECT MAX(rowid) FROM points_history),
+			0)
+	`, legacy).Scan(&watermark)
+	if err != nil {
+		return 0, err
+	}
+	return watermark, setAppState(anomalyStateKey, fmt.Sprintf("%d", watermark))
+}
+
+// 分析水位线（rowid）之后新写入的记录，按机器人滚动基线标记异常；
+// 写入较晚但时间较早的记录（如补拉的历史）也会在其时间位置上与前后记录一起评估
+func runAnomalyAnalysis() ([]PointAnomaly, error) {
+	if !anomalyMu.TryLock() {
+		return nil, nil
+	}
+	defer anomalyMu.Unlock()
+
+	watermark, err := loadAnomalyWatermark()
+	if err != nil {
+		return nil, err
+	}
+
+	// 本轮只处理当前最大 rowid 之前的记录，分析期间新写入的留到下一轮
+	var maxRowID int64
+	if err := db.QueryRow("SELECT COALESCE(MAX(rowid), 0) FROM points_history").Scan(&maxRowID); err != nil {
+		return nil, err
+	}
+	if maxRowID <= watermark {
+		return nil, nil
+	}
+
+	// 每个机器人最早的新记录时间，从该时间点开始重放
+	rows, err := db.Query(`
+		SELECT bot_name, MIN(creation_time) FROM points_history
+		WHERE rowid > ? AND rowid <= ? AND `+accountFilter+`
+		GROUP BY bot_name
+	`, watermark, maxRowID, localAccount)
+	if err != nil {
+		return nil, err
+	}
+	since := map[string]int64{}
+	for rows.Next() {
+		var botName string
+		var earliest int64
+		if err := rows.Scan(&botName, &earliest); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		since[botName] = earliest
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var flagged []PointAnomaly
+	detectedAt := time.Now().UnixMicro()
+	for botName, earliest := range since {
+		window, err := loadAnomalyBaseline(botName, earliest)
+		if err != nil {
+			return flagged, err
+		}
+
+		rows, err := db.Query(`
+			SELECT rowid, id, point_cost, creation_time FROM points_history
+			WHERE bot_name = ? AND creation_time >= ? AND rowid <= ? AND `+accountFilter+`
+			ORDER BY creation_time ASC, rowid ASC
+		`, botName, earliest, maxRowID, localAccount)
+		if err != nil {
+			return flagged, err
+		}
+		var records []PointsHistoryNode
+		var isNew []bool
+		for rows.Next() {
+			var rowID int64
+			r := PointsHistoryNode{BotName: botName}
+			if err := rows.Scan(&rowID, &r.ID, &r.PointCost, &r.CreationTime); err != nil {
+				rows.Close()
+				return flagged, err
+			}
+			records = append(records, r)
+			isNew = append(isNew, rowID > watermark)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return flagged, err
+		}
+
+		for i, r := range records {
+			if isNew[i] && len(window) >= anomalyMinSamples {
+				med, mad := medianMAD(window)
+				// MAD 为 0（消耗恒定）时使用中位数的 5% 作为最小尺度
+				scale := math.Max(madConsistencyRate*mad, math.Max(1, med*0.05))
+				score := (float64(r.PointCost) - med) / scale
+
+				if score >= anomalyThreshold {
+					anomaly := PointAnomaly{
+						RecordID:       r.ID,
+						BotName:        r.BotName,
+						PointCost:      r.PointCost,
+						CreationTime:   r.CreationTime,
+						BaselineMedian: med,
+						BaselineMAD:    mad,
+						Score:          score,
+						Severity:       anomalySeverity(score),
+						DetectedAt:     detectedAt,
+					}
+					_, err := db.Exec(`
+						INSERT OR REPLACE INTO point_anomalies
+							(record_id, bot_name, point_cost, creation_time, baseline_median, baseline_mad, score, severity, detected_at)
+						VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+					`, anomaly.RecordID, anomaly.BotName, anomaly.PointCost, anomaly.CreationTime,
+						anomaly.BaselineMedian, anomaly.BaselineMAD, anomaly.Score, anomaly.Severity, anomaly.DetectedAt)
+					if err != nil {
+						return flagged, err
+					}
+					flagged = append(flagged, anomaly)
+				}
+			}
+
+			window = append(window, r.PointCost)
+			if len(window) > anomalyWindowSize {
+				window = window[len(window)-anomalyWindowSize:]
+			}
+		}
+	}
+
+	if err := setAppState(anomalyStateKey, fmt.Sprintf("%d", maxRowID)); err != nil {
+		return flagged, err
+	}
+
+	if len(flagged) > 0 {
+		log.Printf("Anomaly analysis flagged %d records", len(flagged))
+	}
+	return flagged, nil
+}
+
+// 启动后台异常分析，关闭服务时退出
+func startAnomalyAnalyzer() {
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		ticker := time.NewTicker(anomalyScanPeriod)
+		defer ticker.Stop()
+		for {
+			anomalies, err := runAnomalyAnalysis()
+			if err != nil {
+				log.Printf("Anomaly analysis error: %v", err)
+			}
+			notifyAnomalies(anomalies)
+			select {
+			case <-ticker.C:
+			case <-appCtx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// 获取异常消耗列表
+func getAnomalies(c *gin.Context) {
+	limit := c.DefaultQuery("limit", "100")
+
+	query := `
+		SELECT record_id, bot_name, point_cost, creation_time, baseline_median, baseline_mad, score, severity, detected_at
+		FROM point_anomalies
+		WHERE 1 = 1
+	`
+	var args []interface{}
+	if severity := c.Query("severity"); severity != "" {
+		query += " AND severity = ?"
+		args = append(args, severity)
+	}
+	if bot := c.Query("bot"); bot != "" {
+		query += " AND bot_name = ?"
+		args = append(args, bot)
+	}
+	if since := c.Query("since"); since != "" {
+		start, err := parseTimeParam(since)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		query += " AND creation_time >= ?"
+		args = append(args, start)
+	}
+	query += " ORDER BY creation_time DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var anomalies []PointAnomaly
+	for rows.Next() {
+		var a PointAnomaly
+		if err := rows.Scan(&a.RecordID, &a.BotName, &a.PointCost, &a.CreationTime,
+			&a.BaselineMedian, &a.BaselineMAD, &a.Score, &a.Severity, &a.DetectedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		anomalies = append(anomalies, a)
+	}
+
+	if anomalies == nil {
+		anomalies = []PointAnomaly{}
+	}
+
+	c.JSON(http.StatusOK, anomalies)
+}
+
+// 预算规则
+type Budget struct {
+	ID            int     `json:"id"`
+	Name          string  `json:"name"`
+	Account       string  `json:"account"`        // 统计的账户，空表示本机账户
+	Scope         string  `json:"scope"`          // account, bot
+	BotName       string  `json:"bot_name"`       // scope=bot 时为空表示任意机器人
+	Period        string  `json:"period"`         // cycle, day, window
+	WindowStart   int64   `json:"window_start"`   // period=window 时的开始时间（微秒）
+	WindowEnd     int64   `json:"window_end"`     // period=window 时的结束时间（微秒）
+	ThresholdType string  `json:"threshold_type"` // percent, absolute
+	Threshold     float64 `json:"threshold"`
+	Enabled       bool    `json:"enabled"`
+	CreatedAt     int64   `json:"created_at"`
+	UpdatedAt     int64   `json:"updated_at"`
+}
+
+// 预算告警
+type Alert struct {
+	ID              int     `json:"id"`
+	BudgetID        int     `json:"budget_id"`
+	BudgetName      string  `json:"budget_name"`
+	BotName         string  `json:"bot_name"`
+	PeriodStart     int64   `json:"period_start"`
+	PeriodEnd       int64   `json:"period_end"`
+	UsedPoints      int     `json:"used_points"`
+	ThresholdPoints float64 `json:"threshold_points"`
+	Message         string  `json:"message"`
+	TriggeredAt     int64   `json:"triggered_at"`
+	Acknowledged    bool    `json:"acknowledged"`
+}
+
+// 校验预算规则
+func validateBudget(b *Budget) error {
+	if b.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	switch b.Scope {
+	case "account":
+		b.BotName = ""
+	case "bot":
+	default:
+		return fmt.Errorf("scope must be account or bot")
+	}
+	switch b.Period {
+	case "cycle", "day":
+	case "window":
+		if b.WindowEnd <= b.WindowStart {
+			return fmt.Errorf("window_end must be after window_start")
+		}
+	default:
+		return fmt.Errorf("period must be cycle, day or window")
+	}
+	b.Account = parseAccount(b.Account)
+	switch b.ThresholdType {
+	case "percent":
+		// 月度配额只属于本机账户
+		if b.Account != localAccount {
+			return fmt.Errorf("percent threshold is only supported for the local account")
+		}
+	case "absolute":
+	default:
+		return fmt.Errorf("threshold_type must be percent or absolute")
+	}
+	if b.Threshold <= 0 {
+		return fmt.Errorf("threshold must be positive")
+	}
+	return nil
+}
+
+// 计算预算规则当前所在的统计区间
+func budgetPeriod(b *Budget, now time.Time) (int64, int64) {
+	switch b.Period {
+	case "day":
+		dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		return dayStart.UnixMicro(), dayStart.AddDate(0, 0, 1).UnixMicro()
+	case "window":
+		return b.WindowStart, b.WindowEnd
+	default:
+		return getPlanPeriodByOffset(0)
+	}
+}
+
+func scanBudget(scanner interface{ Scan(...interface{}) error }) (Budget, error) {
+	var b Budget
+	var enabled int
+	err := scanner.Scan(&b.ID, &b.Name, &b.Account, &b.Scope, &b.BotName, &b.Period, &b.WindowStart, &b.WindowEnd,
+		&b.ThresholdType, &b.Threshold, &enabled, &b.CreatedAt, &b.UpdatedAt)
+	b.Enabled = enabled == 1
+	return b, err
+}
+
+const budgetColumns = `id, name, account, scope, COALESCE(bot_name, ''), period, COALESCE(window_start, 0), COALESCE(window_end, 0),
+	threshold_type, threshold, enabled, created_at, updated_at`
+
+// 加载预算规则
+func loadBudgets(onlyEnabled bool) ([]Budget, error) {
+	query := "SELECT " + budgetColumns + " FROM budgets"
+	if onlyEnabled {
+		query += " WHERE enabled = 1"
+	}
+	query += " ORDER BY id"
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var budgets []Budget
+	for rows.Next() {
+		b, err := scanBudget(rows)
+		if err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, b)
+	}
+	return budgets, rows.Err()
+}
+
+// 评估所有预算规则，返回本次新触发的告警
+func evaluateBudgets() ([]Alert, error) {
+	budgets, err := loadBudgets(true)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	currentPeriodStart, _ := getPlanPeriodByOffset(0)
+	allotment, _ := getAllotmentForPeriod(currentPeriodStart, getCurrentPlan().Allotment)
+	var triggered []Alert
+
+	for i := range budgets {
+		b := &budgets[i]
+		periodStart, periodEnd := budgetPeriod(b, now)
+
+		thresholdPoints := b.Threshold
+		if b.ThresholdType == "percent" {
+			thresholdPoints = float64(allotment) * b.Threshold / 100
+		}
+
+		// 按机器人或整个账户汇总区间消耗
+		query := `
+			SELECT '' as bot_name, COALESCE(SUM(point_cost), 0) FROM points_history
+			WHERE creation_time >= ? AND creation_time < ? AND ` + accountFilter + `
+		`
+		args := []interface{}{periodStart, periodEnd, b.Account}
+		if b.Scope == "bot" {
+			query = `
+				SELECT bot_name, SUM(point_cost) FROM points_history
+				WHERE creation_time >= ? AND creation_time < ? AND ` + accountFilter + `
+			`
+			if b.BotName != "" {
+				query += " AND bot_name = ?"
+				args = append(args, b.BotName)
+			}
+			query += " GROUP BY bot_name"
+		}
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return triggered, err
+		}
+		type usage struct {
+			botName string
+			points  int
+		}
+		var usages []usage
+		for rows.Next() {
+			var u usage
+			if err := rows.Scan(&u.botName, &u.points); err != nil {
+				rows.Close()
+				return triggered, err
+			}
+			usages = append(usages, u)
+		}
+		rows.Close()
+
+		for _, u := range usages {
+			if float64(u.points) < thresholdPoints {
+				continue
+			}
+
+			target := "account " + accountLabel(b.Account)
+			if u.botName != "" {
+				target = "bot " + u.botName
+			}
+			alert := Alert{
+				BudgetID:        b.ID,
+				BudgetName:      b.Name,
+				BotName:         u.botName,
+				PeriodStart:     periodStart,
+				PeriodEnd:       periodEnd,
+				UsedPoints:      u.points,
+				ThresholdPoints: thresholdPoints,
+				Message: fmt.Sprintf("Budget %q exceeded: %s used %d points (threshold %.0f)",
+					b.Name, target, u.points, thresholdPoints),
+				TriggeredAt: now.UnixMicro(),
+			}
+
+			// 同一规则、机器人和区间只告警一次；规则修改后重新计算，
+			// 修改前触发的告警会被新告警替换（并重置确认状态）
+			result, err := db.Exec(`
+				INSERT INTO alerts
+					(budget_id, budget_name, bot_name, period_start, period_end, used_points, threshold_points, message, triggered_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(budget_id, bot_name, period_start) DO UPDATE SET
+					budget_name = excluded.budget_name, period_end = excluded.period_end,
+					used_points = excluded.used_points, threshold_points = excluded.threshold_points,
+					message = excluded.message, triggered_at = excluded.triggered_at, acknowledged = 0
+				WHERE alerts.triggered_at < ?
+			`, alert.BudgetID, alert.BudgetName, alert.BotName, alert.PeriodStart, alert.PeriodEnd,
+				alert.UsedPoints, alert.ThresholdPoints, alert.Message, alert.TriggeredAt, b.UpdatedAt)
+			if err != nil {
+				return triggered, err
+			}
+			if affected, _ := result.RowsAffected(); affected > 0 {
+				if err := db.QueryRow(`
+					SELECT id FROM alerts WHERE budget_id = ? AND bot_name = ? AND period_start = ?
+				`, alert.BudgetID, alert.BotName, alert.PeriodStart).Scan(&alert.ID); err != nil {
+					return triggered, err
+				}
+				triggered = append(triggered, alert)
+				log.Println(alert.Message)
+			}
+		}
+	}
+
+	return triggered, nil
+}
+
+// 同步完成后的处理：异常分析和预算评估，并发送相应通知
+func afterSync(newRecords int) {
+	if newRecords > 0 {
+		anomalies, err := runAnomalyAnalysis()
+		if err != nil {
+			log.Printf("Anomaly analysis error: %v", err)
+		}
+		notifyAnomalies(anomalies)
+	}
+
+	alerts, err := evaluateBudgets()
+	if err != nil {
+		log.Printf("Budget evaluation error: %v", err)
+	}
+	for _, a := range alerts {
+		notifyEvent(eventBudgetExceeded, a.Message, a)
+	}
+
+	// 推送到外部时序库（包括上次同步后导入或合并的记录）
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		runExporters()
+	}()
+}
+
+// 获取预算规则列表，指定 account 时只返回该账户的规则
+func getBudgets(c *gin.Context) {
+	budgets, err := loadBudgets(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if account, ok := c.GetQuery("account"); ok {
+		account = parseAccount(account)
+		filtered := []Budget{}
+		for _, b := range budgets {
+			if b.Account == account {
+				filtered = append(filtered, b)
+			}
+		}
+		budgets = filtered
+	}
+	if budgets == nil {
+		budgets = []Budget{}
+	}
+	c.JSON(http.StatusOK, budgets)
+}
+
+// 创建预算规则
+func createBudget(c *gin.Context) {
+	input := Budget{Enabled: true}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateBudget(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	enabled := 0
+	if input.Enabled {
+		enabled = 1
+	}
+	now := time.Now().UnixMicro()
+	result, err := db.Exec(`
+		INSERT INTO budgets (name, account, scope, bot_name, period, window_start, window_end, threshold_type, threshold, enabled, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, input.Name, input.Account, input.Scope, input.BotName, input.Period, input.WindowStart, input.WindowEnd,
+		input.ThresholdType, input.Threshold, enabled, now, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	input.ID = int(id)
+	input.CreatedAt = now
+	input.UpdatedAt = now
+	c.JSON(http.StatusOK, input)
+}
+
+// 更新预算规则
+func updateBudget(c *gin.Context) {
+	existing, err := scanBudget(db.QueryRow("SELECT "+budgetColumns+" FROM budgets WHERE id = ?", c.Param("id")))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Budget not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 未提供的字段保持原值
+	input := existing
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.ID = existing.ID
+	input.CreatedAt = existing.CreatedAt
+	if err := validateBudget(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	enabled := 0
+	if input.Enabled {
+		enabled = 1
+	}
+	input.UpdatedAt = time.Now().UnixMicro()
+	_, err = db.Exec(`
+		UPDATE budgets
+		SET name = ?, account = ?, scope = ?, bot_name = ?, period = ?, window_start = ?, window_end = ?,
+		    threshold_type = ?, threshold = ?, enabled = ?, updated_at = ?
+		WHERE id = ?
+	`, input.Name, input.Account, input.Scope, input.BotName, input.Period, input.WindowStart, input.WindowEnd,
+		input.ThresholdType, input.Threshold, enabled, input.UpdatedAt, input.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, input)
+}
+
+// 删除预算规则
+func deleteBudget(c *gin.Context) {
+	result, err := db.Exec("DELETE FROM budgets WHERE id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Budget not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "预算已删除"})
+}
+
+// 获取告警列表
+func getAlerts(c *gin.Context) {
+	limit := c.DefaultQuery("limit", "100")
+
+	query := `
+		SELECT id, budget_id, budget_name, bot_name, period_start, period_end,
+		       used_points, threshold_points, message, triggered_at, acknowledged
+		FROM alerts
+	`
+	if c.Query("unacknowledged") == "true" {
+		query += " WHERE acknowledged = 0"
+	}
+	query += " ORDER BY triggered_at DESC LIMIT ?"
+
+	rows, err := db.Query(query, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var alerts []Alert
+	for rows.Next() {
+		var a Alert
+		var acknowledged int
+		if err := rows.Scan(&a.ID, &a.BudgetID, &a.BudgetName, &a.BotName, &a.PeriodStart, &a.PeriodEnd,
+			&a.UsedPoints, &a.ThresholdPoints, &a.Message, &a.TriggeredAt, &acknowledged); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		a.Acknowledged = acknowledged == 1
+		alerts = append(alerts, a)
+	}
+
+	if alerts == nil {
+		alerts = []Alert{}
+	}
+
+	c.JSON(http.StatusOK, alerts)
+}
+
+// 确认告警
+func acknowledgeAlert(c *gin.Context) {
+	result, err := db.Exec("UPDATE alerts SET acknowledged = 1 WHERE id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "告警已确认"})
+}
+
+// 通知事件类型
+const (
+	eventBudgetExceeded     = "budget_exceeded"
+	eventCredentialsExpired = "credentials_expired"
+	eventSyncFailed         = "sync_failed"
+	eventAnomalyDetected    = "anomaly_detected"
+	eventResumeDropped      = "resume_cursor_dropped"
+	eventTest               = "test"
+)
+
+// 通知事件
+type NotificationEvent struct {
+	Event     string      `json:"event"`
+	Message   string      `json:"message"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// Webhook 目标
+type WebhookTarget struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`             // slack, discord, generic
+	URL       string `json:"url"`              // 接收地址
+	Secret    string `json:"secret,omitempty"` // HMAC 签名密钥（为空则不签名），只写不返回
+	SecretSet bool   `json:"secret_set"`
+	Events    string `json:"events"`   // 订阅的事件，逗号分隔，* 表示全部
+	Template  string `json:"template"` // 自定义 JSON 负载模板（text/template），为空使用默认模板
+	Enabled   bool   `json:"enabled"`
+}
+
+// Webhook 投递记录
+type WebhookDelivery struct {
+	ID          int    `json:"id"`
+	TargetID    int    `json:"target_id"`
+	Event       string `json:"event"`
+	Payload     string `json:"payload"`
+	Attempt     int    `json:"attempt"`
+	StatusCode  int    `json:"status_code"`
+	Error       string `json:"error"`
+	Success     bool   `json:"success"`
+	DeliveredAt int64  `json:"delivered_at"`
+}
+
+// 各类型目标的默认负载模板
+var defaultWebhookTemplates = map[string]string{
+	"slack":   `{"text": {{json (printf "[%s] %s" .Event .Message)}}}`,
+	"discord": `{"content": {{json (printf "[%s] %s" .Event .Message)}}}`,
+	"generic": `{"event": {{json .Event}}, "message": {{json .Message}}, "timestamp": {{json .Timestamp}}, "data": {{json .Data}}}`,
+}
+
+// Webhook 通知器
+type WebhookNotifier struct {
+	client      *http.Client
+	maxAttempts int
+	baseBackoff time.Duration
+	wg          sync.WaitGroup
+}
+
+var webhookNotifier = &WebhookNotifier{
+	client:      &http.Client{Timeout: 10 * time.Second},
+	maxAttempts: 4,
+	baseBackoff: 2 * time.Second,
+}
+
+// 渲染负载模板，结果必须是合法 JSON
+func renderWebhookPayload(target *WebhookTarget, event *NotificationEvent) ([]byte, error) {
+	text := target.Template
+	if text == "" {
+		text = defaultWebhookTemplates[target.Kind]
+	}
+
+	tmpl, err := template.New("payload").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, event); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template did not produce valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+// 计算 HMAC-SHA256 签名
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// 判断目标是否订阅了事件
+func (t *WebhookTarget) subscribes(event string) bool {
+	if t.Events == "" || t.Events == "*" {
+		return true
+	}
+	for _, e := range strings.Split(t.Events, ",") {
+		if strings.TrimSpace(e) == event {
+			return true
+		}
+	}
+	return false
+}
+
+// 记录一次投递尝试
+func logWebhookDelivery(d *WebhookDelivery) {
+	success := 0
+	if d.Success {
+		success = 1
+	}
+	if _, err := db.Exec(`
+		INSERT INTO webhook_deliveries (target_id, event, payload, attempt, status_code, error, success, delivered_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, d.TargetID, d.Event, d.Payload, d.Attempt, d.StatusCode, d.Error, success, d.DeliveredAt); err != nil {
+		log.Printf("Failed to log webhook delivery: %v", err)
+	}
+}
+
+// 向单个目标投递，429/5xx 和网络错误按指数退避重试
+func (n *WebhookNotifier) deliver(target WebhookTarget, event NotificationEvent) error {
+	payload, err := renderWebhookPayload(&target, &event)
+	if err != nil {
+		logWebhookDelivery(&WebhookDelivery{
+			TargetID: target.ID, Event: event.Event, Attempt: 1,
+			Error: err.Error(), DeliveredAt: time.Now().UnixMicro(),
+		})
+		return err
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= n.maxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(n.baseBackoff * time.Duration(1<<(attempt-2)))
+		}
+
+		delivery := WebhookDelivery{TargetID: target.ID, Event: event.Event, Payload: string(payload), Attempt: attempt}
+		retry := false
+
+		req, err := http.NewRequest("POST", target.URL, bytes.NewReader(payload))
+		if err != nil {
+			lastErr = err
+		} else {
+			req.Header.Set("content-type", "application/json")
+			req.Header.Set("user-agent", "PoePointsMonitor-Webhook/1.0")
+			req.Header.Set("x-poe-monitor-event", event.Event)
+			if target.Secret != "" {
+				req.Header.Set("x-poe-monitor-signature", signWebhookPayload(target.Secret, payload))
+			}
+
+			resp, err := n.client.Do(req)
+			if err != nil {
+				lastErr = err
+				retry = true
+			} else {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				delivery.StatusCode = resp.StatusCode
+				switch {
+				case resp.StatusCode >= 200 && resp.StatusCode < 300:
+					lastErr = nil
+				case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+					lastErr = fmt.Errorf("webhook returned status %d", resp.StatusCode)
+					retry = true
+				default:
+					lastErr = fmt.Errorf("webhook returned status %d", resp.StatusCode)
+				}
+			}
+		}
+
+		delivery.Success = lastErr == nil
+		if lastErr != nil {
+			delivery.Error = lastErr.Error()
+		}
+		delivery.DeliveredAt = time.Now().UnixMicro()
+		logWebhookDelivery(&delivery)
+
+		if !retry {
+			break
+		}
+	}
+
+	if lastErr != nil {
+		log.Printf("Webhook %q delivery of %s failed: %v", target.Name, event.Event, lastErr)
+	}
+	return lastErr
+}
+
+// 加载 Webhook 目标
+func loadWebhookTargets(onlyEnabled bool) ([]WebhookTarget, error) {
+	query := `
+		SELECT id, name, kind, url, COALESCE(secret, ''), COALESCE(events, '*'), COALESCE(template, ''), enabled
+		FROM webhook_targets
+	`
+	if onlyEnabled {
+		query += " WHERE enabled = 1"
+	}
+	query += " ORDER BY id"
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []WebhookTarget
+	for rows.Next() {
+		var t WebhookTarget
+		var enabled int
+		if err := rows.Scan(&t.ID, &t.Name, &t.Kind, &t.URL, &t.Secret, &t.Events, &t.Template, &enabled); err != nil {
+			return nil, err
+		}
+		t.Enabled = enabled == 1
+		t.SecretSet = t.Secret != ""
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+// 异步向所有订阅了该事件的目标发送通知
+func notifyEvent(eventName, message string, data interface{}) {
+	if db == nil {
+		return
+	}
+	targets, err := loadWebhookTargets(true)
+	if err != nil {
+		log.Printf("Failed to load webhook targets: %v", err)
+		return
+	}
+
+	event := NotificationEvent{Event: eventName, Message: message, Timestamp: time.Now(), Data: data}
+	for _, target := range targets {
+		if !target.subscribes(eventName) {
+			continue
+		}
+		webhookNotifier.wg.Add(1)
+		go func(t WebhookTarget) {
+			defer webhookNotifier.wg.Done()
+			webhookNotifier.deliver(t, event)
+		}(target)
+	}
+}
+
+// 为新发现的异常发送通知
+func notifyAnomalies(anomalies []PointAnomaly) {
+	for _, a := range anomalies {
+		notifyEvent(eventAnomalyDetected,
+			fmt.Sprintf("%s charged %d points (baseline median %.0f, severity %s)", a.BotName, a.PointCost, a.BaselineMedian, a.Severity),
+			a)
+	}
+}
+
+// 同步失败时的通知，自动和手动拉取共用；401/403 视为凭据过期，statusCode 为 0 表示非 HTTP 错误
+func notifySyncFailure(trigger string, statusCode int, message string, newRecords int) {
+	if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+		notifyEvent(eventCredentialsExpired, "Poe credentials expired, please update cookie and form key",
+			gin.H{"status_code": statusCode, "trigger": trigger})
+		return
+	}
+	data := gin.H{"new_records": newRecords, "trigger": trigger}
+	if statusCode != 0 {
+		data["status_code"] = statusCode
+	}
+	notifyEvent(eventSyncFailed, message, data)
+}
+
+// 校验 Webhook 目标
+func validateWebhookTarget(t *WebhookTarget) error {
+	if t.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if t.Kind == "" {
+		t.Kind = "generic"
+	}
+	if _, ok := defaultWebhookTemplates[t.Kind]; !ok {
+		return fmt.Errorf("kind must be slack, discord or generic")
+	}
+	if !strings.HasPrefix(t.URL, "http://") && !strings.HasPrefix(t.URL, "https://") {
+		return fmt.Errorf("url must be an http(s) URL")
+	}
+	if t.Events == "" {
+		t.Events = "*"
+	}
+	// 用订阅的每种事件的示例数据检查模板能否生成合法 JSON；未订阅任何已知事件时用测试事件检查
+	samples := sampleNotificationEvents()
+	checked := 0
+	for _, sample := range samples {
+		if !t.subscribes(sample.Event) {
+			continue
+		}
+		checked++
+		if _, err := renderWebhookPayload(t, &sample); err != nil {
+			return fmt.Errorf("invalid template for %s event: %v", sample.Event, err)
+		}
+	}
+	if checked == 0 {
+		if _, err := renderWebhookPayload(t, &samples[len(samples)-1]); err != nil {
+			return fmt.Errorf("invalid template: %v", err)
+		}
+	}
+	return nil
+}
+
+// 各类事件的示例，数据类型与实际通知一致；测试事件放在最后
+func sampleNotificationEvents() []NotificationEvent {
+	now := time.Now()
+	return []NotificationEvent{
+		{Event: eventBudgetExceeded, Message: "Budget exceeded", Timestamp: now, Data: Alert{
+			BudgetName: "sample", BotName: "Claude", PeriodStart: now.UnixMicro(), PeriodEnd: now.UnixMicro(),
+			UsedPoints: 1000, ThresholdPoints: 800, Message: "Budget exceeded", TriggeredAt: now.UnixMicro(),
+		}},
+		{Event: eventCredentialsExpired, Message: "Poe credentials expired", Timestamp: now, Data: gin.H{"status_code": 401}},
+		{Event: eventSyncFailed, Message: "Sync failed", Timestamp: now, Data: gin.H{"new_records": 0, "status_code": 502}},
+		{Event: eventAnomalyDetected, Message: "Anomaly detected", Timestamp: now, Data: PointAnomaly{
+			RecordID: "sample", BotName: "Claude", PointCost: 5000, CreationTime: now.UnixMicro(),
+			BaselineMedian: 300, BaselineMAD: 20, Score: 10, Severity: "high", DetectedAt: now.UnixMicro(),
+		}},
+		{Event: eventResumeDropped, Message: "Resume cursor dropped", Timestamp: now, Data: resumeCursor{
+			Cursor: "sample", Attempts: resumeCursorMaxAttempts, SavedAt: now.Unix(),
+		}},
+		{Event: eventTest, Message: "test", Timestamp: now, Data: gin.H{"target": "sample"}},
+	}
+}
+
+// 获取 Webhook 目标列表
+func getWebhookTargets(c *gin.Context) {
+	targets, err := loadWebhookTargets(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if targets == nil {
+		targets = []WebhookTarget{}
+	}
+	for i := range targets {
+		targets[i].Secret = ""
+	}
+	c.JSON(http.StatusOK, targets)
+}
+
+// 创建 Webhook 目标
+func createWebhookTarget(c *gin.Context) {
+	input := WebhookTarget{Enabled: true}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateWebhookTarget(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	enabled := 0
+	if input.Enabled {
+		enabled = 1
+	}
+	result, err := db.Exec(`
+		INSERT INTO webhook_targets (name, kind, url, secret, events, template, enabled, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, input.Name, input.Kind, input.URL, input.Secret, input.Events, input.Template, enabled, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	input.ID = int(id)
+	input.SecretSet = input.Secret != ""
+	input.Secret = ""
+	c.JSON(http.StatusOK, input)
+}
+
+// 更新 Webhook 目标
+func updateWebhookTarget(c *gin.Context) {
+	var existing WebhookTarget
+	var enabled int
+	err := db.QueryRow(`
+		SELECT id, name, kind, url, COALESCE(secret, ''), COALESCE(events, '*'), COALESCE(template, ''), enabled
+		FROM webhook_targets WHERE id = ?
+	`, c.Param("id")).Scan(&existing.ID, &existing.Name, &existing.Kind, &existing.URL,
+		&existing.Secret, &existing.Events, &existing.Template, &enabled)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	existing.Enabled = enabled == 1
+
+	// 未提供的字段保持原值，密钥为空时保留原密钥
+	input := existing
+	input.Secret = ""
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Secret == "" {
+		input.Secret = existing.Secret
+	}
+	input.ID = existing.ID
+	if err := validateWebhookTarget(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	enabled = 0
+	if input.Enabled {
+		enabled = 1
+	}
+	_, err = db.Exec(`
+		UPDATE webhook_targets
+		SET name = ?, kind = ?, url = ?, secret = ?, events = ?, template = ?, enabled = ?, updated_at = ?
+		WHERE id = ?
+	`, input.Name, input.Kind, input.URL, input.Secret, input.Events, input.Template, enabled, time.Now(), input.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	input.SecretSet = input.Secret != ""
+	input.Secret = ""
+	c.JSON(http.StatusOK, input)
+}
+
+// 删除 Webhook 目标
+func deleteWebhookTarget(c *gin.Context) {
+	result, err := db.Exec("DELETE FROM webhook_targets WHERE id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook 已删除"})
+}
+
+// 发送测试通知（同步投递，便于立即查看结果）
+func testWebhookTarget(c *gin.Context) {
+	targets, err := loadWebhookTargets(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, target := range targets {
+		if fmt.Sprintf("%d", target.ID) != c.Param("id") {
+			continue
+		}
+		event := NotificationEvent{
+			Event:     eventTest,
+			Message:   "Test notification from Poe Points Monitor",
+			Timestamp: time.Now(),
+			Data:      gin.H{"target": target.Name},
+		}
+		if err := webhookNotifier.deliver(target, event); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "测试通知已发送"})
+		return
+	}
+
+	c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+}
+
+// 获取 Webhook 投递记录
+func getWebhookDeliveries(c *gin.Context) {
+	limit := c.DefaultQuery("limit", "100")
+
+	query := `
+		SELECT id, target_id, event, COALESCE(payload, ''), attempt, COALESCE(status_code, 0),
+		       COALESCE(error, ''), success, delivered_at
+		FROM webhook_deliveries
+	`
+	var args []interface{}
+	if targetID := c.Query("target_id"); targetID != "" {
+		query += " WHERE target_id = ?"
+		args = append(args, targetID)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		var success int
+		if err := rows.Scan(&d.ID, &d.TargetID, &d.Event, &d.Payload, &d.Attempt, &d.StatusCode,
+			&d.Error, &success, &d.DeliveredAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		d.Success = success == 1
+		deliveries = append(deliveries, d)
+	}
+
+	if deliveries == nil {
+		deliveries = []WebhookDelivery{}
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// 邮件通知设置
+type EmailSettings struct {
+	SMTPHost     string `json:"smtp_host"`
+	SMTPPort     int    `json:"smtp_port"`
+	TLSMode      string `json:"tls_mode"` // none, starttls, tls
+	Username     string `json:"username"`
+	Password     string `json:"password,omitempty"`
+	PasswordSet  bool   `json:"password_set"`
+	FromAddress  string `json:"from_address"`
+	Recipients   string `json:"recipients"` // 逗号分隔
+	DailyEnabled bool   `json:"daily_enabled"`
+	DailyHour    int    `json:"daily_hour"` // 每日摘要发送时间（本地小时，0-23）
+	CycleEnabled bool   `json:"cycle_enabled"`
+}
+
+// 邮件摘要数据
+type DigestData struct {
+	Title        string
+	RangeLabel   string
+	TotalPoints  int
+	MessageCount int
+	Breakdown    []AggregatedStats
+	Bots         []BotStat
+	Cost         *SubscriptionCostInfo
+	GeneratedAt  string
+}
+
+const (
+	emailDailyStateKey = "email_daily_last"
+	emailCycleStateKey = "email_cycle_last"
+	// 发送失败后的重试间隔，每次失败加倍，最长不超过 emailRetryMaxDelay
+	emailRetryBaseDelay = 5 * time.Minute
+	emailRetryMaxDelay  = 6 * time.Hour
+)
+
+// 摘要发送失败记录，保存在 "<状态键>_attempt" 中，用于退避重试
+type digestAttempt struct {
+	Marker      string `json:"marker"`
+	Failures    int    `json:"failures"`
+	LastAttempt int64  `json:"last_attempt"` // Unix 秒
+}
+
+var digestHTMLTemplate = htmltemplate.Must(htmltemplate.New("digest").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: -apple-system, Helvetica, Arial, sans-serif; color: #222;">
+<h2>{{.Title}}</h2>
+<p>{{.RangeLabel}}</p>
+<table cellpadding="6" style="border-collapse: collapse;">
+<tr><td>Total points</td><td><b>{{.TotalPoints}}</b></td></tr>
+<tr><td>Messages</td><td><b>{{.MessageCount}}</b></td></tr>
+{{if .Cost}}<tr><td>Cycle points used</td><td>{{.Cost.TotalPointsUsed}}</td></tr>
+<tr><td>Cycle cost ({{.Cost.DisplayCurrency}})</td><td>{{printf "%.2f" .Cost.UsedPointsValueDisplay}} / {{printf "%.2f" .Cost.SubscriptionAmountDisplay}}</td></tr>{{end}}
+</table>
+{{if .Bots}}<h3>Bots</h3>
+<table cellpadding="6" style="border-collapse: collapse; border: 1px solid #ddd;">
+<tr style="background: #f4f4f4;"><th align="left">Bot</th><th align="right">Points</th><th align="right">Messages</th></tr>
+{{range .Bots}}<tr><td>{{.BotName}}</td><td align="right">{{.TotalCost}}</td><td align="right">{{.Count}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Breakdown}}<h3>Breakdown</h3>
+<table cellpadding="6" style="border-collapse: collapse; border: 1px solid #ddd;">
+<tr style="background: #f4f4f4;"><th align="left">Time</th><th align="right">Points</th><th align="right">Messages</th></tr>
+{{range .Breakdown}}<tr><td>{{.Timestamp}}</td><td align="right">{{.PointCost}}</td><td align="right">{{.RecordCount}}</td></tr>
+{{end}}</table>{{end}}
+<p style="color: #888; font-size: 12px;">Generated by Poe Points Monitor at {{.GeneratedAt}}</p>
+</body>
+</html>
+`))
+
+var digestTextTemplate = template.Must(template.New("digest").Parse(`{{.Title}}
+{{.RangeLabel}}
+
+Total points: {{.TotalPoints}}
+Messages:     {{.MessageCount}}
+{{if .Cost}}Cycle points used: {{.Cost.TotalPointsUsed}}
+Cycle cost ({{.Cost.DisplayCurrency}}):  {{printf "%.2f" .Cost.UsedPointsValueDisplay}} / {{printf "%.2f" .Cost.SubscriptionAmountDisplay}}
+{{end}}{{if .Bots}}
+Bots:
+{{range .Bots}}  {{.BotName}}: {{.TotalCost}} points, {{.Count}} messages
+{{end}}{{end}}{{if .Breakdown}}
+Breakdown:
+{{range .Breakdown}}  {{.Timestamp}}: {{.PointCost}} points, {{.RecordCount}} messages
+{{end}}{{end}}
+Generated by Poe Points Monitor at {{.GeneratedAt}}
+`))
+
+// 读取邮件设置
+func loadEmailSettings() (*EmailSettings, error) {
+	var s EmailSettings
+	var dailyEnabled, cycleEnabled int
+	err := db.QueryRow(`
+		SELECT COALESCE(smtp_host, ''), COALESCE(smtp_port, 25), COALESCE(tls_mode, 'none'),
+		       COALESCE(username, ''), COALESCE(password, ''), COALESCE(from_address, ''),
+		       COALESCE(recipients, ''), COALESCE(daily_enabled, 0), COALESCE(daily_hour, 8),
+		       COALESCE(cycle_enabled, 0)
+		FROM email_settings WHERE id = 1
+	`).Scan(&s.SMTPHost, &s.SMTPPort, &s.TLSMode, &s.Username, &s.Password, &s.FromAddress,
+		&s.Recipients, &dailyEnabled, &s.DailyHour, &cycleEnabled)
+	if err == sql.ErrNoRows {
+		return &EmailSettings{SMTPPort: 25, TLSMode: "none", DailyHour: 8}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.DailyEnabled = dailyEnabled == 1
+	s.CycleEnabled = cycleEnabled == 1
+	s.PasswordSet = s.Password != ""
+	return &s, nil
+}
+
+// 解析收件人列表（RFC 5322 地址，逗号分隔），返回用于 SMTP 信封的纯地址
+func (s *EmailSettings) recipientList() ([]string, error) {
+	if strings.TrimSpace(s.Recipients) == "" {
+		return nil, nil
+	}
+	addrs, err := mail.ParseAddressList(s.Recipients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipients: %w", err)
+	}
+	list := make([]string, len(addrs))
+	for i, a := range addrs {
+		list[i] = a.Address
+	}
+	return list, nil
+}
+
+// 解析发件人地址，返回用于 SMTP 信封的纯地址
+func (s *EmailSettings) fromAddress() (string, error) {
+	addr, err := mail.ParseAddress(s.FromAddress)
+	if err != nil {
+		return "", fmt.Errorf("invalid from_address: %w", err)
+	}
+	return addr.Address, nil
+}
+
+// 构建 multipart/alternative 邮件内容
+func buildEmailMessage(from string, to []string, subject, textBody, htmlBody string) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", writer.Boundary())
+
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", textBody},
+		{"text/html; charset=utf-8", htmlBody},
+	} {
+		w, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 通过 SMTP 发送邮件
+func sendEmail(settings *EmailSettings, subject, textBody, htmlBody string) error {
+	recipients, err := settings.recipientList()
+	if err != nil {
+		return err
+	}
+	if settings.SMTPHost == "" || settings.FromAddress == "" || len(recipients) == 0 {
+		return fmt.Errorf("email settings incomplete: smtp_host, from_address and recipients are required")
+	}
+	from, err := settings.fromAddress()
+	if err != nil {
+		return err
+	}
+
+	message, err := buildEmailMessage(settings.FromAddress, recipients, subject, textBody, htmlBody)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(settings.SMTPHost, fmt.Sprintf("%d", settings.SMTPPort))
+	tlsConfig := &tls.Config{ServerName: settings.SMTPHost}
+
+	var conn net.Conn
+	if settings.TLSMode == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, settings.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if settings.TLSMode == "starttls" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if settings.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", settings.Username, settings.Password, settings.SMTPHost)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, r := range recipients {
+		if err := client.Rcpt(r); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// 汇总区间内的积分和消息数
+func sumBreakdown(stats []AggregatedStats) (int, int) {
+	var points, count int
+	for _, s := range stats {
+		points += s.PointCost
+		count += s.RecordCount
+	}
+	return points, count
+}
+
+// 构建每日摘要（指定日期的整天）
+func buildDailyDigest(day time.Time) (*DigestData, error) {
+	dayStart := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+	start, end := dayStart.UnixMicro(), dayStart.AddDate(0, 0, 1).UnixMicro()
+
+	breakdown, err := queryAggregatedStats("hour", "discrete", start, end, localAccount)
+	if err != nil {
+		return nil, err
+	}
+	bots, err := queryBotStats(start, end, localAccount, nil)
+	if err != nil {
+		return nil, err
+	}
+	cost, err := buildSubscriptionCostInfo(0, "")
+	if err != nil {
+		return nil, err
+	}
+
+	points, count := sumBreakdown(breakdown)
+	return &DigestData{
+		Title:        "Poe daily usage digest",
+		RangeLabel:   dayStart.Format("2006-01-02 (Monday)"),
+		TotalPoints:  points,
+		MessageCount: count,
+		Breakdown:    breakdown,
+		Bots:         bots,
+		Cost:         cost,
+		GeneratedAt:  time.Now().Format("2006-01-02 15:04:05"),
+	}, nil
+}
+
+// 构建订阅周期总结（相对当前周期的偏移）
+func buildCycleDigest(periodOffset int) (*DigestData, error) {
+	cost, err := buildSubscriptionCostInfo(periodOffset, "")
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown, err := queryAggregatedStats("day", "discrete", cost.PeriodStart, cost.PeriodEnd, localAccount)
+	if err != nil {
+		return nil, err
+	}
+	bots, err := queryBotStats(cost.PeriodStart, cost.PeriodEnd, localAccount, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	points, count := sumBreakdown(breakdown)
+	return &DigestData{
+		Title:        "Poe subscription cycle summary",
+		RangeLabel:   formatPeriodLabel(cost.PeriodStart, cost.PeriodEnd),
+		TotalPoints:  points,
+		MessageCount: count,
+		Breakdown:    breakdown,
+		Bots:         bots,
+		Cost:         cost,
+		GeneratedAt:  time.Now().Format("2006-01-02 15:04:05"),
+	}, nil
+}
+
+// 渲染并发送摘要邮件
+func sendDigest(settings *EmailSettings, data *DigestData) error {
+	var htmlBody, textBody bytes.Buffer
+	if err := digestHTMLTemplate.Execute(&htmlBody, data); err != nil {
+		return err
+	}
+	if err := digestTextTemplate.Execute(&textBody, data); err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("%s: %s", data.Title, data.RangeLabel)
+	return sendEmail(settings, subject, textBody.String(), htmlBody.String())
+}
+
+// 读取某个摘要标记的失败记录，标记变化时重新计数
+func loadDigestAttempt(stateKey, marker string) digestAttempt {
+	var attempt digestAttempt
+	if value, ok := getAppState(stateKey + "_attempt"); ok {
+		json.Unmarshal([]byte(value), &attempt)
+	}
+	if attempt.Marker != marker {
+		return digestAttempt{Marker: marker}
+	}
+	return attempt
+}
+
+// 下次允许重试的时间
+func (a digestAttempt) nextAttempt() time.Time {
+	if a.Failures == 0 {
+		return time.Time{}
 	}
-
-	c.JSON(http.StatusOK, stats)
+	delay := emailRetryBaseDelay
+	for i := 1; i < a.Failures && delay < emailRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > emailRetryMaxDelay {
+		delay = emailRetryMaxDelay
+	}
+	return time.Unix(a.LastAttempt, 0).Add(delay)
 }
 
-// 获取配置
-func getConfig(c *gin.Context) {
-	var config Config
-	var autoFetchEnabled int
-	var subscriptionCurrency sql.NullString
-	var subscriptionAmount sql.NullFloat64
-	err := db.QueryRow(`
-		SELECT id, COALESCE(cookie, '') as cookie, COALESCE(form_key, '') as form_key, 
-		       COALESCE(tchannel, '') as tchannel, COALESCE(revision, '') as revision, 
-		       COALESCE(tag_id, '') as tag_id, COALESCE(subscription_day, 1) as subscription_day,
-		       subscription_amount, subscription_currency,
-		       COALESCE(auto_fetch_interval, 30) as auto_fetch_interval,
-		       COALESCE(auto_fetch_enabled, 0) as auto_fetch_enabled,
-		       updated_at
-		FROM config ORDER BY id DESC LIMIT 1
-	`).Scan(&config.ID, &config.Cookie, &config.FormKey, &config.TChannel,
-		&config.Revision, &config.TagID, &config.SubscriptionDay,
-		&subscriptionAmount, &subscriptionCurrency,
-		&config.AutoFetchInterval, &autoFetchEnabled, &config.UpdatedAt)
-
-	config.AutoFetchEnabled = autoFetchEnabled == 1
-	if subscriptionAmount.Valid {
-		config.SubscriptionAmount = subscriptionAmount.Float64
+// 发送一份摘要：该标记已发送过则跳过，失败后记录尝试时间并按指数退避重试
+func sendDigestOnce(settings *EmailSettings, stateKey, marker, label string, now time.Time, build func() (*DigestData, error)) {
+	if last, _ := getAppState(stateKey); last == marker {
+		return
 	}
-	if subscriptionCurrency.Valid && subscriptionCurrency.String != "" {
-		config.SubscriptionCurrency = subscriptionCurrency.String
-	} else {
-		config.SubscriptionCurrency = "USD"
+	attempt := loadDigestAttempt(stateKey, marker)
+	if now.Before(attempt.nextAttempt()) {
+		return
 	}
 
-	if err == sql.ErrNoRows {
-		// 返回空配置
-		c.JSON(http.StatusOK, Config{
-			Revision:             "59988163982a4ac4be7c7e7784f006dc48cafcf5",
-			TagID:                "8a0df086c2034f5e97dcb01c426029ee",
-			SubscriptionDay:      1,
-			SubscriptionAmount:   0,
-			SubscriptionCurrency: "USD",
-			AutoFetchInterval:    30,
-			AutoFetchEnabled:     false,
-		})
+	digest, err := build()
+	if err == nil {
+		err = sendDigest(settings, digest)
+	}
+	if err != nil {
+		attempt.Failures++
+		attempt.LastAttempt = now.Unix()
+		if data, mErr := json.Marshal(attempt); mErr == nil {
+			setAppState(stateKey+"_attempt", string(data))
+		}
+		log.Printf("Failed to send %s (attempt %d, next retry after %s): %v",
+			label, attempt.Failures, attempt.nextAttempt().Format("2006-01-02 15:04:05"), err)
 		return
 	}
+	setAppState(stateKey, marker)
+	log.Printf("Sent %s", label)
+}
 
+// 检查是否到了发送每日摘要或周期总结的时间
+func checkEmailDigests(now time.Time) {
+	settings, err := loadEmailSettings()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		log.Printf("Failed to load email settings: %v", err)
 		return
 	}
 
-	c.JSON(http.StatusOK, config)
+	if settings.DailyEnabled && now.Hour() >= settings.DailyHour {
+		sendDigestOnce(settings, emailDailyStateKey, now.Format("2006-01-02"), "daily digest", now,
+			func() (*DigestData, error) { return buildDailyDigest(now.AddDate(0, 0, -1)) })
+	}
+
+	if settings.CycleEnabled {
+		previousStart, _ := getPlanPeriodByOffset(-1)
+		sendDigestOnce(settings, emailCycleStateKey, fmt.Sprintf("%d", previousStart), "cycle summary", now,
+			func() (*DigestData, error) { return buildCycleDigest(-1) })
+	}
 }
 
-// 内部辅助函数：保存配置到数据库（处理插入或更新）
-func upsertConfig(cookie, formKey, tchannel, revision, tagID string, subscriptionDay int, subscriptionAmount float64, subscriptionCurrency string, autoFetchInterval, autoFetchEnabled int) error {
-	var existingID int
-	err := db.QueryRow("SELECT id FROM config ORDER BY id DESC LIMIT 1").Scan(&existingID)
+// 启动邮件摘要定时检查，关闭服务时退出
+func startEmailDigestScheduler() {
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				checkEmailDigests(now)
+			case <-appCtx.Done():
+				return
+			}
+		}
+	}()
+}
 
+// 获取邮件设置（不返回密码）
+func getEmailSettings(c *gin.Context) {
+	settings, err := loadEmailSettings()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			// 不存在配置，执行插入
-			_, err = db.Exec(`
-				INSERT INTO config (cookie, form_key, tchannel, revision, tag_id, subscription_day, 
-				                    subscription_amount, subscription_currency,
-				                    auto_fetch_interval, auto_fetch_enabled, updated_at)
-				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-			`, cookie, formKey, tchannel, revision, tagID, subscriptionDay, subscriptionAmount, subscriptionCurrency, autoFetchInterval, autoFetchEnabled, time.Now())
-		}
-		// 如果是其他错误，直接返回
-		return err
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-
-	// 存在配置，执行更新
-	_, err = db.Exec(`
-		UPDATE config 
-		SET cookie = ?, form_key = ?, tchannel = ?, revision = ?, tag_id = ?, 
-		    subscription_day = ?, subscription_amount = ?, subscription_currency = ?,
-		    auto_fetch_interval = ?, auto_fetch_enabled = ?, updated_at = ?
-		WHERE id = ?
-	`, cookie, formKey, tchannel, revision, tagID, subscriptionDay, subscriptionAmount, subscriptionCurrency, autoFetchInterval, autoFetchEnabled, time.Now(), existingID)
-
-	return err
+	settings.Password = ""
+	c.JSON(http.StatusOK, settings)
 }
 
-// 保存/更新配置
-func saveConfig(c *gin.Context) {
-	var input struct {
-		Cookie               string  `json:"cookie"`
-		FormKey              string  `json:"form_key"`
-		TChannel             string  `json:"tchannel"`
-		Revision             string  `json:"revision"`
-		TagID                string  `json:"tag_id"`
-		SubscriptionDay      int     `json:"subscription_day"`
-		SubscriptionAmount   float64 `json:"subscription_amount"`
-		SubscriptionCurrency string  `json:"subscription_currency"`
-		AutoFetchInterval    int     `json:"auto_fetch_interval"`
-		AutoFetchEnabled     bool    `json:"auto_fetch_enabled"`
+// 保存邮件设置（密码为空时保留原密码）
+func saveEmailSettings(c *gin.Context) {
+	existing, err := loadEmailSettings()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
+	input := *existing
+	input.Password = ""
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if input.Password == "" {
+		input.Password = existing.Password
+	}
 
-	// 默认货币为 USD
-	if input.SubscriptionCurrency == "" {
-		input.SubscriptionCurrency = "USD"
+	switch input.TLSMode {
+	case "":
+		input.TLSMode = "none"
+	case "none", "starttls", "tls":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tls_mode must be none, starttls or tls"})
+		return
+	}
+	if input.SMTPPort <= 0 || input.SMTPPort > 65535 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid smtp_port"})
+		return
+	}
+	if input.DailyHour < 0 || input.DailyHour > 23 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "daily_hour must be between 0 and 23"})
+		return
+	}
+	// 地址可以留空（暂不发送），填写时必须能解析
+	if input.FromAddress != "" {
+		if _, err := input.fromAddress(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if _, err := input.recipientList(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	autoFetchEnabledInt := 0
-	if input.AutoFetchEnabled {
-		autoFetchEnabledInt = 1
+	dailyEnabled, cycleEnabled := 0, 0
+	if input.DailyEnabled {
+		dailyEnabled = 1
+	}
+	if input.CycleEnabled {
+		cycleEnabled = 1
 	}
 
-	// 使用统一的保存逻辑
-	if err := upsertConfig(input.Cookie, input.FormKey, input.TChannel, input.Revision, input.TagID,
-		input.SubscriptionDay, input.SubscriptionAmount, input.SubscriptionCurrency,
-		input.AutoFetchInterval, autoFetchEnabledInt); err != nil {
+	_, err = db.Exec(`
+		INSERT OR REPLACE INTO email_settings
+			(id, smtp_host, smtp_port, tls_mode, username, password, from_address, recipients,
+			 daily_enabled, daily_hour, cycle_enabled, updated_at)
+		VALUES (1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, input.SMTPHost, input.SMTPPort, input.TLSMode, input.Username, input.Password, input.FromAddress,
+		input.Recipients, dailyEnabled, input.DailyHour, cycleEnabled, time.Now())
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// 重启自动拉取定时器
-	restartAutoFetchTimer()
-
-	c.JSON(http.StatusOK, gin.H{"message": "配置已保存"})
+	c.JSON(http.StatusOK, gin.H{"message": "邮件设置已保存"})
 }
 
-// 获取布局配置
-func getLayoutConfig(c *gin.Context) {
-	var sidebarWidth int
-	var gridLayout sql.NullString
-
-	err := db.QueryRow("SELECT COALESCE(sidebar_width, 400), grid_layout FROM layout_config ORDER BY id DESC LIMIT 1").Scan(&sidebarWidth, &gridLayout)
-
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusOK, gin.H{
-			"sidebar_width": 400,
-			"grid_layout":   nil,
-		})
+// 立即发送摘要邮件（type=daily 或 cycle）
+func sendDigestNow(c *gin.Context) {
+	settings, err := loadEmailSettings()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	var digest *DigestData
+	switch c.DefaultQuery("type", "daily") {
+	case "daily":
+		digest, err = buildDailyDigest(time.Now().AddDate(0, 0, -1))
+	case "cycle":
+		digest, err = buildCycleDigest(-1)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be daily or cycle"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	var layout interface{}
-	if gridLayout.Valid && gridLayout.String != "" {
-		json.Unmarshal([]byte(gridLayout.String), &layout)
+	if err := sendDigest(settings, digest); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"sidebar_width": sidebarWidth,
-		"grid_layout":   layout,
-	})
+	c.JSON(http.StatusOK, gin.H{"message": "摘要邮件已发送"})
 }
 
-// 保存布局配置
-func saveLayoutConfig(c *gin.Context) {
-	var input struct {
-		SidebarWidth *int        `json:"sidebar_width"`
-		GridLayout   interface{} `json:"grid_layout"`
+// 创建访问 Poe API 的 HTTP 客户端
+func newPoeClient() *http.Client {
+	return &http.Client{
+		Timeout:   poeRequestTimeout,
+		Transport: instrumentedTransport{base: http.DefaultTransport},
 	}
+}
 
-	if err := c.ShouldBindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+const (
+	poeRequestTimeout = 30 * time.Second // 单次 Poe 请求（含读取响应体）的超时
+	poeMaxAttempts    = 4                // 网络错误、429 和 5xx 的最大尝试次数
+	poeBaseBackoff    = 1 * time.Second
+	poeMaxBackoff     = 30 * time.Second
+	poeMaxRetryAfter  = 5 * time.Minute // Retry-After 超过该值时不再等待，直接返回
+	autoFetchMaxPages = 10              // 自动拉取单次最多请求的页数，剩余部分留给下次
+)
 
-	// 获取现有配置
-	var currentWidth int
-	var currentLayout sql.NullString
-	db.QueryRow("SELECT COALESCE(sidebar_width, 400), grid_layout FROM layout_config ORDER BY id DESC LIMIT 1").Scan(&currentWidth, &currentLayout)
+// 令牌桶限流器
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // 每秒补充的令牌数
+	burst  float64
+	tokens float64
+	last   time.Time
+}
 
-	newWidth := currentWidth
-	if input.SidebarWidth != nil {
-		newWidth = *input.SidebarWidth
-		// 限制宽度范围
-		if newWidth < 300 {
-			newWidth = 300
-		}
-		if newWidth > 600 {
-			newWidth = 600
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// 等待直到取得一个令牌或 ctx 结束
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
 		}
-	}
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
 
-	newLayout := currentLayout.String
-	if input.GridLayout != nil {
-		layoutBytes, _ := json.Marshal(input.GridLayout)
-		newLayout = string(layoutBytes)
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
 	}
+}
 
-	_, err := db.Exec("INSERT OR REPLACE INTO layout_config (id, sidebar_width, grid_layout, updated_at) VALUES (1, ?, ?, ?)",
-		newWidth, newLayout, time.Now())
+// 所有 Poe 请求共享的限流器：平均每秒 1 个请求，允许 2 个突发
+var poeLimiter = newTokenBucket(1, 2)
 
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+// 解析 Retry-After（秒数或 HTTP 日期）
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "布局已保存"})
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
 }
 
-// 接收前端日志
-func logFrontend(c *gin.Context) {
-	var logEntry struct {
-		Timestamp string      `json:"timestamp"`
-		Level     string      `json:"level"`
-		Message   string      `json:"message"`
-		Data      interface{} `json:"data"`
+// 第 attempt 次失败后的退避时间：指数增长，在 [d/2, d) 内随机抖动
+func poeBackoff(attempt int) time.Duration {
+	d := poeBaseBackoff << uint(attempt-1)
+	if d <= 0 || d > poeMaxBackoff {
+		d = poeMaxBackoff
 	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
 
-	if err := c.ShouldBindJSON(&logEntry); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+// 发送 Poe 请求并读完响应体（返回前关闭）。每次尝试前经过限流器，
+// 网络错误、429 和 5xx 按指数退避重试，响应带 Retry-After 时优先遵循；
+// 重试耗尽后返回最后一次的响应，由调用方检查状态码
+func doPoeRequest(req *http.Request) (*http.Response, []byte, error) {
+	ctx := req.Context()
+	queryName := req.Header.Get("poe-queryname")
 
-	// 写入日志文件
-	if frontendLogFile != nil {
-		logLine := fmt.Sprintf("[%s] [%s] %s", logEntry.Timestamp, logEntry.Level, logEntry.Message)
-		if logEntry.Data != nil {
-			dataJSON, _ := json.Marshal(logEntry.Data)
-			logLine += fmt.Sprintf(" | Data: %s", string(dataJSON))
+	for attempt := 1; ; attempt++ {
+		if err := poeLimiter.wait(ctx); err != nil {
+			return nil, nil, err
 		}
-		logLine += "\n"
 
-		frontendLogFile.WriteString(logLine)
-		frontendLogFile.Sync() // 立即刷新到磁盘
-	}
+		resp, body, err := doPoeAttempt(req)
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
 
-	c.JSON(http.StatusOK, gin.H{"status": "logged"})
-}
+		var reason string
+		delay := poeBackoff(attempt)
+		switch {
+		case err != nil:
+			reason = err.Error()
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			reason = fmt.Sprintf("status %d", resp.StatusCode)
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				if retryAfter > poeMaxRetryAfter {
+					return resp, body, nil
+				}
+				delay = retryAfter
+			}
+		default:
+			return resp, body, nil
+		}
+		if attempt >= poeMaxAttempts {
+			return resp, body, err
+		}
 
-// 获取自动拉取状态
-func getAutoFetchStatus(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"is_running":        isAutoFetching,
-		"last_fetch_time":   lastAutoFetchTime,
-		"last_fetch_result": lastAutoFetchResult,
-	})
+		log.Printf("Poe %s attempt %d failed (%s), retrying in %s", queryName, attempt, reason, delay.Round(time.Millisecond))
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, nil, err
+		}
+	}
 }
 
-// 获取订阅费用统计信息
-func getSubscriptionCostInfo(c *gin.Context) {
-	// 获取配置
-	var subscriptionDay int
-	var subscriptionAmount float64
-	var subscriptionCurrency string
-	err := db.QueryRow(`
-		SELECT COALESCE(subscription_day, 1), COALESCE(subscription_amount, 0), COALESCE(subscription_currency, 'USD')
-		FROM config ORDER BY id DESC LIMIT 1
-	`).Scan(&subscriptionDay, &subscriptionAmount, &subscriptionCurrency)
+// 单次尝试，使用独立的超时并重新生成请求体
+func doPoeAttempt(req *http.Request) (*http.Response, []byte, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), poeRequestTimeout)
+	defer cancel()
 
-	if err != nil && err != sql.ErrNoRows {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	attempt := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, nil, err
+		}
+		attempt.Body = body
 	}
 
-	// 计算当前订阅周期
-	now := time.Now()
-	year := now.Year()
-	month := int(now.Month())
-	if now.Day() < subscriptionDay {
-		month--
-		if month < 1 {
-			month = 12
-			year--
+	resp, err := newPoeClient().Do(attempt)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// 派生同时受 parent 和服务关闭控制的上下文
+func withAppCancel(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(appCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// 可被取消的等待，ctx 结束时返回其错误
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 构建信息；未通过 -ldflags 注入提交号时尝试读取 Go 工具链记录的 VCS 信息
+func buildInfo() gin.H {
+	rev := commit
+	if rev == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "vcs.revision" {
+					rev = setting.Value
+				}
+			}
 		}
 	}
-	periodStart, periodEnd := getSubscriptionPeriod(year, month, subscriptionDay)
+	if rev == "" {
+		rev = "unknown"
+	}
+	return gin.H{
+		"version":        version,
+		"commit":         rev,
+		"build_date":     buildDate,
+		"go_version":     runtime.Version(),
+		"schema_version": schemaVersion(),
+	}
+}
 
-	// 获取本周期的总积分消耗
-	var totalPointsUsed int
-	db.QueryRow(`
-		SELECT COALESCE(SUM(point_cost), 0)
-		FROM points_history
-		WHERE creation_time >= ? AND creation_time < ?
-	`, periodStart, periodEnd).Scan(&totalPointsUsed)
+// 存活检查：进程能响应即可
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// 单项就绪检查结果，status 为 ok、fail 或 skipped
+type readinessCheck struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
 
-	// 将订阅费用转换为美元
-	subscriptionAmountUSD := convertToUSD(subscriptionAmount, subscriptionCurrency)
+// 就绪检查：数据库可用、迁移已应用、自动拉取定时器与配置一致、最近一次成功同步不过旧。
+// 同步时效阈值默认为自动拉取间隔的 3 倍加静默时段（cron 模式无默认值），可用 max_sync_age（分钟）覆盖；
+// 进程启动后尚未成功同步时从启动时间开始计算
+func readyz(c *gin.Context) {
+	checks := map[string]readinessCheck{}
+	ready := true
+	fail := func(name, format string, args ...interface{}) {
+		checks[name] = readinessCheck{Status: "fail", Message: fmt.Sprintf(format, args...)}
+		ready = false
+	}
 
-	// 获取用户积分信息以计算积分对应的美元价值
-	// Poe 的积分兑换比例：根据订阅类型，一般是 1M 积分 = 订阅费用
-	// 我们使用配置的订阅费用和积分总额来计算单积分价值
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
 
-	// 获取用户的总积分配额（如果有）
-	var totalAllotment int64
-	totalAllotment = 1000000 // 默认 100 万积分
+	var userVersion int
+	if err := db.PingContext(ctx); err != nil {
+		fail("database", "%v", err)
+		checks["migrations"] = readinessCheck{Status: "skipped"}
+	} else {
+		checks["database"] = readinessCheck{Status: "ok"}
+		if schemaErr != nil {
+			fail("migrations", "%v", schemaErr)
+		} else if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&userVersion); err != nil {
+			fail("migrations", "%v", err)
+		} else if userVersion < schemaVersion() {
+			fail("migrations", "schema version %d, expected %d", userVersion, schemaVersion())
+		} else if userVersion > schemaVersion() {
+			fail("migrations", "schema version %d is newer than this build (%d)", userVersion, schemaVersion())
+		} else {
+			checks["migrations"] = readinessCheck{Status: "ok", Message: fmt.Sprintf("schema version %d", userVersion)}
+		}
+	}
 
-	// 计算每积分对应的美元价值
-	pointValueUSD := subscriptionAmountUSD / float64(totalAllotment)
+	var enabled int
+	timer := scheduler.status()
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(auto_fetch_enabled, 0) FROM config ORDER BY id DESC LIMIT 1").Scan(&enabled)
+	switch {
+	case err != nil && err != sql.ErrNoRows:
+		fail("auto_fetch", "%v", err)
+	case enabled == 1 && timer.Mode == "":
+		fail("auto_fetch", "enabled in config but timer is not running")
+	case enabled == 1 && timer.NextRunTime == nil:
+		fail("auto_fetch", "%s schedule has no upcoming run", timer.Mode)
+	case enabled == 1:
+		checks["auto_fetch"] = readinessCheck{Status: "ok", Message: fmt.Sprintf("%s mode, next run %s", timer.Mode, timer.NextRunTime.Format(time.RFC3339))}
+	default:
+		checks["auto_fetch"] = readinessCheck{Status: "ok", Message: "disabled"}
+	}
 
-	// 计算已使用积分对应的美元价值
-	usedPointsValueUSD := float64(totalPointsUsed) * pointValueUSD
+	maxAge := scheduler.staleAfter()
+	if v := c.Query("max_sync_age"); v != "" {
+		minutes, err := strconv.Atoi(v)
+		if err != nil || minutes <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "max_sync_age must be a positive number of minutes"})
+			return
+		}
+		maxAge = time.Duration(minutes) * time.Minute
+	}
+	lastSuccess := appMetrics.lastSyncSuccess()
+	since := lastSuccess
+	if since.IsZero() {
+		since = processStartTime
+	}
+	age := time.Since(since).Round(time.Second)
+	switch {
+	case maxAge == 0:
+		checks["last_sync"] = readinessCheck{Status: "skipped", Message: "no default threshold for this schedule and no max_sync_age given"}
+	case age > maxAge:
+		fail("last_sync", "last successful sync %s ago exceeds %s", age, maxAge)
+	case lastSuccess.IsZero():
+		checks["last_sync"] = readinessCheck{Status: "ok", Message: fmt.Sprintf("no sync yet, started %s ago", age)}
+	default:
+		checks["last_sync"] = readinessCheck{Status: "ok", Message: fmt.Sprintf("%s ago", age)}
+	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"subscription_day":        subscriptionDay,
-		"subscription_amount":     subscriptionAmount,
-		"subscription_currency":   subscriptionCurrency,
-		"subscription_amount_usd": subscriptionAmountUSD,
-		"period_start":            periodStart,
-		"period_end":              periodEnd,
-		"total_points_used":       totalPointsUsed,
-		"point_value_usd":         pointValueUSD,
-		"used_points_value_usd":   usedPointsValueUSD,
-		"currency_rates":          currencyRates,
-	})
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not_ready", http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{"status": status, "checks": checks})
+}
+
+// 版本信息
+func getVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, buildInfo())
 }
 
 // 执行自动增量拉取
 func performAutoFetch() {
-	if isAutoFetching {
-		log.Println("Auto fetch already in progress, skipping...")
+	started := time.Now()
+	outcome := "error"
+	newRecords := 0
+	defer func() { appMetrics.recordSync("auto", outcome, started, newRecords) }()
+
+	if appCtx.Err() != nil {
+		outcome = "skipped"
 		return
 	}
-
-	isAutoFetching = true
-	defer func() { isAutoFetching = false }()
+	release, ok := scheduler.acquire("auto")
+	if !ok {
+		log.Println("Sync already in progress, skipping auto fetch...")
+		outcome = "skipped"
+		return
+	}
+	defer release()
+	backgroundTasks.Add(1)
+	defer backgroundTasks.Done()
 
 	log.Println("Starting auto fetch...")
-	lastAutoFetchTime = time.Now()
+	result := ""
+	defer func() { scheduler.finish(result, newRecords, outcome == "success") }()
 
 	// 从数据库获取配置
 	var config Config
@@ -1171,40 +7546,39 @@ func performAutoFetch() {
 		&config.Revision, &config.TagID, &config.SubscriptionDay, &autoFetchEnabled)
 
 	if err != nil || autoFetchEnabled == 0 {
-		lastAutoFetchResult = "Disabled or no config"
+		result = "Disabled or no config"
 		log.Println("Auto fetch disabled or no config")
+		outcome = "skipped"
 		return
 	}
 
 	if config.Cookie == "" || config.FormKey == "" || config.TChannel == "" {
-		lastAutoFetchResult = "Invalid config"
+		result = "Invalid config"
 		log.Println("Auto fetch: invalid config")
 		return
 	}
 
-	// 计算当前订阅周期的开始时间
-	now := time.Now()
-	currentDay := now.Day()
-	year := now.Year()
-	month := int(now.Month())
+	// 当前订阅周期的开始时间（按生效的订阅方案）
+	subscriptionStartMicros, _ := getPlanPeriodByOffset(0)
 
-	if currentDay < config.SubscriptionDay {
-		month--
-		if month < 1 {
-			month = 12
-			year--
-		}
+	// 执行增量拉取，服务关闭时中断
+	ctx := appCtx
+	abortCanceled := func() {
+		result = fmt.Sprintf("Canceled: %d new records", newRecords)
+		log.Printf("Auto fetch canceled after %d new records: %v", newRecords, ctx.Err())
+		outcome = "canceled"
 	}
-
-	subscriptionStartTime := time.Date(year, time.Month(month), config.SubscriptionDay, 0, 0, 0, 0, time.Local)
-	subscriptionStartMicros := subscriptionStartTime.UnixMicro()
-
-	// 执行增量拉取
-	newRecords := 0
 	cursor := ""
 	reachedSubscriptionStart := false
 
-	for i := 0; i < 10; i++ { // 最多拉取 10 页，避免无限循环
+	// 上次中断或达到页数上限留下的续传游标，在本次增量部分完成后依次继续
+	pending := loadResumeCursors()
+	resuming := false
+	saveProgress := func() {
+		pending = saveSyncProgress(pending, resuming, cursor)
+	}
+
+	for page := 1; ; page++ {
 		requestBody := map[string]interface{}{
 			"queryName": "PointsHistoryPageColumnViewerPaginationQuery",
 			"variables": map[string]interface{}{
@@ -1220,7 +7594,7 @@ func performAutoFetch() {
 		}
 
 		jsonBody, _ := json.Marshal(requestBody)
-		req, _ := http.NewRequest("POST", "https://poe.com/api/gql_POST", strings.NewReader(string(jsonBody)))
+		req, _ := http.NewRequestWithContext(ctx, "POST", poeBaseURL+"/api/gql_POST", strings.NewReader(string(jsonBody)))
 
 		req.Header.Set("accept", "*/*")
 		req.Header.Set("content-type", "application/json")
@@ -1232,21 +7606,52 @@ func performAutoFetch() {
 		req.Header.Set("poe-queryname", "PointsHistoryPageColumnViewerPaginationQuery")
 		req.Header.Set("poegraphql", "1")
 
-		client := &http.Client{Timeout: 30 * time.Second}
-		resp, err := client.Do(req)
+		resp, body, err := doPoeRequest(req)
+		if err != nil {
+			saveProgress()
+		}
+		if err != nil && ctx.Err() != nil {
+			abortCanceled()
+			return
+		}
 		if err != nil {
-			lastAutoFetchResult = fmt.Sprintf("Error: %v", err)
+			result = fmt.Sprintf("Error: %v", err)
 			log.Printf("Auto fetch error: %v", err)
+			notifySyncFailure("auto", 0, result, newRecords)
 			return
 		}
 
-		body, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			saveProgress()
+		}
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			result = fmt.Sprintf("Credentials expired (status %d)", resp.StatusCode)
+			log.Printf("Auto fetch: %s", result)
+			notifySyncFailure("auto", resp.StatusCode, result, newRecords)
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			result = fmt.Sprintf("HTTP status %d", resp.StatusCode)
+			log.Printf("Auto fetch: %s", result)
+			notifySyncFailure("auto", resp.StatusCode, result, newRecords)
+			return
+		}
 
 		var poeResp PoeResponse
 		if err := json.Unmarshal(body, &poeResp); err != nil {
-			lastAutoFetchResult = fmt.Sprintf("Parse error: %v", err)
+			saveProgress()
+			appMetrics.recordAPIParseError("PointsHistoryPageColumnViewerPaginationQuery")
+			result = fmt.Sprintf("Parse error: %v", err)
 			log.Printf("Auto fetch parse error: %v", err)
+			notifySyncFailure("auto", 0, result, newRecords)
+			return
+		}
+		if err := poeResp.validate(); err != nil {
+			saveProgress()
+			appMetrics.recordAPIParseError("PointsHistoryPageColumnViewerPaginationQuery")
+			result = err.Error()
+			log.Printf("Auto fetch: %v", err)
+			notifySyncFailure("auto", 0, result, newRecords)
 			return
 		}
 
@@ -1278,56 +7683,528 @@ func performAutoFetch() {
 			}
 		}
 
-		if foundDuplicate || reachedSubscriptionStart || !poeResp.Data.Viewer.PointsHistoryConnection.PageInfo.HasNextPage {
-			break
+		pageInfo := poeResp.Data.Viewer.PointsHistoryConnection.PageInfo
+		if foundDuplicate || reachedSubscriptionStart || !pageInfo.HasNextPage {
+			if resuming {
+				if len(poeResp.Data.Viewer.PointsHistoryConnection.Edges) == 0 {
+					// 续传页没有任何记录，游标可能已失效，保留到下次重试，超过次数后丢弃
+					log.Printf("Auto fetch: saved cursor returned an empty page, keeping it for retry")
+					saveProgress()
+					recordEmptyResume(pending)
+					break
+				}
+				pending = pending[1:]
+			}
+			if len(pending) == 0 || page >= autoFetchMaxPages {
+				break
+			}
+			resuming, cursor = true, startResume(pending)
+			reachedSubscriptionStart = false
+			continue
 		}
 
-		cursor = poeResp.Data.Viewer.PointsHistoryConnection.PageInfo.EndCursor
-		time.Sleep(1 * time.Second)
+		// 请求间隔由 poeLimiter 控制
+		cursor = pageInfo.EndCursor
+		if page >= autoFetchMaxPages {
+			// 达到单次页数上限，剩余部分留给下次同步
+			saveProgress()
+			break
+		}
+	}
+	if err := saveResumeCursors(pending); err != nil {
+		log.Printf("Failed to save resume cursor: %v", err)
 	}
 
-	lastAutoFetchResult = fmt.Sprintf("Success: %d new records", newRecords)
+	result = fmt.Sprintf("Success: %d new records", newRecords)
 	log.Printf("Auto fetch completed: %d new records", newRecords)
+	outcome = "success"
+
+	afterSync(newRecords)
+}
+
+// 五段 cron 表达式（分 时 日 月 周），每段支持 *、数字、a-b、逗号列表和 /步长，周日为 0 或 7
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+// 解析 cron 单个字段为位集合
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			a, errA := strconv.Atoi(bounds[0])
+			b, errB := strconv.Atoi(bounds[1])
+			if errA != nil || errB != nil || a > b {
+				return 0, fmt.Errorf("invalid range %q", rangePart)
+			}
+			lo, hi = a, b
+		default:
+			n, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", rangePart)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = max // "5/15" 表示从 5 开始每 15
+			}
+		}
+		if lo < min || hi > max {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression must have 5 fields (minute hour day month weekday)")
+	}
+
+	var s cronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+
+	if s.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron expression never matches")
+	}
+	return &s, nil
+}
+
+// 日期是否匹配；日与周都有限制时满足其一即可（与标准 cron 一致）
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// 是否有落在静默时段之外的匹配时刻。静默时段只与时刻有关，
+// 而 parseCron 已保证日期可以匹配，因此只需检查小时×分钟
+func (s *cronSchedule) matchesOutside(q *quietHours) bool {
+	for h := 0; h < 24; h++ {
+		if s.hour&(1<<uint(h)) == 0 {
+			continue
+		}
+		for m := 0; m < 60; m++ {
+			if s.minute&(1<<uint(m)) != 0 && !q.containsMinute(h*60+m) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// after 之后（不含）的第一个匹配时间，5 年内无匹配时返回零值
+func (s *cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// 静默时段 HH:MM-HH:MM（本地时间，可跨午夜），期间不执行自动拉取
+type quietHours struct {
+	start, end int // 一天中的分钟数
+}
+
+func parseQuietHours(spec string) (*quietHours, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	parts := strings.Split(spec, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("quiet_hours must look like 23:00-07:00")
+	}
+	var q quietHours
+	for i, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return nil, fmt.Errorf("quiet_hours must look like 23:00-07:00")
+		}
+		m := t.Hour()*60 + t.Minute()
+		if i == 0 {
+			q.start = m
+		} else {
+			q.end = m
+		}
+	}
+	if q.start == q.end {
+		return nil, fmt.Errorf("quiet_hours start and end must differ")
+	}
+	return &q, nil
+}
+
+func (q *quietHours) contains(t time.Time) bool {
+	return q.containsMinute(t.Hour()*60 + t.Minute())
+}
+
+// m 为一天中的分钟数
+func (q *quietHours) containsMinute(m int) bool {
+	if q.start < q.end {
+		return m >= q.start && m < q.end
+	}
+	return m >= q.start || m < q.end
 }
 
-// 启动自动拉取定时器
-func startAutoFetchTimer(interval int) {
-	if autoFetchTicker != nil {
-		autoFetchTicker.Stop()
+// t 之后最近的静默结束时间
+func (q *quietHours) endAfter(t time.Time) time.Time {
+	end := time.Date(t.Year(), t.Month(), t.Day(), q.end/60, q.end%60, 0, 0, t.Location())
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
 	}
+	return end
+}
+
+// 静默时段长度
+func (q *quietHours) duration() time.Duration {
+	minutes := q.end - q.start
+	if minutes < 0 {
+		minutes += 24 * 60
+	}
+	return time.Duration(minutes) * time.Minute
+}
 
+const (
+	autoFetchModeInterval = "interval"
+	autoFetchModeCron     = "cron"
+	autoFetchModeAdaptive = "adaptive"
+
+	// 自适应模式：单次拉取达到该数量（约一页）视为繁忙，间隔减半；无新记录时间隔加倍
+	adaptiveBusyRecords = 20
+)
+
+// 自动拉取计划，由配置解析得到
+type fetchPlan struct {
+	mode        string
+	cronExpr    string
+	quietSpec   string
+	interval    int // interval 模式的固定间隔 / adaptive 模式的初始间隔（分钟）
+	cron        *cronSchedule
+	quiet       *quietHours
+	adaptiveMin int
+	adaptiveMax int
+}
+
+// 校验配置并生成计划
+func newFetchPlan(mode string, interval int, cronExpr, quiet string, adaptiveMin, adaptiveMax int) (*fetchPlan, error) {
 	if interval <= 0 {
 		interval = 30 // 默认 30 分钟
 	}
+	p := &fetchPlan{mode: mode, interval: interval, quietSpec: quiet, adaptiveMin: adaptiveMin, adaptiveMax: adaptiveMax}
+
+	switch mode {
+	case "", autoFetchModeInterval:
+		p.mode = autoFetchModeInterval
+	case autoFetchModeCron:
+		c, err := parseCron(cronExpr)
+		if err != nil {
+			return nil, err
+		}
+		p.cron, p.cronExpr = c, cronExpr
+	case autoFetchModeAdaptive:
+		if p.adaptiveMin <= 0 {
+			p.adaptiveMin = 5
+		}
+		if p.adaptiveMax <= 0 {
+			p.adaptiveMax = 120
+		}
+		if p.adaptiveMin > p.adaptiveMax {
+			return nil, fmt.Errorf("adaptive_min_interval must not exceed adaptive_max_interval")
+		}
+		p.interval = clampInt(p.interval, p.adaptiveMin, p.adaptiveMax)
+	default:
+		return nil, fmt.Errorf("auto_fetch_mode must be interval, cron or adaptive")
+	}
 
-	autoFetchTicker = time.NewTicker(time.Duration(interval) * time.Minute)
-	autoFetchStop = make(chan bool)
+	q, err := parseQuietHours(quiet)
+	if err != nil {
+		return nil, err
+	}
+	if p.cron != nil && q != nil && !p.cron.matchesOutside(q) {
+		return nil, fmt.Errorf("cron expression %q only matches during quiet hours %s", cronExpr, quiet)
+	}
+	p.quiet = q
+	return p, nil
+}
 
-	go func() {
-		for {
-			select {
-			case <-autoFetchTicker.C:
-				performAutoFetch()
-			case <-autoFetchStop:
-				return
-			}
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// 计算 now 之后的下一次执行时间，interval 为当前间隔（adaptive 模式会动态调整）
+func (p *fetchPlan) nextRun(now time.Time, interval int) time.Time {
+	next := now.Add(time.Duration(interval) * time.Minute)
+	if p.cron != nil {
+		next = p.cron.next(now)
+	}
+	if p.quiet == nil {
+		return next
+	}
+	// 落在静默时段内则推迟到静默结束（cron 模式取结束后的第一个匹配时间）
+	for i := 0; i < 8 && !next.IsZero() && p.quiet.contains(next); i++ {
+		end := p.quiet.endAfter(next)
+		if p.cron == nil {
+			return end
 		}
-	}()
+		next = p.cron.next(end.Add(-time.Minute))
+	}
+	return next
+}
+
+// 自动拉取调度器：计划、定时器状态和同步锁。同步锁由自动、手动拉取以及导入、合并共享，同一时间只允许一个写入
+type autoFetchScheduler struct {
+	syncMu sync.Mutex // 单飞同步锁
+
+	mu         sync.Mutex // 保护以下字段
+	plan       *fetchPlan // nil 表示定时器已停止
+	interval   int        // 当前间隔（分钟），adaptive 模式下随拉取结果调整
+	nextRun    time.Time
+	stop       chan struct{}
+	running    string // 正在执行的同步触发方式（auto/manual/import/merge），空表示空闲
+	lastRun    time.Time
+	lastResult string
+	lastNew    int
+}
+
+var scheduler = &autoFetchScheduler{}
+
+// 调度器状态
+type AutoFetchStatus struct {
+	State           string     `json:"state"`      // stopped, scheduled, running
+	IsRunning       bool       `json:"is_running"` // 是否有同步（自动或手动）正在执行
+	RunningTrigger  string     `json:"running_trigger,omitempty"`
+	Mode            string     `json:"mode,omitempty"`
+	Cron            string     `json:"cron,omitempty"`
+	QuietHours      string     `json:"quiet_hours,omitempty"`
+	IntervalMinutes int        `json:"interval_minutes"` // 当前间隔，cron 模式为 0
+	NextRunTime     *time.Time `json:"next_run_time"`
+	LastFetchTime   time.Time  `json:"last_fetch_time"`
+	LastFetchResult string     `json:"last_fetch_result"`
+	LastNewRecords  int        `json:"last_new_records"`
+}
+
+// 按计划启动或重启定时器
+func (s *autoFetchScheduler) start(plan *fetchPlan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopLocked()
 
-	log.Printf("Auto fetch timer started with %d minutes interval", interval)
+	stop := make(chan struct{})
+	s.plan, s.stop, s.interval = plan, stop, plan.interval
+	if plan.cron != nil {
+		s.interval = 0
+	}
+	s.nextRun = plan.nextRun(time.Now(), s.interval)
+
+	go s.loop(plan, stop)
+
+	log.Printf("Auto fetch timer started (%s mode), next run at %s", plan.mode, s.nextRun.Format("2006-01-02 15:04:05"))
 }
 
-// 停止自动拉取定时器
-func stopAutoFetchTimer() {
-	if autoFetchTicker != nil {
-		autoFetchTicker.Stop()
-		if autoFetchStop != nil {
-			close(autoFetchStop)
+func (s *autoFetchScheduler) loop(plan *fetchPlan, stop chan struct{}) {
+	for {
+		s.mu.Lock()
+		if s.plan != plan {
+			s.mu.Unlock()
+			return
+		}
+		wait := time.Until(s.nextRun)
+		s.mu.Unlock()
+
+		if wait < 0 {
+			wait = 0
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			performAutoFetch()
+		case <-stop:
+			timer.Stop()
+			return
+		}
+
+		s.mu.Lock()
+		if s.plan == plan {
+			s.nextRun = plan.nextRun(time.Now(), s.interval)
 		}
+		s.mu.Unlock()
+	}
+}
+
+// 停止定时器（可重复调用），不影响正在执行的同步
+func (s *autoFetchScheduler) stopTimer() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopLocked() {
 		log.Println("Auto fetch timer stopped")
 	}
 }
 
+func (s *autoFetchScheduler) stopLocked() bool {
+	if s.plan == nil {
+		return false
+	}
+	close(s.stop)
+	s.plan, s.stop, s.interval, s.nextRun = nil, nil, 0, time.Time{}
+	return true
+}
+
+// 尝试获取同步锁，已有同步在执行时返回 false；成功时返回的函数用于释放
+func (s *autoFetchScheduler) acquire(trigger string) (func(), bool) {
+	if !s.syncMu.TryLock() {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	s.running = trigger
+	if trigger == "auto" {
+		s.lastRun = time.Now()
+	}
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		s.running = ""
+		s.mu.Unlock()
+		s.syncMu.Unlock()
+	}, true
+}
+
+// 记录最近一次自动拉取的结果；adaptive 模式据此调整间隔，
+// 只有成功且无新记录时才放慢，失败（凭据过期、网络错误等）不影响间隔
+func (s *autoFetchScheduler) finish(result string, newRecords int, succeeded bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastResult = result
+	s.lastNew = newRecords
+
+	if s.plan == nil || s.plan.mode != autoFetchModeAdaptive {
+		return
+	}
+	switch {
+	case newRecords >= adaptiveBusyRecords:
+		s.interval = clampInt(s.interval/2, s.plan.adaptiveMin, s.plan.adaptiveMax)
+	case newRecords == 0 && succeeded:
+		s.interval = clampInt(s.interval*2, s.plan.adaptiveMin, s.plan.adaptiveMax)
+	}
+}
+
+// 定时器是否在运行
+func (s *autoFetchScheduler) active() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.plan != nil
+}
+
+// 默认的同步过期阈值：3 个最长间隔加上静默时段；cron 模式无法推算，返回 0
+func (s *autoFetchScheduler) staleAfter() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.plan == nil || s.plan.cron != nil {
+		return 0
+	}
+	interval := s.interval
+	if s.plan.mode == autoFetchModeAdaptive {
+		interval = s.plan.adaptiveMax
+	}
+	threshold := time.Duration(3*interval) * time.Minute
+	if s.plan.quiet != nil {
+		threshold += s.plan.quiet.duration()
+	}
+	return threshold
+}
+
+func (s *autoFetchScheduler) status() AutoFetchStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := AutoFetchStatus{
+		State:           "stopped",
+		IsRunning:       s.running != "",
+		RunningTrigger:  s.running,
+		IntervalMinutes: s.interval,
+		LastFetchTime:   s.lastRun,
+		LastFetchResult: s.lastResult,
+		LastNewRecords:  s.lastNew,
+	}
+	if s.plan != nil {
+		st.State = "scheduled"
+		st.Mode, st.Cron, st.QuietHours = s.plan.mode, s.plan.cronExpr, s.plan.quietSpec
+		if !s.nextRun.IsZero() {
+			next := s.nextRun
+			st.NextRunTime = &next
+		}
+	}
+	if s.running != "" {
+		st.State = "running"
+	}
+	return st
+}
+
 // 重启自动拉取定时器
 func restartAutoFetchTimer() {
 	if db == nil {
@@ -1335,60 +8212,196 @@ func restartAutoFetchTimer() {
 		return
 	}
 
-	var autoFetchInterval int
-	var autoFetchEnabled int
+	var autoFetchInterval, autoFetchEnabled, adaptiveMin, adaptiveMax int
+	var mode, cronExpr, quiet string
 
 	err := db.QueryRow(`
-		SELECT COALESCE(auto_fetch_interval, 30), COALESCE(auto_fetch_enabled, 0)
+		SELECT COALESCE(auto_fetch_interval, 30), COALESCE(auto_fetch_enabled, 0),
+		       COALESCE(auto_fetch_mode, 'interval'), COALESCE(auto_fetch_cron, ''), COALESCE(quiet_hours, ''),
+		       COALESCE(adaptive_min_interval, 5), COALESCE(adaptive_max_interval, 120)
 		FROM config ORDER BY id DESC LIMIT 1
-	`).Scan(&autoFetchInterval, &autoFetchEnabled)
+	`).Scan(&autoFetchInterval, &autoFetchEnabled, &mode, &cronExpr, &quiet, &adaptiveMin, &adaptiveMax)
 
-	if err == nil && autoFetchEnabled == 1 {
-		startAutoFetchTimer(autoFetchInterval)
-	} else {
-		stopAutoFetchTimer()
+	if err != nil || autoFetchEnabled != 1 {
+		scheduler.stopTimer()
+		return
 	}
+
+	plan, err := newFetchPlan(mode, autoFetchInterval, cronExpr, quiet, adaptiveMin, adaptiveMax)
+	if err != nil {
+		log.Printf("Invalid auto fetch schedule, falling back to %d minute interval: %v", autoFetchInterval, err)
+		plan, _ = newFetchPlan(autoFetchModeInterval, autoFetchInterval, "", "", 0, 0)
+	}
+	scheduler.start(plan)
 }
 
 func main() {
+	// 子命令
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			os.Exit(runImportCommand(os.Args[2:]))
+		case "merge":
+			os.Exit(runMergeCommand(os.Args[2:]))
+		}
+	}
+
 	port := flag.String("port", "58232", "Port to run the server on")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 15*time.Second, "How long to wait for in-flight requests and syncs on shutdown")
+	if v := os.Getenv("POE_BASE_URL"); v != "" {
+		poeBaseURL = v
+	}
+	flag.StringVar(&poeBaseURL, "poe-base-url", poeBaseURL, "Poe base URL, e.g. http://localhost:58300 for the poesim simulator")
 	flag.Parse()
+	poeBaseURL = strings.TrimRight(poeBaseURL, "/")
+	if poeBaseURL != "https://poe.com" {
+		log.Printf("Using Poe base URL %s", poeBaseURL)
+	}
 
 	initDB()
-	defer func() {
-		if db != nil {
-			db.Close()
-		}
-		if frontendLogFile != nil {
-			frontendLogFile.Close()
-		}
-	}()
 
 	r := gin.Default()
 	r.Use(CORSMiddleware())
 
-	api := r.Group("/api")
+	r.GET("/metrics", metricsHandler)
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz)
+	r.GET("/version", getVersion)
+
+	api := r.Group("/api", requireSchema)
 	{
 		api.POST("/fetch", fetchPointsHistory)
 		api.GET("/stats", getStats)
 		api.GET("/records", getLatestRecords)
 		api.GET("/history", getAllHistory)
+		api.GET("/export", exportHistory)
+		api.POST("/import", importHistoryHandler)
+		api.POST("/merge", mergeDatabaseHandler)
+		api.GET("/sync/resume-cursors", getResumeCursors)
+		api.DELETE("/sync/resume-cursors", resetResumeCursors)
+		api.GET("/accounts", getAccounts)
 		api.GET("/bot-stats", getBotStats)
 		api.GET("/config", getConfig)
 		api.POST("/config", saveConfig)
 		api.GET("/auto-fetch-status", getAutoFetchStatus)
 		api.GET("/user-points-info", getUserPointsInfo)
 		api.GET("/subscription-cost-info", getSubscriptionCostInfo)
+		api.GET("/cost/by-bot", getCostByBot)
+		api.GET("/compare", comparePeriods)
+		api.GET("/forecast", getForecast)
+		api.GET("/anomalies", getAnomalies)
+		api.GET("/budgets", getBudgets)
+		api.POST("/budgets", createBudget)
+		api.PUT("/budgets/:id", updateBudget)
+		api.DELETE("/budgets/:id", deleteBudget)
+		api.GET("/alerts", getAlerts)
+		api.POST("/alerts/:id/ack", acknowledgeAlert)
+		api.GET("/webhooks", getWebhookTargets)
+		api.POST("/webhooks", createWebhookTarget)
+		api.PUT("/webhooks/:id", updateWebhookTarget)
+		api.DELETE("/webhooks/:id", deleteWebhookTarget)
+		api.POST("/webhooks/:id/test", testWebhookTarget)
+		api.GET("/webhooks/deliveries", getWebhookDeliveries)
+		api.GET("/exporters", getExporters)
+		api.POST("/exporters", createExporter)
+		api.PUT("/exporters/:id", updateExporter)
+		api.DELETE("/exporters/:id", deleteExporter)
+		api.POST("/exporters/:id/push", pushExporterNow)
+		api.GET("/email/settings", getEmailSettings)
+		api.POST("/email/settings", saveEmailSettings)
+		api.POST("/email/send", sendDigestNow)
+		api.GET("/fx/settings", getFXSettings)
+		api.POST("/fx/settings", saveFXSettings)
+		api.POST("/fx/refresh", refreshFXRates)
+		api.GET("/fx/rates", getFXRates)
+		api.GET("/currencies", getCurrencies)
+		api.GET("/allotments", getAllotments)
+		api.POST("/allotments", setAllotmentOverride)
+		api.GET("/plans", getPlans)
+		api.POST("/plans", createPlan)
+		api.PUT("/plans/:id", updatePlan)
+		api.DELETE("/plans/:id", deletePlan)
+		api.GET("/purchases", getPurchases)
+		api.POST("/purchases", createPurchase)
+		api.PUT("/purchases/:id", updatePurchase)
+		api.DELETE("/purchases/:id", deletePurchase)
 		api.GET("/layout", getLayoutConfig)
 		api.POST("/layout", saveLayoutConfig)
 		api.POST("/log", logFrontend)
 	}
 
-	// 启动自动拉取定时器
-	restartAutoFetchTimer()
+	if schemaErr == nil {
+		// 启动自动拉取定时器
+		restartAutoFetchTimer()
 
-	fmt.Printf("Server starting on port %s...\n", *port)
-	if err := r.Run(":" + *port); err != nil {
-		log.Fatal(err)
+		// 启动后台异常分析
+		startAnomalyAnalyzer()
+
+		// 启动邮件摘要定时检查
+		startEmailDigestScheduler()
+
+		// 启动汇率定时刷新
+		startRateRefresher()
+	} else {
+		log.Printf("Background jobs and /api are disabled until the schema migration succeeds")
+	}
+
+	srv := &http.Server{Addr: ":" + *port, Handler: r}
+	go func() {
+		fmt.Printf("Server starting on port %s...\n", *port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
+	log.Printf("Received %s, shutting down...", sig)
+	shutdown(srv, *shutdownTimeout)
+}
+
+// 优雅关闭：停止定时器、取消进行中的同步，在超时内等待请求、同步和通知结束，然后刷新日志并关闭数据库
+func shutdown(srv *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	scheduler.stopTimer()
+	cancelAppCtx()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("HTTP server shutdown: %v", err)
+	}
+	if !waitWithContext(ctx, &backgroundTasks) {
+		log.Println("Timed out waiting for running syncs and background tasks")
+	}
+	if !waitWithContext(ctx, &webhookNotifier.wg) {
+		log.Println("Timed out waiting for webhook deliveries")
+	}
+
+	if frontendLogFile != nil {
+		frontendLogFile.Sync()
+		frontendLogFile.Close()
+	}
+	if db != nil {
+		if err := db.Close(); err != nil {
+			log.Printf("Failed to close database: %v", err)
+		}
+	}
+	log.Println("Shutdown complete")
+}
+
+// 等待 WaitGroup 结束，ctx 先到期时返回 false
+func waitWithContext(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
@@ -0,0 +1,2218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"poe-points-monitor/internal/poesim"
+)
+
+func TestMain(m *testing.M) {
+	// 周期和 cron 计算依赖本地时区，测试统一使用 UTC
+	time.Local = time.UTC
+	gin.SetMode(gin.TestMode)
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// 在临时目录中初始化数据库，测试结束后关闭
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	initDB()
+	t.Cleanup(closeTestDB)
+}
+
+func closeTestDB() {
+	db.Close()
+	schemaErr = nil
+	if frontendLogFile != nil {
+		frontendLogFile.Close()
+		frontendLogFile = nil
+	}
+}
+
+// 发送 JSON 请求并返回响应
+func doJSON(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func micros(value string) int64 {
+	t, err := time.Parse("2006-01-02 15:04", value)
+	if err != nil {
+		panic(err)
+	}
+	return t.UnixMicro()
+}
+
+func TestPlanSchedulePeriodAt(t *testing.T) {
+	dayChange := planSchedule{
+		{EffectiveFrom: 0, SubscriptionDay: 1},
+		{EffectiveFrom: micros("2026-03-10 00:00"), SubscriptionDay: 15},
+	}
+	priceChange := planSchedule{
+		{EffectiveFrom: 0, SubscriptionDay: 1, Amount: 20},
+		{EffectiveFrom: micros("2026-03-10 00:00"), SubscriptionDay: 1, Amount: 25},
+	}
+	late := planSchedule{
+		{EffectiveFrom: micros("2026-03-10 00:00"), SubscriptionDay: 5},
+	}
+
+	tests := []struct {
+		name       string
+		plans      planSchedule
+		at         string
+		start, end string
+	}{
+		{"single plan", planSchedule{{SubscriptionDay: 15}}, "2026-03-20 12:00", "2026-03-15 00:00", "2026-04-15 00:00"},
+		{"before renewal day", planSchedule{{SubscriptionDay: 15}}, "2026-03-14 23:59", "2026-02-15 00:00", "2026-03-15 00:00"},
+		{"old day cut at change", dayChange, "2026-03-05 00:00", "2026-03-01 00:00", "2026-03-10 00:00"},
+		{"new day starts at change", dayChange, "2026-03-12 00:00", "2026-03-10 00:00", "2026-03-15 00:00"},
+		{"new day full cycle", dayChange, "2026-03-20 00:00", "2026-03-15 00:00", "2026-04-15 00:00"},
+		{"previous cycle untouched", dayChange, "2026-02-20 00:00", "2026-02-01 00:00", "2026-03-01 00:00"},
+		{"price change keeps cycle", priceChange, "2026-03-12 00:00", "2026-03-01 00:00", "2026-04-01 00:00"},
+		{"before first plan", late, "2026-01-20 00:00", "2026-01-05 00:00", "2026-02-05 00:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := tt.plans.periodAt(micros(tt.at))
+			if start != micros(tt.start) || end != micros(tt.end) {
+				t.Errorf("periodAt(%s) = [%s, %s), want [%s, %s)", tt.at,
+					time.UnixMicro(start).Format("2006-01-02 15:04"), time.UnixMicro(end).Format("2006-01-02 15:04"),
+					tt.start, tt.end)
+			}
+		})
+	}
+}
+
+// 每个偏移都以当前周期为基准：-1 紧接在当前周期之前，不会因为未到续费日而重复返回当前周期
+func TestSubscriptionPeriodByOffset(t *testing.T) {
+	now := time.Now().UnixMicro()
+	for day := 1; day <= 28; day++ {
+		start, end := getSubscriptionPeriodByOffset(day, 0)
+		if now < start || now >= end {
+			t.Fatalf("day %d: current period [%d, %d) does not contain now", day, start, end)
+		}
+		if _, prevEnd := getSubscriptionPeriodByOffset(day, -1); prevEnd != start {
+			t.Errorf("day %d: previous period ends at %d, want %d", day, prevEnd, start)
+		}
+		if nextStart, _ := getSubscriptionPeriodByOffset(day, 1); nextStart != end {
+			t.Errorf("day %d: next period starts at %d, want %d", day, nextStart, end)
+		}
+	}
+}
+
+func TestStatsPreviousPeriod(t *testing.T) {
+	setupTestDB(t)
+	r := gin.New()
+	r.GET("/api/stats", getStats)
+
+	var current, previous struct {
+		PeriodStart int64 `json:"period_start"`
+		PeriodEnd   int64 `json:"period_end"`
+	}
+	for path, out := range map[string]any{"/api/stats?period=0": &current, "/api/stats?period=-1": &previous} {
+		w := doJSON(r, "GET", path, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", path, w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if previous.PeriodEnd != current.PeriodStart || previous.PeriodStart >= current.PeriodStart {
+		t.Errorf("period=-1 = [%d, %d), want the cycle before [%d, %d)",
+			previous.PeriodStart, previous.PeriodEnd, current.PeriodStart, current.PeriodEnd)
+	}
+}
+
+func TestComparePeriods(t *testing.T) {
+	setupTestDB(t)
+	insertTestRecords(t,
+		PointsHistoryNode{ID: "a1", PointCost: 100, CreationTime: micros("2026-01-01 10:00"), BotName: "X"},
+		PointsHistoryNode{ID: "a2", PointCost: 50, CreationTime: micros("2026-01-02 10:00"), BotName: "X"},
+		PointsHistoryNode{ID: "a3", PointCost: 30, CreationTime: micros("2026-01-02 11:00"), BotName: "Y"},
+		PointsHistoryNode{ID: "b1", PointCost: 60, CreationTime: micros("2026-01-03 10:00"), BotName: "X"},
+		PointsHistoryNode{ID: "b2", PointCost: 40, CreationTime: micros("2026-01-05 10:00"), BotName: "Z"},
+		PointsHistoryNode{ID: "out", PointCost: 999, CreationTime: micros("2026-01-06 00:00"), BotName: "X"},
+	)
+	r := gin.New()
+	r.GET("/api/compare", comparePeriods)
+
+	w := doJSON(r, "GET", "/api/compare?a=range:2026-01-01,2026-01-03&b=range:2026-01-03,2026-01-06", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		A, B  CompareRange
+		Bots  []BotCompare
+		Delta struct {
+			TotalPoints int      `json:"total_points"`
+			TotalPct    *float64 `json:"total_points_change_pct"`
+		}
+		Curve []CompareCurvePoint
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.A.TotalPoints != 180 || resp.A.MessageCount != 3 || resp.A.Days != 2 {
+		t.Errorf("a = %+v", resp.A)
+	}
+	if resp.B.TotalPoints != 100 || resp.B.MessageCount != 2 || resp.B.Days != 3 {
+		t.Errorf("b = %+v", resp.B)
+	}
+	if resp.Delta.TotalPoints != -80 || resp.Delta.TotalPct == nil || math.Abs(*resp.Delta.TotalPct+44.444) > 0.01 {
+		t.Errorf("delta = %+v", resp.Delta)
+	}
+
+	wantBots := []struct {
+		name   string
+		a, b   int
+		change *float64
+	}{
+		{"X", 150, 60, ptr(-60.0)},
+		{"Y", 30, 0, ptr(-100.0)},
+		{"Z", 0, 40, nil},
+	}
+	if len(resp.Bots) != len(wantBots) {
+		t.Fatalf("bots = %+v", resp.Bots)
+	}
+	for i, want := range wantBots {
+		got := resp.Bots[i]
+		if got.BotName != want.name || got.APoints != want.a || got.BPoints != want.b || got.PointsDelta != want.b-want.a {
+			t.Errorf("bot %d = %+v, want %+v", i, got, want)
+		}
+		if (got.PointsChange == nil) != (want.change == nil) || (got.PointsChange != nil && *got.PointsChange != *want.change) {
+			t.Errorf("bot %s change = %v, want %v", want.name, got.PointsChange, want.change)
+		}
+	}
+
+	// A 只有两天，第三天为空；两条曲线按第 N 天对齐累积
+	wantCurve := []struct{ a, b *int }{{ptr(100), ptr(60)}, {ptr(180), ptr(60)}, {nil, ptr(100)}}
+	if len(resp.Curve) != len(wantCurve) {
+		t.Fatalf("curve = %+v", resp.Curve)
+	}
+	for i, want := range wantCurve {
+		got := resp.Curve[i]
+		if got.Day != i+1 || !equalIntPtr(got.ACumulative, want.a) || !equalIntPtr(got.BCumulative, want.b) {
+			t.Errorf("curve[%d] = day %d a %v b %v", i, got.Day, got.ACumulative, got.BCumulative)
+		}
+	}
+
+	for _, q := range []string{"a=range:2026-01-03,2026-01-01", "a=week:1", "b=period:x"} {
+		if w := doJSON(r, "GET", "/api/compare?"+q, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", q, w.Code)
+		}
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func equalIntPtr(a, b *int) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
+
+func TestBuildSeasonalProfile(t *testing.T) {
+	setupTestDB(t)
+	// 2026-01-05 是周一，窗口两周，每天 09:00 消耗 10，第二个周一额外消耗 28
+	start, end := micros("2026-01-05 00:00"), micros("2026-01-19 00:00")
+	var records []PointsHistoryNode
+	for d := 0; d < 14; d++ {
+		ts := start + int64(d)*microsPerDay + 9*int64(time.Hour/time.Microsecond)
+		records = append(records, PointsHistoryNode{ID: "r" + strconv.Itoa(d), PointCost: 10, CreationTime: ts, BotName: "b"})
+	}
+	records = append(records, PointsHistoryNode{ID: "extra", PointCost: 28, CreationTime: micros("2026-01-12 09:30"), BotName: "b"})
+	insertTestRecords(t, records...)
+
+	profile, stdDev, err := buildSeasonalProfile(start, end, localAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := profile[time.Monday][9]; got != 24 {
+		t.Errorf("monday 09:00 rate = %v, want 24", got)
+	}
+	if got := profile[time.Tuesday][9]; got != 10 {
+		t.Errorf("tuesday 09:00 rate = %v, want 10", got)
+	}
+	if got := profile[time.Tuesday][10]; got != 0 {
+		t.Errorf("tuesday 10:00 rate = %v, want 0", got)
+	}
+	// 两个周一分别偏离预期 ±14，其余日子没有残差
+	if want := math.Sqrt(2 * 14 * 14 / 13.0); math.Abs(stdDev-want) > 1e-9 {
+		t.Errorf("daily std dev = %v, want %v", stdDev, want)
+	}
+}
+
+func TestComputeTrendFactor(t *testing.T) {
+	setupTestDB(t)
+	start, end := micros("2026-01-01 00:00"), micros("2026-01-29 00:00")
+	var records []PointsHistoryNode
+	for d := 0; d < 28; d++ {
+		cost := 10
+		if d >= 21 {
+			cost = 25 // 最近 7 天
+		}
+		ts := start + int64(d)*microsPerDay + 12*int64(time.Hour/time.Microsecond)
+		records = append(records, PointsHistoryNode{ID: "r" + strconv.Itoa(d), PointCost: cost, CreationTime: ts, BotName: "b"})
+	}
+	insertTestRecords(t, records...)
+
+	tests := []struct {
+		name       string
+		start, end int64
+		want       float64
+	}{
+		{"recent surge", start, end, 25 / (385 / 28.0)},
+		{"window shorter than a week", end - 5*microsPerDay, end, 1},
+		{"no usage", micros("2025-01-01 00:00"), micros("2025-02-01 00:00"), 1},
+		{"capped at 2", micros("2025-12-01 00:00"), end, 2},
+		{"floored at 0.5", start, end + 7*microsPerDay, 0.5},
+	}
+	for _, tt := range tests {
+		got, err := computeTrendFactor(tt.start, tt.end, localAccount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: trend = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEstimatedBalance(t *testing.T) {
+	setupTestDB(t)
+	if _, ok, err := getEstimatedBalance(); err != nil || ok {
+		t.Fatalf("without snapshots: ok=%v err=%v", ok, err)
+	}
+
+	now := time.Now()
+	hour := int64(time.Hour / time.Microsecond)
+	insertTestRecords(t,
+		PointsHistoryNode{ID: "before", PointCost: 999, CreationTime: now.UnixMicro() - 2*hour, BotName: "b"},
+		PointsHistoryNode{ID: "after", PointCost: 100, CreationTime: now.UnixMicro() - hour/2, BotName: "b"},
+		PointsHistoryNode{ID: "other", PointCost: 50, CreationTime: now.UnixMicro() - hour/2, BotName: "b", Account: "bob"},
+	)
+	if _, err := db.Exec(`INSERT INTO points_snapshots (total_allotment, current_balance, captured_at) VALUES (?, ?, ?)`,
+		10000, 1000, now.UnixMicro()-hour); err != nil {
+		t.Fatal(err)
+	}
+	if balance, ok, err := getEstimatedBalance(); err != nil || !ok || balance != 900 {
+		t.Errorf("balance = %d ok=%v err=%v, want 900", balance, ok, err)
+	}
+
+	// 快照早于本周期开始：以本周期配额为起点，只扣除本周期的消耗
+	periodStart, _ := getPlanPeriodByOffset(0)
+	if _, err := db.Exec(`DELETE FROM points_snapshots`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO points_snapshots (total_allotment, current_balance, captured_at) VALUES (?, ?, ?)`,
+		10000, 10, periodStart-microsPerDay); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO cycle_allotments (period_start, manual_allotment) VALUES (?, ?)`, periodStart, 5000); err != nil {
+		t.Fatal(err)
+	}
+	used, err := sumPointsBetween(periodStart, math.MaxInt64, localAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance, ok, err := getEstimatedBalance(); err != nil || !ok || balance != 5000-used {
+		t.Errorf("balance after reset = %d ok=%v err=%v, want %d", balance, ok, err, 5000-used)
+	}
+}
+
+func TestForecastParams(t *testing.T) {
+	setupTestDB(t)
+	r := gin.New()
+	r.GET("/api/forecast", getForecast)
+
+	for _, q := range []string{"lookback_days=abc", "lookback_days=7d", "balance=x"} {
+		if w := doJSON(r, "GET", "/api/forecast?"+q, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", q, w.Code)
+		}
+	}
+
+	tests := []struct {
+		query    string
+		lookback int
+	}{
+		{"", 28},
+		{"lookback_days=3", 7},
+		{"lookback_days=90", 90},
+		{"lookback_days=100000", 365},
+	}
+	for _, tt := range tests {
+		w := doJSON(r, "GET", "/api/forecast?balance=50&"+tt.query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tt.query, w.Code, w.Body)
+		}
+		var resp struct {
+			LookbackDays int   `json:"lookback_days"`
+			Remaining    int   `json:"projected_remaining"`
+			EndBalance   int64 `json:"projected_end_balance"`
+			WillRunOut   bool  `json:"will_run_out"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		// 没有历史消耗时预测为 0，余额保持不变
+		if resp.LookbackDays != tt.lookback || resp.Remaining != 0 || resp.EndBalance != 50 || resp.WillRunOut {
+			t.Errorf("%s: %+v", tt.query, resp)
+		}
+	}
+}
+
+func TestEvaluateBudgets(t *testing.T) {
+	setupTestDB(t)
+	periodStart, _ := getPlanPeriodByOffset(0)
+	if _, err := db.Exec(`INSERT INTO cycle_allotments (period_start, manual_allotment) VALUES (?, ?)`, periodStart, 1000); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now().Add(-time.Second).UnixMicro()
+	insertTestRecords(t,
+		PointsHistoryNode{ID: "x1", PointCost: 200, CreationTime: ts, BotName: "X"},
+		PointsHistoryNode{ID: "x2", PointCost: 150, CreationTime: ts, BotName: "X"},
+		PointsHistoryNode{ID: "y1", PointCost: 260, CreationTime: ts, BotName: "Y"},
+		PointsHistoryNode{ID: "z1", PointCost: 10, CreationTime: ts, BotName: "Z"},
+		PointsHistoryNode{ID: "bob", PointCost: 5000, CreationTime: ts, BotName: "X", Account: "bob"},
+	)
+
+	r := gin.New()
+	r.POST("/api/budgets", createBudget)
+	r.PUT("/api/budgets/:id", updateBudget)
+	ids := map[string]int{}
+	for _, body := range []string{
+		`{"name":"half","scope":"account","period":"cycle","threshold_type":"percent","threshold":50}`,
+		`{"name":"whole","scope":"account","period":"cycle","threshold_type":"percent","threshold":100}`,
+		`{"name":"x","scope":"bot","bot_name":"X","period":"cycle","threshold_type":"absolute","threshold":300}`,
+		`{"name":"any bot","scope":"bot","period":"cycle","threshold_type":"absolute","threshold":250}`,
+		`{"name":"daily","scope":"account","period":"day","threshold_type":"absolute","threshold":100}`,
+		`{"name":"off","scope":"account","period":"day","threshold_type":"absolute","threshold":1,"enabled":false}`,
+	} {
+		w := doJSON(r, "POST", "/api/budgets", body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("create %s: status %d: %s", body, w.Code, w.Body)
+		}
+		var b Budget
+		json.Unmarshal(w.Body.Bytes(), &b)
+		ids[b.Name] = b.ID
+	}
+
+	alertKeys := func(alerts []Alert) []string {
+		var keys []string
+		for _, a := range alerts {
+			keys = append(keys, fmt.Sprintf("%s/%s/%d", a.BudgetName, a.BotName, a.UsedPoints))
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	alerts, err := evaluateBudgets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"any bot/X/350", "any bot/Y/260", "daily//620", "half//620", "x/X/350"}
+	if got := alertKeys(alerts); !reflect.DeepEqual(got, want) {
+		t.Fatalf("alerts = %v, want %v", got, want)
+	}
+	for _, a := range alerts {
+		if a.BudgetName == "half" && a.ThresholdPoints != 500 {
+			t.Errorf("percent threshold = %v, want 500", a.ThresholdPoints)
+		}
+	}
+
+	// 同一区间不重复告警
+	if alerts, err := evaluateBudgets(); err != nil || len(alerts) != 0 {
+		t.Fatalf("second evaluation = %v, %v", alertKeys(alerts), err)
+	}
+
+	// 提高阈值后尚未超出：不告警，也不重复旧告警
+	if w := doJSON(r, "PUT", fmt.Sprintf("/api/budgets/%d", ids["x"]), `{"threshold":400}`); w.Code != http.StatusOK {
+		t.Fatalf("update: status %d: %s", w.Code, w.Body)
+	}
+	if alerts, err := evaluateBudgets(); err != nil || len(alerts) != 0 {
+		t.Fatalf("after raising threshold = %v, %v", alertKeys(alerts), err)
+	}
+
+	// 超出新阈值后重新告警一次，替换修改前的告警
+	insertTestRecords(t, PointsHistoryNode{ID: "x3", PointCost: 100, CreationTime: ts, BotName: "X"})
+	alerts, err = evaluateBudgets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := alertKeys(alerts); !reflect.DeepEqual(got, []string{"x/X/450"}) {
+		t.Fatalf("after exceeding new threshold = %v", got)
+	}
+	if alerts[0].ThresholdPoints != 400 {
+		t.Errorf("threshold = %v, want 400", alerts[0].ThresholdPoints)
+	}
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM alerts WHERE budget_id = ?`, ids["x"]).Scan(&count)
+	if count != 1 {
+		t.Errorf("%d alerts stored for the edited rule, want 1", count)
+	}
+	if alerts, err := evaluateBudgets(); err != nil || len(alerts) != 0 {
+		t.Fatalf("evaluation after re-alert = %v, %v", alertKeys(alerts), err)
+	}
+}
+
+func TestValidateBudget(t *testing.T) {
+	tests := []struct {
+		budget Budget
+		ok     bool
+	}{
+		{Budget{Name: "a", Scope: "account", Period: "cycle", ThresholdType: "percent", Threshold: 80}, true},
+		{Budget{Name: "w", Scope: "bot", Period: "window", WindowStart: 1, WindowEnd: 2, ThresholdType: "absolute", Threshold: 1}, true},
+		{Budget{Scope: "account", Period: "cycle", ThresholdType: "percent", Threshold: 80}, false},
+		{Budget{Name: "a", Scope: "team", Period: "cycle", ThresholdType: "percent", Threshold: 80}, false},
+		{Budget{Name: "a", Scope: "account", Period: "week", ThresholdType: "percent", Threshold: 80}, false},
+		{Budget{Name: "a", Scope: "account", Period: "window", WindowStart: 2, WindowEnd: 2, ThresholdType: "percent", Threshold: 80}, false},
+		{Budget{Name: "a", Scope: "account", Period: "cycle", ThresholdType: "ratio", Threshold: 80}, false},
+		{Budget{Name: "a", Scope: "account", Period: "cycle", ThresholdType: "percent", Threshold: 0}, false},
+	}
+	for i, tt := range tests {
+		if err := validateBudget(&tt.budget); (err == nil) != tt.ok {
+			t.Errorf("case %d: err = %v, want ok=%v", i, err, tt.ok)
+		}
+	}
+}
+
+// 配置表单不发送 display_currency，保存时应保留原有的显示货币
+func TestSaveConfigKeepsDisplayCurrency(t *testing.T) {
+	setupTestDB(t)
+	r := gin.New()
+	r.GET("/api/config", getConfig)
+	r.POST("/api/config", saveConfig)
+
+	displayCurrency := func() string {
+		w := doJSON(r, "GET", "/api/config", "")
+		var cfg struct {
+			DisplayCurrency string `json:"display_currency"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &cfg)
+		return cfg.DisplayCurrency
+	}
+	save := func(extra string) {
+		t.Helper()
+		body := `{"cookie":"p-b=test","form_key":"fk","tchannel":"tc","subscription_day":1,` +
+			`"subscription_amount":20,"subscription_currency":"USD","auto_fetch_interval":30` + extra + `}`
+		if w := doJSON(r, "POST", "/api/config", body); w.Code != http.StatusOK {
+			t.Fatalf("save %s: status %d: %s", extra, w.Code, w.Body)
+		}
+	}
+
+	save(`,"display_currency":"eur"`)
+	if got := displayCurrency(); got != "EUR" {
+		t.Fatalf("display currency = %q, want EUR", got)
+	}
+	save("")
+	if got := displayCurrency(); got != "EUR" {
+		t.Errorf("display currency after save without the field = %q, want EUR", got)
+	}
+	if w := doJSON(r, "POST", "/api/config", `{"display_currency":"XXX1"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid display currency: status %d", w.Code)
+	}
+}
+
+func TestRecordPointsSnapshotDetectsPurchase(t *testing.T) {
+	setupTestDB(t)
+	grant := micros("2026-02-01 00:00")
+	insertTestRecords(t, PointsHistoryNode{ID: "u1", PointCost: 200, CreationTime: micros("2026-01-10 12:00"), BotName: "b"})
+
+	steps := []struct {
+		at      string
+		balance int64
+		grant   int64
+		bought  int64 // 0 表示不应识别为加购
+	}{
+		{"2026-01-10 00:00", 5000, grant, 0},        // 首个快照
+		{"2026-01-11 00:00", 4800, grant, 0},        // 余额只因消耗减少
+		{"2026-01-12 00:00", 6300, grant, 1500},     // 加购 1500
+		{"2026-01-13 00:00", 6800, grant, 0},        // 增长未达阈值
+		{"2026-02-01 01:00", 10000, grant + 1e6, 0}, // 每月重置
+	}
+	for _, step := range steps {
+		if err := recordPointsSnapshot(10000, step.balance, step.grant, micros(step.at)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purchases, err := loadPurchases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purchases) != 1 {
+		t.Fatalf("purchases = %+v, want one detected purchase", purchases)
+	}
+	p := purchases[0]
+	if p.Points != 1500 || p.PurchasedAt != micros("2026-01-12 00:00") || p.Source != "detected" || p.Amount != 0 || p.SnapshotID == nil {
+		t.Errorf("purchase = %+v", p)
+	}
+}
+
+// 每个周期先用订阅配额，超出部分按购买顺序消耗加购积分，未用完的加购积分结转到下个周期
+func TestPurchaseLedger(t *testing.T) {
+	setupTestDB(t)
+	if _, err := db.Exec(`INSERT INTO subscription_plans (effective_from, amount, currency, allotment, subscription_day) VALUES (0, 20, 'USD', 1000, 1)`); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []struct {
+		at     string
+		points int64
+		amount float64
+	}{
+		{"2026-01-10 00:00", 500, 15}, // 每积分 0.03 美元
+		{"2026-01-20 00:00", 1000, 0}, // 价格未知，按订阅单价 0.02 计
+	} {
+		if _, err := db.Exec(`INSERT INTO point_purchases (purchased_at, points, amount, currency, source, created_at) VALUES (?, ?, ?, 'USD', 'manual', ?)`,
+			micros(p.at), p.points, p.amount, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insertTestRecords(t,
+		PointsHistoryNode{ID: "r1", PointCost: 800, CreationTime: micros("2026-01-05 00:00"), BotName: "W"},
+		PointsHistoryNode{ID: "r2", PointCost: 400, CreationTime: micros("2026-01-12 00:00"), BotName: "X"},
+		PointsHistoryNode{ID: "r3", PointCost: 500, CreationTime: micros("2026-01-21 00:00"), BotName: "Y"},
+		PointsHistoryNode{ID: "r4", PointCost: 1100, CreationTime: micros("2026-02-02 00:00"), BotName: "X"},
+	)
+
+	cc, err := newCostCalculator("USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger, err := cc.ledger()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	want := map[string]struct {
+		points           int64
+		cost, adjustment float64
+	}{
+		"r2": {200, 6, 2},  // 超出 200，全部来自第一批（0.03）
+		"r3": {500, 13, 3}, // 第一批剩余 300（0.03），第二批 200（0.02）
+		"r4": {100, 2, 0},  // 二月配额重置，超出 100 来自结转的第二批
+	}
+	if len(ledger.entries) != len(want) {
+		t.Fatalf("ledger entries = %+v", ledger.entries)
+	}
+	for id, w := range want {
+		i, ok := ledger.byRecord[id]
+		if !ok {
+			t.Fatalf("no ledger entry for %s", id)
+		}
+		e := ledger.entries[i]
+		if e.PurchasedPoints != w.points || !near(e.CostUSD, w.cost) || !near(e.AdjustmentUSD, w.adjustment) {
+			t.Errorf("%s = %+v, want %+v", id, e, w)
+		}
+	}
+
+	if costUSD, _ := cc.recordCost("r2", micros("2026-01-12 00:00"), 400); !near(costUSD, 10) {
+		t.Errorf("r2 cost = %v, want 10 (8 at plan price + 2 purchase premium)", costUSD)
+	}
+	if costUSD, _ := cc.recordCost("r1", micros("2026-01-05 00:00"), 800); !near(costUSD, 16) {
+		t.Errorf("r1 cost = %v, want 16", costUSD)
+	}
+
+	jan, err := cc.purchaseSummary(micros("2026-01-01 00:00"), micros("2026-02-01 00:00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jan.PointsUsed != 700 || !near(jan.CostUSD, 19) || !near(jan.AdjustmentUSD, 5) ||
+		jan.PointsBought != 1500 || !near(jan.AmountUSD, 15) || jan.PointsRemaining != 800 {
+		t.Errorf("january summary = %+v", jan)
+	}
+	feb, err := cc.purchaseSummary(micros("2026-02-01 00:00"), micros("2026-03-01 00:00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feb.PointsUsed != 100 || feb.PointsBought != 0 || feb.PointsRemaining != 700 {
+		t.Errorf("february summary = %+v", feb)
+	}
+
+	byBot, err := cc.purchaseAdjustmentsByBot(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(byBot["X"][0], 2) || !near(byBot["Y"][0], 3) || len(byBot) != 2 {
+		t.Errorf("adjustments by bot = %v", byBot)
+	}
+}
+
+func TestExportStreamsAndReportsErrorsInTrailer(t *testing.T) {
+	setupTestDB(t)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const rows = 2*exportFlushRows + 1
+	for i := 0; i < rows; i++ {
+		if _, err := tx.Exec(`INSERT INTO points_history (id, point_cost, creation_time, bot_name, bot_id, cursor) VALUES (?, 1, ?, 'b', 'b1', '')`,
+			fmt.Sprintf("r%04d", i), micros("2026-01-01 00:00")+int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.GET("/api/export", exportHistory)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(query string) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/api/export?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	// 分块输出而不是缓存后一次写出；完整导出时 trailer 为空
+	resp, body := get("format=jsonl&columns=id")
+	if resp.ContentLength != -1 || len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("response not streamed: content-length %d, transfer-encoding %v", resp.ContentLength, resp.TransferEncoding)
+	}
+	if n := strings.Count(body, "\n"); n != rows {
+		t.Errorf("exported %d rows, want %d", n, rows)
+	}
+	if e := resp.Trailer.Get("X-Export-Error"); e != "" {
+		t.Errorf("trailer on a complete export: %q", e)
+	}
+
+	// 中途读取失败：已写出的行保留，错误通过 trailer 告知
+	if _, err := db.Exec(`INSERT INTO points_history (id, point_cost, creation_time, bot_name, bot_id, cursor, created_at) VALUES ('bad', 'not a number', ?, 'b', 'b1', '', CURRENT_TIMESTAMP)`,
+		micros("2026-01-02 00:00")); err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []string{"csv", "jsonl", "json"} {
+		resp, body := get("format=" + format + "&columns=id,created_at")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d", format, resp.StatusCode)
+		}
+		if resp.Trailer.Get("X-Export-Error") == "" {
+			t.Errorf("%s: missing X-Export-Error trailer", format)
+		}
+		if !strings.Contains(body, fmt.Sprintf("r%04d", rows-1)) || strings.Contains(body, "bad") {
+			t.Errorf("%s: unexpected partial body tail %q", format, body[max(0, len(body)-80):])
+		}
+		if format == "json" && !strings.HasSuffix(body, "]") {
+			t.Errorf("json export not closed: %q", body[max(0, len(body)-20):])
+		}
+	}
+}
+
+func TestExportCSVFloats(t *testing.T) {
+	setupTestDB(t)
+	if _, err := db.Exec(`INSERT INTO subscription_plans (effective_from, amount, currency, allotment, subscription_day) VALUES (0, 20, 'USD', 1000000, 1)`); err != nil {
+		t.Fatal(err)
+	}
+	insertTestRecords(t, PointsHistoryNode{ID: "r1", PointCost: 1, CreationTime: micros("2026-01-05 00:00"), BotName: "b"})
+
+	r := gin.New()
+	r.GET("/api/export", exportHistory)
+	w := doJSON(r, "GET", "/api/export?format=csv&columns=id,cost_usd&currency=USD", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if want := "id,cost_usd\nr1,0.00002\n"; w.Body.String() != want {
+		t.Errorf("csv = %q, want %q", w.Body.String(), want)
+	}
+}
+
+func TestImportHistoryDedupe(t *testing.T) {
+	setupTestDB(t)
+	insertTestRecords(t, PointsHistoryNode{ID: "e1", PointCost: 5, CreationTime: micros("2026-01-01 00:00"), BotName: "b"})
+
+	csvData := "\ufeffid,point_cost,creation_time,bot_name,bot_id,account\n" +
+		"e1,5,1767225600000000,b,b1,local\n" + // 数据库中已存在
+		"n1,10,1767225600,b,b1,local\n" + // 秒级时间戳
+		"n1,10,1767225600,b,b1,local\n" + // 文件内重复
+		"n2,7,2026-01-02T00:00:00Z,c,c1,bob\n" +
+		"n3,x,1767225600,b,b1,local\n" // 无效积分
+
+	// dry-run 只统计，不写入
+	report, err := importHistory(strings.NewReader(csvData), ImportOptions{Format: "csv", DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 5 || report.Inserted != 2 || report.Duplicates != 2 || report.Failed != 1 {
+		t.Fatalf("dry run report = %+v", report)
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM points_history").Scan(&count)
+	if count != 1 {
+		t.Fatalf("dry run wrote %d rows", count-1)
+	}
+
+	report, err = importHistory(strings.NewReader(csvData), ImportOptions{Format: "csv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Inserted != 2 || report.Duplicates != 2 || report.Failed != 1 ||
+		len(report.Errors) != 1 || report.Errors[0].Row != 5 || report.Errors[0].ID != "n3" {
+		t.Fatalf("report = %+v", report)
+	}
+	var creationTime int64
+	var account string
+	db.QueryRow("SELECT creation_time FROM points_history WHERE id = 'n1'").Scan(&creationTime)
+	db.QueryRow("SELECT account FROM points_history WHERE id = 'n2'").Scan(&account)
+	if creationTime != 1767225600000000 || account != "bob" {
+		t.Errorf("n1 creation_time = %d, n2 account = %q", creationTime, account)
+	}
+
+	// 再次导入同一文件：全部视为重复
+	report, err = importHistory(strings.NewReader(csvData), ImportOptions{Format: "csv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Inserted != 0 || report.Duplicates != 4 {
+		t.Errorf("re-import report = %+v", report)
+	}
+}
+
+// 跨批次（每批一个事务）的重复 id 也能识别
+func TestImportHistoryDedupeAcrossBatches(t *testing.T) {
+	setupTestDB(t)
+	var lines []string
+	for i := 0; i < importBatchRows+10; i++ {
+		lines = append(lines, fmt.Sprintf(`{"id":"r%d","point_cost":1,"creation_time":%d,"bot_name":"b"}`, i, 1767225600000000+i))
+	}
+	lines = append(lines, `{"id":"r3","point_cost":1,"creation_time":1767225600000003,"bot_name":"b"}`)
+	data := strings.Join(lines, "\n")
+
+	report, err := importHistory(strings.NewReader(data), ImportOptions{Format: "jsonl", Account: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Inserted != importBatchRows+10 || report.Duplicates != 1 || report.Failed != 0 {
+		t.Fatalf("report = %+v", report)
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM points_history WHERE account = 'alice'").Scan(&count)
+	if count != importBatchRows+10 {
+		t.Errorf("stored %d rows for alice", count)
+	}
+
+	// 语法错误之后的行无法定位，导入中止但保留之前的行
+	report, err = importHistory(strings.NewReader(`{"id":"s1","point_cost":1,"creation_time":1,"bot_name":"b"}`+"\n{oops\n"+
+		`{"id":"s2","point_cost":1,"creation_time":1,"bot_name":"b"}`), ImportOptions{Format: "jsonl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Inserted != 1 || report.Failed != 1 || report.Total != 2 {
+		t.Errorf("aborted import report = %+v", report)
+	}
+}
+
+func TestReadEndpointsFilterAccount(t *testing.T) {
+	setupTestDB(t)
+	ts := time.Now().Add(-time.Minute).UnixMicro()
+	insertTestRecords(t,
+		PointsHistoryNode{ID: "l1", PointCost: 10, CreationTime: ts, BotName: "A"},
+		PointsHistoryNode{ID: "l2", PointCost: 20, CreationTime: ts, BotName: "A"},
+		PointsHistoryNode{ID: "b1", PointCost: 300, CreationTime: ts, BotName: "B", Account: "bob"},
+	)
+
+	r := gin.New()
+	r.GET("/api/history", getAllHistory)
+	r.GET("/api/records", getLatestRecords)
+	r.GET("/api/stats", getStats)
+	r.GET("/api/bot-stats", getBotStats)
+	r.GET("/api/compare", comparePeriods)
+	r.GET("/api/forecast", getForecast)
+
+	get := func(path string, out any) {
+		t.Helper()
+		w := doJSON(r, "GET", path, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", path, w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+
+	// 未指定 account 与 account=local 都只统计本机账户
+	for _, tt := range []struct {
+		query      string
+		records    int
+		points     int
+		bot        string
+		costCounts bool
+	}{
+		{"", 2, 30, "A", true},
+		{"?account=local", 2, 30, "A", true},
+		{"?account=bob", 1, 300, "B", false},
+		{"?account=nobody", 0, 0, "", false},
+	} {
+		sep := "?"
+		if tt.query != "" {
+			sep = "&"
+		}
+
+		var history []PointsHistoryWithCost
+		get("/api/history"+tt.query, &history)
+		var records []PointsHistoryNode
+		get("/api/records"+tt.query, &records)
+		if len(history) != tt.records || len(records) != tt.records {
+			t.Errorf("%q: history %d, records %d, want %d", tt.query, len(history), len(records), tt.records)
+		}
+		for _, h := range history {
+			if (h.CostCurrency != "") != tt.costCounts {
+				t.Errorf("%q: history cost currency %q", tt.query, h.CostCurrency)
+			}
+		}
+
+		var stats struct {
+			Data []AggregatedStats `json:"data"`
+		}
+		get("/api/stats"+tt.query+sep+"granularity=day", &stats)
+		if points, _ := sumBreakdown(stats.Data); points != tt.points {
+			t.Errorf("%q: stats points = %d, want %d", tt.query, points, tt.points)
+		}
+
+		var bots []BotStat
+		get("/api/bot-stats"+tt.query, &bots)
+		if tt.bot == "" {
+			if len(bots) != 0 {
+				t.Errorf("%q: bot stats = %+v, want none", tt.query, bots)
+			}
+		} else if len(bots) != 1 || bots[0].BotName != tt.bot || bots[0].TotalCost != tt.points {
+			t.Errorf("%q: bot stats = %+v", tt.query, bots)
+		}
+
+		var compare struct {
+			B CompareRange `json:"b"`
+		}
+		get("/api/compare"+tt.query, &compare)
+		if compare.B.TotalPoints != tt.points {
+			t.Errorf("%q: compare total = %d, want %d", tt.query, compare.B.TotalPoints, tt.points)
+		}
+
+		var forecast struct {
+			UsedInCycle int `json:"used_in_cycle"`
+		}
+		get("/api/forecast"+tt.query, &forecast)
+		if forecast.UsedInCycle != tt.points {
+			t.Errorf("%q: forecast used = %d, want %d", tt.query, forecast.UsedInCycle, tt.points)
+		}
+	}
+}
+
+func TestBudgetAccount(t *testing.T) {
+	setupTestDB(t)
+	ts := time.Now().Add(-time.Second).UnixMicro()
+	insertTestRecords(t,
+		PointsHistoryNode{ID: "l1", PointCost: 50, CreationTime: ts, BotName: "A"},
+		PointsHistoryNode{ID: "b1", PointCost: 500, CreationTime: ts, BotName: "A", Account: "bob"},
+	)
+
+	r := gin.New()
+	r.GET("/api/budgets", getBudgets)
+	r.POST("/api/budgets", createBudget)
+	for _, body := range []string{
+		`{"name":"local","scope":"account","period":"cycle","threshold_type":"absolute","threshold":100}`,
+		`{"name":"bob","account":"bob","scope":"account","period":"cycle","threshold_type":"absolute","threshold":100}`,
+	} {
+		if w := doJSON(r, "POST", "/api/budgets", body); w.Code != http.StatusOK {
+			t.Fatalf("create %s: status %d: %s", body, w.Code, w.Body)
+		}
+	}
+	// 百分比阈值依赖本机账户的配额
+	w := doJSON(r, "POST", "/api/budgets", `{"name":"pct","account":"bob","scope":"account","period":"cycle","threshold_type":"percent","threshold":50}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("percent budget for bob: status %d, want 400", w.Code)
+	}
+
+	for query, want := range map[string][]string{
+		"":               {"local", "bob"},
+		"?account=local": {"local"},
+		"?account=bob":   {"bob"},
+	} {
+		var budgets []Budget
+		json.Unmarshal(doJSON(r, "GET", "/api/budgets"+query, "").Body.Bytes(), &budgets)
+		var names []string
+		for _, b := range budgets {
+			names = append(names, b.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(want, ",") {
+			t.Errorf("GET /api/budgets%s = %v, want %v", query, names, want)
+		}
+	}
+
+	alerts, err := evaluateBudgets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 || alerts[0].BudgetName != "bob" || alerts[0].UsedPoints != 500 {
+		t.Fatalf("alerts = %+v, want only bob's budget", alerts)
+	}
+	if !strings.Contains(alerts[0].Message, "account bob") {
+		t.Errorf("message = %q", alerts[0].Message)
+	}
+}
+
+// 在 initDB 使用的路径上预先创建数据库，返回其路径
+func createTestDBFile(t *testing.T, schema string) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dir := filepath.Join(home, "Library", "Application Support", "PoePointsMonitor")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	old, err := sql.Open("sqlite3", filepath.Join(dir, "points.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if _, err := old.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateSchemaFromBaseline(t *testing.T) {
+	// 最初版本的数据库：只有三张表，没有后来补充的列
+	createTestDBFile(t, `
+		CREATE TABLE points_history (
+			id TEXT PRIMARY KEY, point_cost INTEGER NOT NULL, creation_time INTEGER NOT NULL,
+			bot_name TEXT NOT NULL, bot_id TEXT NOT NULL, cursor TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE config (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, cookie TEXT, form_key TEXT, tchannel TEXT, revision TEXT, tag_id TEXT,
+			subscription_day INTEGER DEFAULT 1, subscription_amount REAL DEFAULT 0, subscription_currency TEXT DEFAULT 'USD',
+			auto_fetch_interval INTEGER DEFAULT 30, auto_fetch_enabled INTEGER DEFAULT 0,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE layout_config (id INTEGER PRIMARY KEY AUTOINCREMENT, sidebar_width INTEGER DEFAULT 400, grid_layout TEXT);
+		INSERT INTO points_history (id, point_cost, creation_time, bot_name, bot_id, cursor) VALUES ('old', 5, 1, 'b', '', '');
+	`)
+	initDB()
+	t.Cleanup(closeTestDB)
+
+	if schemaErr != nil {
+		t.Fatalf("migration failed: %v", schemaErr)
+	}
+	var version int
+	db.QueryRow("PRAGMA user_version").Scan(&version)
+	if version != schemaVersion() || version != len(schemaMigrations) {
+		t.Errorf("user_version = %d, want %d", version, schemaVersion())
+	}
+	for _, table := range []string{"points_snapshots", "point_anomalies", "budgets", "alerts", "webhook_targets",
+		"webhook_deliveries", "email_settings", "fx_rates", "fx_settings", "cycle_allotments",
+		"subscription_plans", "point_purchases", "exporters", "app_state", "accounts"} {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&n)
+		if n != 1 {
+			t.Errorf("table %s not created", table)
+		}
+	}
+	var account string
+	if err := db.QueryRow("SELECT account FROM points_history WHERE id = 'old'").Scan(&account); err != nil || account != "" {
+		t.Errorf("existing row after migration: account=%q err=%v", account, err)
+	}
+	var mode string
+	if err := db.QueryRow("SELECT COALESCE(auto_fetch_mode, 'interval') FROM config").Scan(&mode); err != nil && err != sql.ErrNoRows {
+		t.Errorf("config.auto_fetch_mode: %v", err)
+	}
+
+	// 重复执行不改变结果
+	if err := migrateSchema(); err != nil {
+		t.Errorf("second migration: %v", err)
+	}
+}
+
+func TestMigrationFailureDisablesAPI(t *testing.T) {
+	// 同名视图使建表被跳过、补充列失败
+	createTestDBFile(t, `CREATE VIEW budgets AS SELECT 1 AS id`)
+	initDB()
+	t.Cleanup(closeTestDB)
+	if schemaErr == nil {
+		t.Fatal("migration unexpectedly succeeded")
+	}
+	var version int
+	db.QueryRow("PRAGMA user_version").Scan(&version)
+	if version != 0 {
+		t.Errorf("user_version = %d after a failed migration", version)
+	}
+
+	r := gin.New()
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz)
+	api := r.Group("/api", requireSchema)
+	api.GET("/stats", getStats)
+
+	if w := doJSON(r, "GET", "/healthz", ""); w.Code != http.StatusOK {
+		t.Errorf("/healthz: status %d", w.Code)
+	}
+	w := doJSON(r, "GET", "/api/stats", "")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "migration failed") {
+		t.Errorf("/api/stats: status %d: %s", w.Code, w.Body)
+	}
+	w = doJSON(r, "GET", "/readyz", "")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "view") {
+		t.Errorf("/readyz: status %d: %s", w.Code, w.Body)
+	}
+}
+
+// 替换全局的服务关闭上下文和指标，测试结束后恢复
+func useFreshAppContext(t *testing.T) {
+	t.Helper()
+	ctx, cancel, metrics := appCtx, cancelAppCtx, appMetrics
+	appCtx, cancelAppCtx = context.WithCancel(context.Background())
+	appMetrics = newMetricsRegistry()
+	t.Cleanup(func() {
+		cancelAppCtx()
+		appCtx, cancelAppCtx, appMetrics = ctx, cancel, metrics
+	})
+}
+
+func TestShutdownDrainsInFlightSync(t *testing.T) {
+	setupTestDB(t)
+	useFreshAppContext(t)
+
+	// Poe 请求一直挂起，直到关闭时取消
+	reached, stop := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	useFakePoe(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(reached) })
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	t.Cleanup(func() { close(stop) })
+
+	r := gin.New()
+	r.POST("/api/fetch", fetchPointsHistory)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: r}
+	go srv.Serve(ln)
+
+	type response struct {
+		code int
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Post("http://"+ln.Addr().String()+"/api/fetch", "application/json",
+			strings.NewReader(`{"cookie":"p-b=test","form_key":"formkey","tchannel":"tchannel"}`))
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		responses <- response{code: resp.StatusCode, body: string(body)}
+	}()
+	select {
+	case <-reached:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync never reached Poe")
+	}
+
+	started := time.Now()
+	shutdown(srv, 5*time.Second)
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %s, want the in-flight sync to be canceled promptly", elapsed)
+	}
+
+	// 进行中的请求在关闭前得到完整响应，同步记为 canceled
+	res := <-responses
+	if res.err != nil || res.code != http.StatusServiceUnavailable || !strings.Contains(res.body, "Fetch canceled") {
+		t.Errorf("in-flight fetch: code=%d body=%s err=%v", res.code, res.body, res.err)
+	}
+	if n := appMetrics.syncRuns[[3]string{localAccountLabel, "manual", "canceled"}]; n != 1 {
+		t.Errorf("canceled manual syncs = %d, want 1", n)
+	}
+	if release, ok := scheduler.acquire("manual"); !ok {
+		t.Error("sync lock still held after shutdown")
+	} else {
+		release()
+	}
+	if err := db.Ping(); err == nil {
+		t.Error("database still open after shutdown")
+	}
+}
+
+func TestShutdownTimesOutOnStuckTask(t *testing.T) {
+	setupTestDB(t)
+	useFreshAppContext(t)
+
+	// 不响应取消的后台任务不能让关闭无限期等待
+	release := make(chan struct{})
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		<-release
+	}()
+	defer close(release)
+
+	started := time.Now()
+	shutdown(&http.Server{}, 100*time.Millisecond)
+	if elapsed := time.Since(started); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("shutdown returned after %s, want about the 100ms timeout", elapsed)
+	}
+	if appCtx.Err() == nil {
+		t.Error("app context not canceled")
+	}
+	if err := db.Ping(); err == nil {
+		t.Error("database still open after shutdown")
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr  string
+		after string
+		want  string
+	}{
+		// 工作日 9-19 点每 10 分钟（2026-10-16 为周五）
+		{"*/10 9-19 * * 1-5", "2026-10-19 09:03", "2026-10-19 09:10"},
+		{"*/10 9-19 * * 1-5", "2026-10-19 19:50", "2026-10-20 09:00"},
+		{"*/10 9-19 * * 1-5", "2026-10-16 19:55", "2026-10-19 09:00"},
+		// 恰好命中时取下一次
+		{"15 10 * * *", "2026-10-18 10:15", "2026-10-19 10:15"},
+		// 日与周都有限制时满足其一即可
+		{"0 0 1,15 * 1", "2026-10-01 00:00", "2026-10-05 00:00"},
+		{"0 0 1,15 * 1", "2026-10-12 00:00", "2026-10-15 00:00"},
+		// 周日写作 7
+		{"30 8 * * 7", "2026-10-18 09:00", "2026-10-25 08:30"},
+		// 起点加步长
+		{"5/15 * * * *", "2026-10-18 10:06", "2026-10-18 10:20"},
+		{"0 6-18/6 * * *", "2026-10-18 12:00", "2026-10-18 18:00"},
+		// 跨年、闰日
+		{"0 0 1 1 *", "2026-12-31 23:59", "2027-01-01 00:00"},
+		{"0 12 29 2 *", "2026-03-01 00:00", "2028-02-29 12:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr+"@"+tt.after, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+			got := c.next(time.UnixMicro(micros(tt.after)))
+			if got.UnixMicro() != micros(tt.want) {
+				t.Errorf("next(%s) = %s, want %s", tt.after, got.Format("2006-01-02 15:04"), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"0 0 31 2 *", // 永不匹配
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestQuietHoursAcrossMidnight(t *testing.T) {
+	q, err := parseQuietHours("23:00-07:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for at, want := range map[string]bool{
+		"2026-10-18 22:59": false,
+		"2026-10-18 23:00": true,
+		"2026-10-18 23:30": true,
+		"2026-10-19 03:00": true,
+		"2026-10-19 06:59": true,
+		"2026-10-19 07:00": false,
+		"2026-10-19 12:00": false,
+	} {
+		if got := q.contains(time.UnixMicro(micros(at))); got != want {
+			t.Errorf("contains(%s) = %v, want %v", at, got, want)
+		}
+	}
+	if got := q.endAfter(time.UnixMicro(micros("2026-10-18 23:30"))); got.UnixMicro() != micros("2026-10-19 07:00") {
+		t.Errorf("endAfter(23:30) = %s", got)
+	}
+	if got := q.endAfter(time.UnixMicro(micros("2026-10-19 03:00"))); got.UnixMicro() != micros("2026-10-19 07:00") {
+		t.Errorf("endAfter(03:00) = %s", got)
+	}
+	if got := q.duration(); got != 8*time.Hour {
+		t.Errorf("duration = %s, want 8h", got)
+	}
+
+	for _, spec := range []string{"7-8", "10:00-10:00", "25:00-07:00", "23:00"} {
+		if _, err := parseQuietHours(spec); err == nil {
+			t.Errorf("parseQuietHours(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestFetchPlanNextRun(t *testing.T) {
+	tests := []struct {
+		name              string
+		mode, cron, quiet string
+		now, want         string
+	}{
+		{"interval", autoFetchModeInterval, "", "", "2026-10-18 22:00", "2026-10-18 22:30"},
+		{"interval into quiet", autoFetchModeInterval, "", "23:00-07:00", "2026-10-18 22:45", "2026-10-19 07:00"},
+		{"interval before quiet", autoFetchModeInterval, "", "23:00-07:00", "2026-10-18 22:15", "2026-10-18 22:45"},
+		{"cron into quiet", autoFetchModeCron, "0 * * * *", "23:00-07:00", "2026-10-18 22:30", "2026-10-19 07:00"},
+		{"cron after lunch", autoFetchModeCron, "*/10 9-19 * * 1-5", "12:00-13:00", "2026-10-19 11:55", "2026-10-19 13:00"},
+		{"cron quiet past window", autoFetchModeCron, "*/10 9-19 * * 1-5", "19:00-09:30", "2026-10-19 18:55", "2026-10-20 09:30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newFetchPlan(tt.mode, 30, tt.cron, tt.quiet, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := p.nextRun(time.UnixMicro(micros(tt.now)), p.interval)
+			if got.UnixMicro() != micros(tt.want) {
+				t.Errorf("nextRun(%s) = %s, want %s", tt.now, got.Format("2006-01-02 15:04"), tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchPlanRejectsCronInsideQuietHours(t *testing.T) {
+	for _, tt := range []struct {
+		cron, quiet string
+		ok          bool
+	}{
+		{"0 3 * * *", "23:00-07:00", false},
+		{"*/15 0-6 * * 1-5", "23:00-07:00", false},
+		{"30 12 * * *", "12:00-13:00", false},
+		{"0 3,12 * * *", "23:00-07:00", true},
+		{"0 7 * * *", "23:00-07:00", true},
+		{"59 22 1 1 *", "23:00-07:00", true},
+		{"0 3 * * *", "", true},
+	} {
+		p, err := newFetchPlan(autoFetchModeCron, 30, tt.cron, tt.quiet, 0, 0)
+		if (err == nil) != tt.ok {
+			t.Errorf("newFetchPlan(%q, quiet %q) error = %v, want ok=%v", tt.cron, tt.quiet, err, tt.ok)
+			continue
+		}
+		// 合法的计划总能找到静默时段之外的下一次执行时间
+		if err == nil && tt.quiet != "" {
+			next := p.nextRun(time.UnixMicro(micros("2026-10-18 22:00")), p.interval)
+			if next.IsZero() || p.quiet.contains(next) {
+				t.Errorf("%q with quiet %q: next run %s", tt.cron, tt.quiet, next)
+			}
+		}
+	}
+}
+
+func TestAdaptiveFinish(t *testing.T) {
+	p, err := newFetchPlan(autoFetchModeAdaptive, 20, "", "", 5, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &autoFetchScheduler{plan: p, interval: p.interval}
+
+	steps := []struct {
+		newRecords int
+		succeeded  bool
+		want       int
+	}{
+		{0, false, 20}, // 失败不放慢
+		{0, true, 40},
+		{0, true, 60}, // 不超过上限
+		{5, true, 60},
+		{adaptiveBusyRecords, true, 30},
+		{adaptiveBusyRecords, true, 15},
+		{adaptiveBusyRecords, true, 7},
+		{adaptiveBusyRecords, true, 5}, // 不低于下限
+	}
+	for i, step := range steps {
+		s.finish("", step.newRecords, step.succeeded)
+		if s.interval != step.want {
+			t.Fatalf("step %d: interval = %d, want %d", i, s.interval, step.want)
+		}
+	}
+}
+
+// 同步进行中时，手动拉取、导入与合并返回 409，自动拉取直接跳过
+func TestSyncLockCollision(t *testing.T) {
+	release, ok := scheduler.acquire("auto")
+	if !ok {
+		t.Fatal("acquire on idle scheduler failed")
+	}
+	defer release()
+
+	if _, ok := scheduler.acquire("manual"); ok {
+		t.Fatal("second acquire succeeded while a sync is running")
+	}
+
+	r := gin.New()
+	r.POST("/api/fetch", fetchPointsHistory)
+	r.POST("/api/import", importHistoryHandler)
+	r.POST("/api/merge", mergeDatabaseHandler)
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/api/fetch", strings.NewReader(`{"cookie":"c","form_key":"f","tchannel":"t"}`)),
+		httptest.NewRequest("POST", "/api/import?format=jsonl", strings.NewReader(`{"id":"1","point_cost":1,"creation_time":1,"bot_name":"b"}`)),
+		httptest.NewRequest("POST", "/api/merge?account=bob", strings.NewReader(`{"path":"/nonexistent.db"}`)),
+	} {
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusConflict {
+			t.Errorf("%s: status %d, want 409", req.URL.Path, w.Code)
+		}
+	}
+
+	// 数据库未初始化，若未跳过会直接 panic
+	performAutoFetch()
+
+	st := scheduler.status()
+	if st.State != "running" || st.RunningTrigger != "auto" {
+		t.Errorf("status = %+v, want running auto", st)
+	}
+}
+
+func TestStopTimerTwice(t *testing.T) {
+	s := &autoFetchScheduler{}
+	s.stopTimer() // 未启动时停止
+
+	p, err := newFetchPlan(autoFetchModeInterval, 30, "", "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.start(p)
+	if !s.active() {
+		t.Fatal("timer not active after start")
+	}
+	s.stopTimer()
+	s.stopTimer()
+	if s.active() {
+		t.Fatal("timer still active after stop")
+	}
+	if st := s.status(); st.State != "stopped" || st.NextRunTime != nil {
+		t.Errorf("status after stop = %+v", st)
+	}
+}
+
+// 同步进行中重启定时器：同步锁保持不变，状态在同步结束后回到 scheduled
+func TestStartWhileSyncRunning(t *testing.T) {
+	s := &autoFetchScheduler{}
+	release, ok := s.acquire("manual")
+	if !ok {
+		t.Fatal("acquire failed")
+	}
+
+	interval, _ := newFetchPlan(autoFetchModeInterval, 30, "", "", 0, 0)
+	s.start(interval)
+	adaptive, _ := newFetchPlan(autoFetchModeAdaptive, 10, "", "", 5, 60)
+	s.start(adaptive)
+	defer s.stopTimer()
+
+	st := s.status()
+	if st.State != "running" || !st.IsRunning || st.Mode != autoFetchModeAdaptive || st.NextRunTime == nil {
+		t.Errorf("status while running = %+v", st)
+	}
+	if _, ok := s.acquire("auto"); ok {
+		t.Fatal("acquire succeeded while manual sync holds the lock")
+	}
+
+	release()
+	st = s.status()
+	if st.State != "scheduled" || st.IsRunning || st.IntervalMinutes != 10 {
+		t.Errorf("status after release = %+v", st)
+	}
+	if release, ok := s.acquire("auto"); !ok {
+		t.Fatal("acquire failed after release")
+	} else {
+		release()
+	}
+}
+
+// 并发读取状态与启停、加锁、记录结果，需配合 -race 运行
+func TestSchedulerConcurrentStatus(t *testing.T) {
+	s := &autoFetchScheduler{}
+	defer s.stopTimer()
+	p, _ := newFetchPlan(autoFetchModeAdaptive, 10, "", "23:00-07:00", 5, 60)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				st := s.status()
+				_ = st.State
+				s.staleAfter()
+				s.active()
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				switch (i + j) % 4 {
+				case 0:
+					s.start(p)
+				case 1:
+					s.stopTimer()
+				case 2:
+					if release, ok := s.acquire("manual"); ok {
+						release()
+					}
+				case 3:
+					s.finish("ok", j, true)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if release, ok := s.acquire("auto"); !ok {
+		t.Fatal("sync lock leaked")
+	} else {
+		release()
+	}
+}
+
+func TestWebhookDeliveryRetriesAndSigns(t *testing.T) {
+	setupTestDB(t)
+
+	var mu sync.Mutex
+	var bodies [][]byte
+	var signatures, events []string
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		signatures = append(signatures, r.Header.Get("x-poe-monitor-signature"))
+		events = append(events, r.Header.Get("x-poe-monitor-event"))
+		w.WriteHeader(statuses[len(bodies)-1])
+	}))
+	defer srv.Close()
+
+	n := &WebhookNotifier{client: srv.Client(), maxAttempts: 4, baseBackoff: time.Millisecond}
+	target := WebhookTarget{ID: 1, Name: "stub", Kind: "generic", URL: srv.URL, Secret: "s3cret", Events: "*"}
+	event := sampleNotificationEvents()[0]
+	if err := n.deliver(target, event); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+
+	if len(bodies) != 3 {
+		t.Fatalf("got %d attempts, want 3 (503, 429, 200)", len(bodies))
+	}
+	var payload struct {
+		Event   string `json:"event"`
+		Message string `json:"message"`
+		Data    Alert  `json:"data"`
+	}
+	if err := json.Unmarshal(bodies[2], &payload); err != nil {
+		t.Fatalf("payload is not JSON: %v", err)
+	}
+	if payload.Event != eventBudgetExceeded || payload.Message != event.Message || payload.Data.BudgetName != "sample" {
+		t.Errorf("unexpected payload %s", bodies[2])
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(bodies[2])
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signatures[2] != want {
+		t.Errorf("signature = %q, want %q", signatures[2], want)
+	}
+	if events[2] != eventBudgetExceeded {
+		t.Errorf("event header = %q", events[2])
+	}
+	for i := 1; i < len(bodies); i++ {
+		if string(bodies[i]) != string(bodies[0]) {
+			t.Errorf("attempt %d sent a different body", i+1)
+		}
+	}
+
+	rows, err := db.Query("SELECT attempt, status_code, success FROM webhook_deliveries ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var attempt, status, success int
+		rows.Scan(&attempt, &status, &success)
+		got = append(got, strings.Join([]string{strconv.Itoa(attempt), strconv.Itoa(status), strconv.Itoa(success)}, "/"))
+	}
+	if want := "1/503/0 2/429/0 3/200/1"; strings.Join(got, " ") != want {
+		t.Errorf("delivery log = %q, want %q", strings.Join(got, " "), want)
+	}
+}
+
+func TestWebhookDeliveryStopsOnClientError(t *testing.T) {
+	setupTestDB(t)
+
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.Header.Get("x-poe-monitor-signature") != "" {
+			t.Error("unsigned target sent a signature")
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	n := &WebhookNotifier{client: srv.Client(), maxAttempts: 4, baseBackoff: time.Millisecond}
+	target := WebhookTarget{ID: 1, Name: "stub", Kind: "slack", URL: srv.URL}
+	if err := n.deliver(target, sampleNotificationEvents()[2]); err == nil {
+		t.Fatal("deliver succeeded on 400")
+	}
+	if attempts != 1 {
+		t.Errorf("got %d attempts on 400, want 1", attempts)
+	}
+}
+
+func TestWebhookSecretIsWriteOnly(t *testing.T) {
+	setupTestDB(t)
+	r := gin.New()
+	r.GET("/api/webhooks", getWebhookTargets)
+	r.POST("/api/webhooks", createWebhookTarget)
+	r.PUT("/api/webhooks/:id", updateWebhookTarget)
+
+	w := doJSON(r, "POST", "/api/webhooks", `{"name":"ops","url":"https://example.com/hook","secret":"s3cret"}`)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "s3cret") || !strings.Contains(w.Body.String(), `"secret_set":true`) {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	w = doJSON(r, "GET", "/api/webhooks", "")
+	if strings.Contains(w.Body.String(), "s3cret") || !strings.Contains(w.Body.String(), `"secret_set":true`) {
+		t.Fatalf("list leaks secret: %s", w.Body)
+	}
+
+	// 更新时不传密钥保留原值，传入新值则替换
+	w = doJSON(r, "PUT", "/api/webhooks/1", `{"name":"ops-renamed"}`)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "s3cret") {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+	var secret string
+	db.QueryRow("SELECT secret FROM webhook_targets WHERE id = 1").Scan(&secret)
+	if secret != "s3cret" {
+		t.Errorf("secret after update without secret = %q", secret)
+	}
+	doJSON(r, "PUT", "/api/webhooks/1", `{"secret":"rotated"}`)
+	db.QueryRow("SELECT secret FROM webhook_targets WHERE id = 1").Scan(&secret)
+	if secret != "rotated" {
+		t.Errorf("secret after rotation = %q", secret)
+	}
+}
+
+// 手动拉取失败与自动拉取一样发送 credentials_expired / sync_failed 通知
+func TestManualFetchFailureNotifies(t *testing.T) {
+	setupTestDB(t)
+
+	var mu sync.Mutex
+	var events, bodies []string
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		events = append(events, r.Header.Get("x-poe-monitor-event"))
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+	}))
+	defer sink.Close()
+	if _, err := db.Exec(`INSERT INTO webhook_targets (name, url, events) VALUES ('ops', ?, 'sync_failed,credentials_expired')`, sink.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	var status int
+	var payload string
+	useFakePoe(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, payload)
+	}))
+	r := gin.New()
+	r.POST("/api/fetch", fetchPointsHistory)
+
+	tests := []struct {
+		name       string
+		status     int
+		payload    string
+		wantCode   int
+		wantEvent  string
+		wantInBody string
+	}{
+		{"unauthorized", http.StatusUnauthorized, "", http.StatusUnauthorized, eventCredentialsExpired, `401`},
+		{"bad request", http.StatusBadRequest, "", http.StatusBadGateway, eventSyncFailed, `Poe returned status 400`},
+		{"schema drift", http.StatusOK, `{"data":{"viewer":{}}}`, http.StatusBadGateway, eventSyncFailed, `pointsHistoryConnection`},
+	}
+	for _, tt := range tests {
+		status, payload = tt.status, tt.payload
+		w := doJSON(r, "POST", "/api/fetch", `{"cookie":"p-b=test","form_key":"formkey","tchannel":"tchannel"}`)
+		if w.Code != tt.wantCode {
+			t.Fatalf("%s: status %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body)
+		}
+		webhookNotifier.wg.Wait()
+
+		mu.Lock()
+		if len(events) != 1 || events[0] != tt.wantEvent || !strings.Contains(bodies[0], tt.wantInBody) || !strings.Contains(bodies[0], "manual") {
+			t.Errorf("%s: events %v, bodies %v", tt.name, events, bodies)
+		}
+		events, bodies = nil, nil
+		mu.Unlock()
+	}
+}
+
+func TestValidateWebhookTemplatePerEvent(t *testing.T) {
+	// 引用 sync_failed 专有字段的模板，只订阅该事件时合法
+	target := WebhookTarget{Name: "t", URL: "https://example.com", Events: eventSyncFailed,
+		Template: `{"code": {{json .Data.status_code}}}`}
+	if err := validateWebhookTarget(&target); err != nil {
+		t.Fatalf("template valid for sync_failed rejected: %v", err)
+	}
+	// 订阅全部事件时，预算告警数据没有该字段
+	target.Events = "*"
+	if err := validateWebhookTarget(&target); err == nil || !strings.Contains(err.Error(), eventBudgetExceeded) {
+		t.Errorf("want budget_exceeded template error, got %v", err)
+	}
+
+	target = WebhookTarget{Name: "t", URL: "https://example.com", Events: eventAnomalyDetected,
+		Template: `{"bot": {{json .Data.BotName}}, "score": {{.Data.Score}}}`}
+	if err := validateWebhookTarget(&target); err != nil {
+		t.Errorf("anomaly template rejected: %v", err)
+	}
+	target.Template = `{"bot": {{json .Data.Bot}}}`
+	if err := validateWebhookTarget(&target); err == nil {
+		t.Error("template with unknown anomaly field accepted")
+	}
+}
+
+func insertTestRecords(t *testing.T, records ...PointsHistoryNode) {
+	t.Helper()
+	for _, r := range records {
+		if _, err := db.Exec(`
+			INSERT INTO points_history (id, point_cost, creation_time, bot_name, bot_id, cursor, account)
+			VALUES (?, ?, ?, ?, ?, '', ?)
+		`, r.ID, r.PointCost, r.CreationTime, r.BotName, r.BotID, r.Account); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 最小 SMTP 接收端：记录连接次数和收到的邮件，reject 时直接以 554 拒绝
+type smtpSink struct {
+	mu       sync.Mutex
+	conns    int
+	reject   bool
+	messages []string
+	rcpts    []string
+}
+
+func startSMTPSink(t *testing.T) (*smtpSink, int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	sink := &smtpSink{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+	return sink, ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	s.mu.Lock()
+	s.conns++
+	reject := s.reject
+	s.mu.Unlock()
+	if reject {
+		io.WriteString(conn, "554 service unavailable\r\n")
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	io.WriteString(conn, "220 sink ready\r\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			io.WriteString(conn, "250 sink\r\n")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			s.mu.Lock()
+			s.rcpts = append(s.rcpts, strings.TrimSpace(line[len("RCPT TO:"):]))
+			s.mu.Unlock()
+			io.WriteString(conn, "250 OK\r\n")
+		case strings.HasPrefix(cmd, "DATA"):
+			io.WriteString(conn, "354 go ahead\r\n")
+			var body strings.Builder
+			for {
+				l, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				body.WriteString(l)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, body.String())
+			s.mu.Unlock()
+			io.WriteString(conn, "250 queued\r\n")
+		case strings.HasPrefix(cmd, "QUIT"):
+			io.WriteString(conn, "221 bye\r\n")
+			return
+		default:
+			io.WriteString(conn, "250 OK\r\n")
+		}
+	}
+}
+
+func (s *smtpSink) snapshot() (int, []string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns, append([]string(nil), s.messages...), append([]string(nil), s.rcpts...)
+}
+
+func TestEmailDigestBackoffAndDelivery(t *testing.T) {
+	setupTestDB(t)
+	sink, port := startSMTPSink(t)
+	sink.mu.Lock()
+	sink.reject = true
+	sink.mu.Unlock()
+
+	r := gin.New()
+	r.POST("/api/email/settings", saveEmailSettings)
+	body := `{"smtp_host":"127.0.0.1","smtp_port":` + strconv.Itoa(port) + `,"tls_mode":"none",` +
+		`"from_address":"Monitor <monitor@example.com>","recipients":"a@example.com, \"Ops, Team\" <b@example.com>",` +
+		`"daily_enabled":true,"daily_hour":8}`
+	if w := doJSON(r, "POST", "/api/email/settings", body); w.Code != http.StatusOK {
+		t.Fatalf("save settings: %d %s", w.Code, w.Body)
+	}
+	insertTestRecords(t, PointsHistoryNode{ID: "1", PointCost: 120, CreationTime: micros("2026-03-09 10:00"), BotName: "GPT-4o"})
+
+	now := time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC)
+	// 失败后 5 分钟内不重试，之后间隔加倍
+	steps := []struct {
+		offset time.Duration
+		conns  int
+	}{
+		{0, 1},
+		{time.Minute, 1},
+		{4 * time.Minute, 1},
+		{5 * time.Minute, 2},
+		{14 * time.Minute, 2},
+		{15 * time.Minute, 3},
+		{30 * time.Minute, 3},
+	}
+	for _, step := range steps {
+		checkEmailDigests(now.Add(step.offset))
+		if conns, _, _ := sink.snapshot(); conns != step.conns {
+			t.Fatalf("at +%s: %d connections, want %d", step.offset, conns, step.conns)
+		}
+	}
+	if _, ok := getAppState(emailDailyStateKey); ok {
+		t.Fatal("failed digest must not be marked as sent")
+	}
+
+	sink.mu.Lock()
+	sink.reject = false
+	sink.mu.Unlock()
+	checkEmailDigests(now.Add(35 * time.Minute))
+	conns, messages, rcpts := sink.snapshot()
+	if conns != 4 || len(messages) != 1 {
+		t.Fatalf("delivery: conns=%d messages=%d", conns, len(messages))
+	}
+	if !strings.Contains(messages[0], "Subject: ") || !strings.Contains(messages[0], "2026-03-09") {
+		t.Fatalf("unexpected message:\n%s", messages[0])
+	}
+	if strings.Join(rcpts, ",") != "<a@example.com>,<b@example.com>" {
+		t.Fatalf("recipients = %v", rcpts)
+	}
+	if last, _ := getAppState(emailDailyStateKey); last != "2026-03-10" {
+		t.Fatalf("state = %q", last)
+	}
+
+	// 已发送的当天不会再发
+	checkEmailDigests(now.Add(2 * time.Hour))
+	if conns, _, _ := sink.snapshot(); conns != 4 {
+		t.Fatalf("resent after success: %d connections", conns)
+	}
+}
+
+func TestSaveEmailSettingsValidatesAddresses(t *testing.T) {
+	setupTestDB(t)
+	r := gin.New()
+	r.POST("/api/email/settings", saveEmailSettings)
+
+	tests := []struct {
+		from, recipients string
+		ok               bool
+	}{
+		{"monitor@example.com", "a@example.com", true},
+		{"", "", true}, // 留空表示暂不发送
+		{"Monitor <monitor@example.com>", "a@example.com, Ops <b@example.com>", true},
+		{"monitor", "a@example.com", false},
+		{"monitor@example.com", "a@example.com; b@example.com", false},
+		{"monitor@example.com", "not an address", false},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(gin.H{"smtp_port": 25, "from_address": tt.from, "recipients": tt.recipients})
+		w := doJSON(r, "POST", "/api/email/settings", string(body))
+		if (w.Code == http.StatusOK) != tt.ok {
+			t.Errorf("from %q recipients %q: status %d: %s", tt.from, tt.recipients, w.Code, w.Body)
+		}
+	}
+}
+
+// 把 Poe 请求指向测试服务器，并放开请求限速
+func useFakePoe(t *testing.T, handler http.Handler) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	baseURL, limiter := poeBaseURL, poeLimiter
+	poeBaseURL, poeLimiter = srv.URL, newTokenBucket(1000, 1000)
+	t.Cleanup(func() { poeBaseURL, poeLimiter = baseURL, limiter })
+}
+
+func enableAutoFetchConfig(t *testing.T) {
+	t.Helper()
+	if err := upsertConfig("p-b=test", "formkey", "tchannel", "rev", "tag", 1, 0, "USD", "USD", 30, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeCursorRetryLimit(t *testing.T) {
+	setupTestDB(t)
+	enableAutoFetchConfig(t)
+
+	recent := time.Now().Add(-time.Hour).UnixMicro()
+	insertTestRecords(t, PointsHistoryNode{ID: "dup", PointCost: 1, CreationTime: recent, BotName: "bot"})
+
+	var mu sync.Mutex
+	requested := map[string]int{}
+	useFakePoe(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Variables struct {
+				Cursor string `json:"cursor"`
+			} `json:"variables"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		requested[req.Variables.Cursor]++
+		mu.Unlock()
+
+		edges := "[]"
+		switch req.Variables.Cursor {
+		case "":
+			edges = `[{"node":{"id":"dup","pointCost":1,"creationTime":` + strconv.FormatInt(recent, 10) + `,"bot":{"displayName":"bot","id":"1"}},"cursor":"c0"}]`
+		case "good":
+			edges = `[{"node":{"id":"old","pointCost":7,"creationTime":` + strconv.FormatInt(recent-1000, 10) + `,"bot":{"displayName":"bot","id":"1"}},"cursor":"c1"}]`
+		}
+		io.WriteString(w, `{"data":{"viewer":{"pointsHistoryConnection":{"edges":`+edges+`,"pageInfo":{"endCursor":"","hasNextPage":false}}}}}`)
+	}))
+
+	// 旧版本保存的字符串数组仍可读取
+	setAppState(resumeCursorsKey, `["stale","good"]`)
+
+	for run := 1; run <= resumeCursorMaxAttempts; run++ {
+		performAutoFetch()
+		cursors := loadResumeCursors()
+		if run < resumeCursorMaxAttempts {
+			if len(cursors) != 2 || cursors[0].Cursor != "stale" || cursors[0].Attempts != run {
+				t.Fatalf("run %d: cursors = %+v", run, cursors)
+			}
+		} else if len(cursors) != 1 || cursors[0].Cursor != "good" {
+			t.Fatalf("stale cursor not dropped: %+v", cursors)
+		}
+	}
+
+	// 失效游标被丢弃后，后面的游标继续续传并在取到记录后移除
+	performAutoFetch()
+	if cursors := loadResumeCursors(); len(cursors) != 0 {
+		t.Fatalf("cursors after resume = %+v", cursors)
+	}
+	if exists, _ := recordExists("old"); !exists {
+		t.Fatal("record behind the saved cursor was not fetched")
+	}
+	mu.Lock()
+	if requested["stale"] != resumeCursorMaxAttempts || requested["good"] != 1 {
+		t.Fatalf("requests = %v", requested)
+	}
+	mu.Unlock()
+}
+
+// 请求失败和取消不计入续传尝试次数，只有空页才计数；游标被丢弃时发送通知
+func TestResumeCursorCountsOnlyEmptyPages(t *testing.T) {
+	setupTestDB(t)
+	useFreshAppContext(t)
+	enableAutoFetchConfig(t)
+
+	var mu sync.Mutex
+	var events, bodies []string
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		events = append(events, r.Header.Get("x-poe-monitor-event"))
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+	}))
+	defer sink.Close()
+	if _, err := db.Exec(`INSERT INTO webhook_targets (name, url, events) VALUES ('ops', ?, ?)`, sink.URL, eventResumeDropped); err != nil {
+		t.Fatal(err)
+	}
+
+	recent := time.Now().Add(-time.Hour).UnixMicro()
+	insertTestRecords(t, PointsHistoryNode{ID: "dup", PointCost: 1, CreationTime: recent, BotName: "bot"})
+
+	var failing atomic.Bool
+	failing.Store(true)
+	useFakePoe(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Variables struct {
+				Cursor string `json:"cursor"`
+			} `json:"variables"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		edges := "[]"
+		if req.Variables.Cursor == "" {
+			edges = `[{"node":{"id":"dup","pointCost":1,"creationTime":` + strconv.FormatInt(recent, 10) + `,"bot":{"displayName":"bot","id":"1"}},"cursor":"c0"}]`
+		} else if failing.Load() {
+			// Retry-After 超过上限时不再重试，直接返回 503
+			w.Header().Set("Retry-After", "86400")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{"data":{"viewer":{"pointsHistoryConnection":{"edges":`+edges+`,"pageInfo":{"endCursor":"","hasNextPage":false}}}}}`)
+	}))
+	saveResumeCursors([]resumeCursor{{Cursor: "stale", SavedAt: time.Now().Unix()}})
+
+	for run := 0; run < resumeCursorMaxAttempts+1; run++ {
+		performAutoFetch()
+	}
+	if cursors := loadResumeCursors(); len(cursors) != 1 || cursors[0].Attempts != 0 {
+		t.Fatalf("cursors after 5xx = %+v", cursors)
+	}
+
+	cancelAppCtx()
+	performAutoFetch()
+	if cursors := loadResumeCursors(); len(cursors) != 1 || cursors[0].Attempts != 0 {
+		t.Fatalf("cursors after cancel = %+v", cursors)
+	}
+
+	useFreshAppContext(t)
+	failing.Store(false)
+	for run := 1; run <= resumeCursorMaxAttempts; run++ {
+		performAutoFetch()
+	}
+	if cursors := loadResumeCursors(); len(cursors) != 0 {
+		t.Fatalf("stale cursor not dropped: %+v", cursors)
+	}
+	webhookNotifier.wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 || events[0] != eventResumeDropped || !strings.Contains(bodies[0], `"cursor":"stale"`) {
+		t.Fatalf("events %v, bodies %v", events, bodies)
+	}
+}
+
+func TestResetResumeCursors(t *testing.T) {
+	setupTestDB(t)
+	saveResumeCursors([]resumeCursor{{Cursor: "a", SavedAt: time.Now().Unix()}})
+	// 过期游标在读取时丢弃
+	saveResumeCursors(append(loadResumeCursors(), resumeCursor{Cursor: "old", SavedAt: time.Now().Add(-resumeCursorMaxAge - time.Hour).Unix()}))
+
+	r := gin.New()
+	r.GET("/api/sync/resume-cursors", getResumeCursors)
+	r.DELETE("/api/sync/resume-cursors", resetResumeCursors)
+	w := doJSON(r, "GET", "/api/sync/resume-cursors", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"cursor":"a"`) || strings.Contains(w.Body.String(), `"old"`) {
+		t.Fatalf("list: %d %s", w.Code, w.Body)
+	}
+
+	release, _ := scheduler.acquire("manual")
+	if w := doJSON(r, "DELETE", "/api/sync/resume-cursors", ""); w.Code != http.StatusConflict {
+		t.Fatalf("reset during sync: %d", w.Code)
+	}
+	release()
+	if w := doJSON(r, "DELETE", "/api/sync/resume-cursors", ""); w.Code != http.StatusOK {
+		t.Fatalf("reset: %d %s", w.Code, w.Body)
+	}
+	if cursors := loadResumeCursors(); len(cursors) != 0 {
+		t.Fatalf("cursors after reset = %+v", cursors)
+	}
+}
+
+// 对照 poesim 跑完整的手动和自动同步：分页、429 Retry-After、凭据过期和字段变化
+func TestSyncAgainstSimulator(t *testing.T) {
+	setupTestDB(t)
+	enableAutoFetchConfig(t)
+
+	sim, err := poesim.New(poesim.Options{RetryAfter: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	gqlRequests := 0
+	useFakePoe(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/gql_POST" {
+			mu.Lock()
+			gqlRequests++
+			// 只让第二页的第一次请求返回 429
+			switch gqlRequests {
+			case 2:
+				sim.SetFaults(map[string]float64{"rate_limit": 1})
+			case 3:
+				sim.SetFaults(nil)
+			}
+			mu.Unlock()
+		}
+		sim.Handler().ServeHTTP(w, r)
+	}))
+	simCall := func(method, path, body string) string {
+		w := doJSON(sim.Handler(), method, path, body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: %d %s", method, path, w.Code, w.Body)
+		}
+		return w.Body.String()
+	}
+
+	r := gin.New()
+	r.POST("/api/fetch", fetchPointsHistory)
+	fetch := func() (int, map[string]interface{}) {
+		w := doJSON(r, "POST", "/api/fetch", `{"cookie":"p-b=test","form_key":"formkey","tchannel":"tchannel"}`)
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	// 57 条记录分三页，第二页先被限流
+	simCall("POST", "/_sim/records?count=57", "")
+	started := time.Now()
+	code, resp := fetch()
+	if code != http.StatusOK || resp["new_records"] != float64(57) {
+		t.Fatalf("first fetch: %d %v", code, resp)
+	}
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Fatalf("Retry-After not honored, fetch took %s", elapsed)
+	}
+	var stats struct {
+		Requests map[string]int `json:"requests"`
+		Injected map[string]int `json:"injected"`
+	}
+	json.Unmarshal([]byte(simCall("GET", "/_sim/stats", "")), &stats)
+	if stats.Injected["rate_limit"] != 1 || stats.Requests["PointsHistoryPageColumnViewerPaginationQuery"] != 4 {
+		t.Fatalf("simulator stats = %+v", stats)
+	}
+
+	// 增量同步遇到已有记录即停止；追加的记录从当前时刻向前排，逐条追加以免早于已有记录
+	for i := 0; i < 3; i++ {
+		simCall("POST", "/_sim/records?count=1", "")
+	}
+	if code, resp := fetch(); code != http.StatusOK || resp["new_records"] != float64(3) {
+		t.Fatalf("incremental fetch: %d %v", code, resp)
+	}
+
+	simCall("PUT", "/_sim/faults", `{"expired_cookie":1}`)
+	if code, resp := fetch(); code != http.StatusUnauthorized {
+		t.Fatalf("expired cookie: %d %v", code, resp)
+	}
+	performAutoFetch()
+	if st := scheduler.status(); !strings.Contains(st.LastFetchResult, "401") && !strings.Contains(st.LastFetchResult, "expired") {
+		t.Fatalf("auto fetch with expired cookie: %q", st.LastFetchResult)
+	}
+
+	// 字段改名时同步失败，而不是报告 0 条新记录
+	simCall("PUT", "/_sim/faults", `{"schema_drift":1}`)
+	for i := 0; i < 2; i++ {
+		simCall("POST", "/_sim/records?count=1", "")
+	}
+	if code, resp := fetch(); code != http.StatusBadGateway || !strings.Contains(resp["error"].(string), "pointsHistoryConnection") {
+		t.Fatalf("schema drift: %d %v", code, resp)
+	}
+	performAutoFetch()
+	if st := scheduler.status(); !strings.Contains(st.LastFetchResult, "pointsHistoryConnection") {
+		t.Fatalf("auto fetch with schema drift: %q", st.LastFetchResult)
+	}
+
+	// 故障解除后补齐漏掉的记录
+	simCall("PUT", "/_sim/faults", `{}`)
+	if code, resp := fetch(); code != http.StatusOK || resp["new_records"] != float64(2) {
+		t.Fatalf("fetch after recovery: %d %v", code, resp)
+	}
+	var total int
+	db.QueryRow("SELECT COUNT(*) FROM points_history").Scan(&total)
+	if total != sim.Len() {
+		t.Fatalf("stored %d records, simulator has %d", total, sim.Len())
+	}
+}
+
+func TestPoeResponseValidate(t *testing.T) {
+	cases := map[string]string{
+		`{"errors":[{"message":"PersistedQueryNotFound"}],"data":null}`:                                                                     "PersistedQueryNotFound",
+		`{"data":{"viewer":{"pointsHistory":{"edges":[]}}}}`:                                                                                "missing pointsHistoryConnection",
+		`{"data":{"viewer":{"pointsHistoryConnection":{"edges":[{"node":{"id":"a","cost":5,"createdAt":1}}],"pageInfo":{}}}}}`:              "without id or creationTime",
+		`{"data":{"viewer":{"pointsHistoryConnection":{"edges":[],"pageInfo":{"hasNextPage":false}}}}}`:                                     "",
+		`{"data":{"viewer":{"pointsHistoryConnection":{"edges":[{"node":{"id":"a","creationTime":1}}],"pageInfo":{"hasNextPage":false}}}}}`: "",
+	}
+	for body, want := range cases {
+		var resp PoeResponse
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatal(err)
+		}
+		err := resp.validate()
+		if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("%s: err = %v, want %q", body, err, want)
+		}
+	}
+}
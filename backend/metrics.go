@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 本机账户在指标中的标签值
+const localAccountLabel = "local"
+
+// 直方图的桶上限（秒）
+var (
+	syncDurationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	poeLatencyBuckets   = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+)
+
+// 简单的累积直方图
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, upper := range h.buckets {
+		if value <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// 进程内累计的同步和 Poe API 指标，键为按顺序拼接的标签值
+type metricsRegistry struct {
+	mu sync.Mutex
+
+	syncRuns        map[[3]string]uint64 // account, trigger, outcome
+	syncNewRecords  map[[2]string]uint64 // account, trigger
+	syncDurations   map[[2]string]*histogram
+	syncLastSuccess map[[2]string]time.Time
+
+	apiRequests  map[[3]string]uint64 // account, operation, code
+	apiErrors    map[[3]string]uint64 // account, operation, kind
+	apiLatencies map[[2]string]*histogram
+}
+
+var appMetrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		syncRuns:        make(map[[3]string]uint64),
+		syncNewRecords:  make(map[[2]string]uint64),
+		syncDurations:   make(map[[2]string]*histogram),
+		syncLastSuccess: make(map[[2]string]time.Time),
+		apiRequests:     make(map[[3]string]uint64),
+		apiErrors:       make(map[[3]string]uint64),
+		apiLatencies:    make(map[[2]string]*histogram),
+	}
+}
+
+// 记录一次同步（trigger 为 auto 或 manual，outcome 为 success、error、skipped 或 canceled）
+func (m *metricsRegistry) recordSync(trigger, outcome string, started time.Time, newRecords int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.syncRuns[[3]string{localAccountLabel, trigger, outcome}]++
+	if outcome == "skipped" {
+		return
+	}
+
+	key := [2]string{localAccountLabel, trigger}
+	h, ok := m.syncDurations[key]
+	if !ok {
+		h = newHistogram(syncDurationBuckets)
+		m.syncDurations[key] = h
+	}
+	h.observe(time.Since(started).Seconds())
+	m.syncNewRecords[key] += uint64(newRecords)
+	if outcome == "success" {
+		m.syncLastSuccess[key] = time.Now()
+	}
+}
+
+// 记录一次 Poe API 请求，code 为 HTTP 状态码，网络错误时为 0
+func (m *metricsRegistry) recordAPIRequest(operation string, code int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := [2]string{localAccountLabel, operation}
+	h, ok := m.apiLatencies[key]
+	if !ok {
+		h = newHistogram(poeLatencyBuckets)
+		m.apiLatencies[key] = h
+	}
+	h.observe(duration.Seconds())
+
+	codeLabel := "error"
+	if code > 0 {
+		codeLabel = fmt.Sprint(code)
+	}
+	m.apiRequests[[3]string{localAccountLabel, operation, codeLabel}]++
+	switch {
+	case code == 0:
+		m.apiErrors[[3]string{localAccountLabel, operation, "network"}]++
+	case code >= 400:
+		m.apiErrors[[3]string{localAccountLabel, operation, "status"}]++
+	}
+}
+
+// 记录 Poe API 响应解析失败
+func (m *metricsRegistry) recordAPIParseError(operation string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apiErrors[[3]string{localAccountLabel, operation, "parse"}]++
+}
+
+// 统计 Poe API 请求延迟和错误的 RoundTripper，操作名取自 poe-queryname 请求头
+type instrumentedTransport struct {
+	base http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	operation := req.Header.Get("poe-queryname")
+	if operation == "" {
+		operation = "unknown"
+	}
+	started := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	code := 0
+	if err == nil {
+		code = resp.StatusCode
+	}
+	appMetrics.recordAPIRequest(operation, code, time.Since(started))
+	return resp, err
+}
+
+// Prometheus 文本格式输出
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (w *metricsWriter) header(name, metricType, help string) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (w *metricsWriter) sample(name string, labelNames, labelValues []string, value float64) {
+	fmt.Fprintf(&w.buf, "%s%s %s\n", name, formatLabels(labelNames, labelValues), formatMetricValue(value))
+}
+
+func (w *metricsWriter) histogram(name string, labelNames, labelValues []string, h *histogram) {
+	names := append(append([]string{}, labelNames...), "le")
+	for i, upper := range h.buckets {
+		w.sample(name+"_bucket", names, append(append([]string{}, labelValues...), formatMetricValue(upper)), float64(h.counts[i]))
+	}
+	w.sample(name+"_bucket", names, append(append([]string{}, labelValues...), "+Inf"), float64(h.count))
+	w.sample(name+"_sum", labelNames, labelValues, h.sum)
+	w.sample(name+"_count", labelNames, labelValues, float64(h.count))
+}
+
+// 按标签排序 map 的键，使输出稳定
+func sortedKeys3[V any](m map[[3]string]V) [][3]string {
+	keys := make([][3]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return strings.Join(keys[i][:], "\x00") < strings.Join(keys[j][:], "\x00")
+	})
+	return keys
+}
+
+func sortedKeys2[V any](m map[[2]string]V) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return strings.Join(keys[i][:], "\x00") < strings.Join(keys[j][:], "\x00")
+	})
+	return keys
+}
+
+// 从数据库写出用量相关指标
+func writeUsageMetrics(w *metricsWriter) error {
+	now := time.Now()
+	account := []string{"account"}
+
+	// 各账户本周期的积分消耗：本机账户按订阅方案，合并的账户按其订阅日
+	type cycle struct {
+		name       string
+		start, end int64
+	}
+	localStart, localEnd := getPlanPeriodByOffset(0)
+	cycles := []cycle{{"", localStart, localEnd}}
+	rows, err := db.Query("SELECT name, COALESCE(subscription_day, 1) FROM accounts ORDER BY name")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		var day int
+		if err := rows.Scan(&name, &day); err != nil {
+			rows.Close()
+			return err
+		}
+		if day <= 0 || day > 31 {
+			day = 1
+		}
+		start, end := getCurrentSubscriptionPeriod(day, now.UnixMicro())
+		cycles = append(cycles, cycle{name, start, end})
+	}
+	rows.Close()
+
+	w.header("poe_cycle_points_used", "gauge", "Points used in the current subscription cycle.")
+	for _, c := range cycles {
+		var used int64
+		if err := db.QueryRow(`
+			SELECT COALESCE(SUM(point_cost), 0) FROM points_history
+			WHERE creation_time >= ? AND creation_time < ? AND `+accountFilter+`
+		`, c.start, c.end, c.name).Scan(&used); err != nil {
+			return err
+		}
+		w.sample("poe_cycle_points_used", account, []string{accountLabel(c.name)}, float64(used))
+	}
+
+	w.header("poe_cycle_end_timestamp_seconds", "gauge", "End of the current subscription cycle.")
+	for _, c := range cycles {
+		w.sample("poe_cycle_end_timestamp_seconds", account, []string{accountLabel(c.name)}, float64(c.end)/1e6)
+	}
+
+	allotment, _ := getAllotmentForPeriod(localStart, getCurrentPlan().Allotment)
+	w.header("poe_cycle_allotment_points", "gauge", "Point allotment of the current subscription cycle.")
+	w.sample("poe_cycle_allotment_points", account, []string{localAccountLabel}, float64(allotment))
+
+	var balance, capturedAt int64
+	err = db.QueryRow("SELECT current_balance, captured_at FROM points_snapshots ORDER BY captured_at DESC LIMIT 1").Scan(&balance, &capturedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		w.header("poe_points_balance", "gauge", "Subscription point balance from the latest snapshot.")
+		w.sample("poe_points_balance", account, []string{localAccountLabel}, float64(balance))
+		w.header("poe_points_balance_timestamp_seconds", "gauge", "Capture time of the latest balance snapshot.")
+		w.sample("poe_points_balance_timestamp_seconds", account, []string{localAccountLabel}, float64(capturedAt)/1e6)
+	}
+
+	// 各机器人的累计积分和消息数
+	rows, err = db.Query(`
+		SELECT COALESCE(account, ''), bot_name, SUM(point_cost), COUNT(*)
+		FROM points_history GROUP BY COALESCE(account, ''), bot_name
+		ORDER BY 1, 2
+	`)
+	if err != nil {
+		return err
+	}
+	type botRow struct {
+		account, bot    string
+		points, message int64
+	}
+	var bots []botRow
+	for rows.Next() {
+		var b botRow
+		if err := rows.Scan(&b.account, &b.bot, &b.points, &b.message); err != nil {
+			rows.Close()
+			return err
+		}
+		bots = append(bots, b)
+	}
+	rows.Close()
+
+	// 按已存储的历史汇总而非进程内累加：合并时 conflict=theirs 会覆盖已有记录，
+	// 数值可能下降，作为 counter 会被 rate() 误判为重置，因此以 gauge 输出
+	accountBot := []string{"account", "bot"}
+	w.header("poe_bot_points", "gauge", "Points spent per bot in the stored history.")
+	for _, b := range bots {
+		w.sample("poe_bot_points", accountBot, []string{accountLabel(b.account), b.bot}, float64(b.points))
+	}
+	w.header("poe_bot_messages", "gauge", "Messages per bot in the stored history.")
+	for _, b := range bots {
+		w.sample("poe_bot_messages", accountBot, []string{accountLabel(b.account), b.bot}, float64(b.message))
+	}
+
+	// 最新记录的时间
+	rows, err = db.Query(`
+		SELECT COALESCE(account, ''), MAX(creation_time) FROM points_history
+		GROUP BY COALESCE(account, '') ORDER BY 1
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	w.header("poe_newest_record_age_seconds", "gauge", "Age of the newest points history record.")
+	for rows.Next() {
+		var name string
+		var newest int64
+		if err := rows.Scan(&name, &newest); err != nil {
+			return err
+		}
+		age := now.Sub(time.UnixMicro(newest)).Seconds()
+		w.sample("poe_newest_record_age_seconds", account, []string{accountLabel(name)}, age)
+	}
+	return rows.Err()
+}
+
+// 写出进程内累计的同步和 Poe API 指标
+func (m *metricsRegistry) write(w *metricsWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.header("poe_sync_runs_total", "counter", "Sync runs by trigger and outcome.")
+	for _, k := range sortedKeys3(m.syncRuns) {
+		w.sample("poe_sync_runs_total", []string{"account", "trigger", "outcome"}, k[:], float64(m.syncRuns[k]))
+	}
+	w.header("poe_sync_new_records_total", "counter", "Records inserted by sync runs.")
+	for _, k := range sortedKeys2(m.syncNewRecords) {
+		w.sample("poe_sync_new_records_total", []string{"account", "trigger"}, k[:], float64(m.syncNewRecords[k]))
+	}
+	w.header("poe_sync_duration_seconds", "histogram", "Duration of sync runs.")
+	for _, k := range sortedKeys2(m.syncDurations) {
+		w.histogram("poe_sync_duration_seconds", []string{"account", "trigger"}, k[:], m.syncDurations[k])
+	}
+	w.header("poe_sync_last_success_timestamp_seconds", "gauge", "Time of the last successful sync run.")
+	for _, k := range sortedKeys2(m.syncLastSuccess) {
+		w.sample("poe_sync_last_success_timestamp_seconds", []string{"account", "trigger"}, k[:], float64(m.syncLastSuccess[k].Unix()))
+	}
+
+	w.header("poe_api_requests_total", "counter", "Poe API requests by operation and HTTP status code.")
+	for _, k := range sortedKeys3(m.apiRequests) {
+		w.sample("poe_api_requests_total", []string{"account", "operation", "code"}, k[:], float64(m.apiRequests[k]))
+	}
+	w.header("poe_api_errors_total", "counter", "Poe API errors by operation and kind (network, status, parse).")
+	for _, k := range sortedKeys3(m.apiErrors) {
+		w.sample("poe_api_errors_total", []string{"account", "operation", "kind"}, k[:], float64(m.apiErrors[k]))
+	}
+	w.header("poe_api_request_duration_seconds", "histogram", "Latency of Poe API requests.")
+	for _, k := range sortedKeys2(m.apiLatencies) {
+		w.histogram("poe_api_request_duration_seconds", []string{"account", "operation"}, k[:], m.apiLatencies[k])
+	}
+}
+
+// Prometheus 指标
+func metricsHandler(c *gin.Context) {
+	w := &metricsWriter{}
+	if err := writeUsageMetrics(w); err != nil {
+		c.String(http.StatusInternalServerError, "# error: %v\n", err)
+		return
+	}
+	appMetrics.write(w)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", w.buf.Bytes())
+}
+
+// 最近一次成功同步的时间（任意触发方式），尚未成功过则为零值
+func (m *metricsRegistry) lastSyncSuccess() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var latest time.Time
+	for _, t := range m.syncLastSuccess {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
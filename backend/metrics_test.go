@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite testdata golden files")
+
+func TestMetricsWriterHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.5, 1, 2.5})
+	for _, v := range []float64{0.25, 0.75, 1, 3} {
+		h.observe(v)
+	}
+
+	w := &metricsWriter{}
+	w.histogram("poe_x_seconds", []string{"account", "operation"}, []string{"local", "q"}, h)
+	want := `poe_x_seconds_bucket{account="local",operation="q",le="0.5"} 1
+poe_x_seconds_bucket{account="local",operation="q",le="1"} 3
+poe_x_seconds_bucket{account="local",operation="q",le="2.5"} 3
+poe_x_seconds_bucket{account="local",operation="q",le="+Inf"} 4
+poe_x_seconds_sum{account="local",operation="q"} 5
+poe_x_seconds_count{account="local",operation="q"} 4
+`
+	if got := w.buf.String(); got != want {
+		t.Errorf("histogram output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMetricsWriterEscapesLabels(t *testing.T) {
+	w := &metricsWriter{}
+	w.header("poe_x", "gauge", "Test metric.")
+	w.sample("poe_x", []string{"bot"}, []string{"a\\b \"c\"\nd"}, 1.5)
+	w.sample("poe_x", nil, nil, 1e21)
+	want := `# HELP poe_x Test metric.
+# TYPE poe_x gauge
+poe_x{bot="a\\b \"c\"\nd"} 1.5
+poe_x 1e+21
+`
+	if got := w.buf.String(); got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// 随当前时间变化的指标值，比较前替换为占位符
+var dynamicMetricLine = regexp.MustCompile(`(?m)^(poe_cycle_end_timestamp_seconds|poe_newest_record_age_seconds)(\{[^}]*\}) (\S+)$`)
+
+func TestMetricsGolden(t *testing.T) {
+	setupTestDB(t)
+	saved := appMetrics
+	appMetrics = newMetricsRegistry()
+	t.Cleanup(func() { appMetrics = saved })
+
+	now := time.Now()
+	localStart, localEnd := getPlanPeriodByOffset(0)
+	bobStart, bobEnd := getCurrentSubscriptionPeriod(15, now.UnixMicro())
+	for _, q := range []struct {
+		query string
+		args  []any
+	}{
+		{"INSERT INTO cycle_allotments (period_start, manual_allotment) VALUES (?, ?)", []any{localStart, 1000}},
+		{"INSERT INTO accounts (name, subscription_day) VALUES ('bob', 15)", nil},
+		{"INSERT INTO points_snapshots (total_allotment, current_balance, captured_at) VALUES (1000, 640, 1767225600000000)", nil},
+	} {
+		if _, err := db.Exec(q.query, q.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insertTestRecords(t,
+		PointsHistoryNode{ID: "l1", PointCost: 300, CreationTime: localStart + 1, BotName: "Assistant"},
+		PointsHistoryNode{ID: "l2", PointCost: 60, CreationTime: localStart + 2, BotName: `My "bot"\`},
+		PointsHistoryNode{ID: "b1", PointCost: 70, CreationTime: bobStart - 1, BotName: "Assistant", Account: "bob"},
+		PointsHistoryNode{ID: "b2", PointCost: 5, CreationTime: bobStart + 1, BotName: "Assistant", Account: "bob"},
+	)
+
+	appMetrics.recordAPIRequest("q", 200, 300*time.Millisecond)
+	appMetrics.recordAPIRequest("q", 503, 2*time.Second)
+	appMetrics.recordAPIRequest("q", 0, 45*time.Second)
+	appMetrics.recordAPIParseError("q")
+	// 同步耗时取决于真实时间，直接写入固定的观测值
+	key := [2]string{localAccountLabel, "auto"}
+	appMetrics.syncRuns[[3]string{localAccountLabel, "auto", "success"}] = 2
+	appMetrics.syncRuns[[3]string{localAccountLabel, "manual", "skipped"}] = 1
+	appMetrics.syncNewRecords[key] = 12
+	appMetrics.syncDurations[key] = newHistogram(syncDurationBuckets)
+	appMetrics.syncDurations[key].observe(4)
+	appMetrics.syncDurations[key].observe(0.5)
+	appMetrics.syncLastSuccess[key] = time.Unix(1767225600, 0)
+
+	r := gin.New()
+	r.GET("/metrics", metricsHandler)
+	w := doJSON(r, "GET", "/metrics", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	wantEnds := map[string]int64{`{account="local"}`: localEnd, `{account="bob"}`: bobEnd}
+	got := dynamicMetricLine.ReplaceAllStringFunc(w.Body.String(), func(line string) string {
+		m := dynamicMetricLine.FindStringSubmatch(line)
+		value, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Errorf("%s: %v", line, err)
+		}
+		switch m[1] {
+		case "poe_cycle_end_timestamp_seconds":
+			if value != float64(wantEnds[m[2]])/1e6 {
+				t.Errorf("%s: want %v", line, float64(wantEnds[m[2]])/1e6)
+			}
+		default:
+			if value < 0 {
+				t.Errorf("%s: negative age", line)
+			}
+		}
+		return m[1] + m[2] + " <dynamic>"
+	})
+
+	path := filepath.Join("testdata", "metrics.golden")
+	if *updateGolden {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("/metrics output differs from %s (run go test -run TestMetricsGolden -update):\n%s", path, got)
+	}
+}